@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/jdeisenh/lsdalm/pkg/lsdalm"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 )
 
@@ -15,19 +21,66 @@ func main() {
 	url := flag.String("url", "", "Channel URL")
 	name := flag.String("name", "default", "Channel ID")
 	debug := flag.Bool("debug", false, "set log level to debug")
-	dir := flag.String("dumpdir", "", "Directory to store manifests and segments")
+	dir := flag.String("dumpdir", "", "Directory to store manifests and segments, or s3://bucket/prefix?endpoint=URL")
 	accessMedia := flag.Bool("accessmedia", false, "Access all Media segments")
 	verifyMedia := flag.Bool("verifymedia", false, "Verify all Media segments")
 	storeMedia := flag.Bool("storemedia", false, "Store all Media segments")
+	checkAvailability := flag.Bool("checkavailability", false, "Probe new segments around their availability time")
 	workers := flag.Int("workers", 1, "Number of parallel downloads")
 	nodate := flag.Bool("nodate", false, "Do not append date to storage directory name")
 	listen := flag.String("replayport", "", "socket:Port for timeshift replay server (e.g. :8080)")
 	jsonLog := flag.Bool("json", false, "JSON logging output")
+	metrics := flag.String("metrics", "", "socket:Port for prometheus metrics (e.g. :9100)")
 
 	pollTime := flag.Duration("pollInterval", 5*time.Second, "Poll Interval in milliseconds")
 	timeLimit := flag.Duration("timelimit", 0, "Time limit")
+	fetchWindow := flag.Duration("fetchwindow", 5*time.Minute, "Fetch only segments this far behind the live edge (0 = all)")
+	backfill := flag.String("backfill", "", "Fetch the whole DVR window of the first manifest: oldest or newest first")
+	backfillRate := flag.Float64("backfillrate", 10, "Segment requests per second during backfill (0 = unlimited)")
+	drain := flag.Duration("drain", 10*time.Second, "Time to finish queued downloads on exit")
+	manifestFormat := flag.String("manifestformat", lsdalm.ManifestPlain, "Store manifests as plain, gzip, zstd or delta")
+	dedup := flag.Bool("dedup", false, "Store manifests identical to the previous one only in the manifest index")
 	maxRetries := flag.Int("maxRetries", 0, "Exit after N consecutive poll failures (0 = never)")
 
+	retryPolicy := lsdalm.DefaultRetryPolicy()
+	flag.IntVar(&retryPolicy.MaxAttempts, "fetchAttempts", retryPolicy.MaxAttempts, "Attempts per manifest or segment request (1 = no retries)")
+	flag.DurationVar(&retryPolicy.InitialBackoff, "retryBackoff", retryPolicy.InitialBackoff, "Wait before the first retry, doubled for every further one")
+	flag.DurationVar(&retryPolicy.MaxBackoff, "retryMaxBackoff", retryPolicy.MaxBackoff, "Maximum wait between retries")
+	flag.Float64Var(&retryPolicy.Jitter, "retryJitter", retryPolicy.Jitter, "Random fraction (0-1) applied to retry waits")
+	flag.DurationVar(&retryPolicy.RequestTimeout, "requestTimeout", retryPolicy.RequestTimeout, "Timeout for a single request (0 = none)")
+	flag.Func("retryStatus", "Comma separated http status codes to retry (default 408,429,500,502,503,504)", func(v string) error {
+		retryPolicy.RetryStatus = retryPolicy.RetryStatus[:0]
+		for _, code := range strings.Split(v, ",") {
+			c, err := strconv.Atoi(strings.TrimSpace(code))
+			if err != nil {
+				return err
+			}
+			retryPolicy.RetryStatus = append(retryPolicy.RetryStatus, c)
+		}
+		return nil
+	})
+
+	var retention lsdalm.RetentionPolicy
+	flag.DurationVar(&retention.MaxAge, "maxage", 0, "Delete recorded data older than this (0 = keep)")
+	flag.Func("maxsize", "Delete the oldest recorded data above this size per channel, e.g. 500G", func(v string) error {
+		var err error
+		retention.MaxSize, err = lsdalm.ParseSize(v)
+		return err
+	})
+	flag.DurationVar(&retention.Rotate, "rotate", 0, "Start a new recording directory at multiples of this, e.g. 24h (0 = never)")
+
+	var trackFilter lsdalm.TrackFilter
+	trackFilter.RegisterFlags(flag.CommandLine)
+
+	httpConfig := lsdalm.NewHttpConfig()
+	httpConfig.RegisterFlags(flag.CommandLine)
+
+	var rewriter lsdalm.UrlRewriter
+	rewriter.RegisterFlags(flag.CommandLine)
+
+	timeServer := lsdalm.NewTimeServer()
+	timeServer.RegisterFlags(flag.CommandLine)
+
 	flag.Parse()
 
 	var logger zerolog.Logger
@@ -73,11 +126,63 @@ func main() {
 		logger.Fatal().Err(err).Send()
 		return
 	}
+	if err := sg.SetHttpConfig(httpConfig); err != nil {
+		logger.Fatal().Err(err).Msg("Http config")
+	}
+	sg.SetRetryPolicy(retryPolicy)
+	if err := sg.SetManifestFormat(*manifestFormat); err != nil {
+		logger.Fatal().Err(err).Msg("Manifest format")
+	}
+	if *dedup {
+		sg.EnableManifestDedup()
+	}
+	if err := sg.SetFetchWindow(*fetchWindow); err != nil {
+		logger.Fatal().Err(err).Msg("Fetch window")
+	}
+	if *backfill != "" {
+		if err := sg.EnableBackfill(*backfill, *backfillRate); err != nil {
+			logger.Fatal().Err(err).Msg("Backfill")
+		}
+	}
+	if err := trackFilter.Validate(); err != nil {
+		logger.Fatal().Err(err).Msg("Track filter")
+	}
+	if err := sg.SetTrackFilter(&trackFilter); err != nil {
+		logger.Fatal().Err(err).Msg("Track filter")
+	}
+	if *checkAvailability {
+		sg.EnableAvailabilityCheck()
+	}
+	if retention != (lsdalm.RetentionPolicy{}) {
+		if *dir == "" {
+			logger.Fatal().Msg("Retention needs -dumpdir")
+		}
+		if retention.Rotate > 0 && *listen != "" {
+			logger.Fatal().Msg("Rotation is not supported with the timeshift replay server")
+		}
+		sg.SetRetentionPolicy(retention)
+	}
+
+	// Export metrics
+	if *metrics != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			logger.Fatal().Err(http.ListenAndServe(*metrics, mux)).Send()
+		}()
+		logger.Info().Msgf("Serving metrics on %s", *metrics)
+	}
 
 	// If a port is given, we handle replay requests
 	if *listen != "" && *dir != "" {
 		var err error
-		sr, err := lsdalm.NewStreamReplay(sg.GetDumpDir(), logger)
+		sr, err := lsdalm.NewStreamReplayWithStorage(sg.GetStorage(), sg.GetDumpDir(), logger)
+		if err == nil {
+			err = sr.SetUrlRewriter(&rewriter)
+		}
+		if err == nil {
+			err = sr.SetTimeServer(timeServer)
+		}
 		if err != nil {
 			logger.Fatal().Err(err).Send()
 		} else {
@@ -86,6 +191,8 @@ func main() {
 			})
 			// Paths for segments
 			http.HandleFunc("/manifest.mpd", sr.Handler)
+			http.Handle(lsdalm.TimePath, timeServer)
+			http.Handle(lsdalm.TimePath+"/", timeServer)
 			http.HandleFunc("/", sr.FileHandler)
 			go func() {
 				logger.Fatal().Err(http.ListenAndServe(*listen, nil)).Send()
@@ -94,13 +201,17 @@ func main() {
 		}
 	}
 
-	if *timeLimit == time.Duration(0) {
-		if err := sg.Do(*maxRetries); err != nil {
-			logger.Fatal().Err(err).Send()
-		}
-	} else {
-		go sg.Do(*maxRetries)
-		time.Sleep(*timeLimit)
-		sg.Done()
+	// Stop on SIGTERM/Interrupt or when the time limit expires
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeLimit > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeLimit)
+		defer cancel()
+	}
+	err = sg.Do(ctx, *maxRetries)
+	sg.Drain(*drain)
+	if err != nil {
+		logger.Fatal().Err(err).Send()
 	}
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jdeisenh/lsdalm/pkg/lsdalm"
+	"github.com/rs/zerolog"
+)
+
+func main() {
+
+	logger := zerolog.New(zerolog.ConsoleWriter{
+		Out:        os.Stderr,
+		TimeFormat: time.TimeOnly,
+	}).With().Timestamp().Logger()
+
+	debug := flag.Bool("debug", false, "set log level to debug")
+	dump := flag.String("dumpdir", "", "Recording directory to read from, or s3://bucket/prefix")
+	out := flag.String("out", "", "Directory to write the MP4 files to")
+	fromFlag := flag.String("from", "", "Start: RFC3339 time or offset from recording start, e.g. 10m (default: recording start)")
+	toFlag := flag.String("to", "", "End: RFC3339 time, offset from recording start, or negative offset from the end (default: recording end)")
+	reps := flag.String("reps", "", "Representation ids to write, comma separated (default: all)")
+	zeroTfdt := flag.Bool("zerotfdt", false, "Rewrite decode times to start at zero")
+	mux := flag.Bool("mux", false, "Mux the selected video and audio representation into one file")
+
+	flag.Parse()
+
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	}
+	if *dump == "" || *out == "" {
+		flag.Usage()
+		return
+	}
+	opts := lsdalm.ConcatOptions{ZeroTfdt: *zeroTfdt, Mux: *mux}
+	for _, r := range strings.Split(*reps, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			opts.RepIds = append(opts.RepIds, r)
+		}
+	}
+	sl, err := lsdalm.NewStreamLooper(*dump, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Send()
+	}
+	start, end := sl.RecordingRange()
+	from, err := lsdalm.ParseBound(*fromFlag, start, end, start)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("from")
+	}
+	to, err := lsdalm.ParseBound(*toFlag, start, end, end)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("to")
+	}
+	if from.Before(start) || to.After(end) {
+		logger.Fatal().Msgf("Range %s - %s outside of recording %s - %s",
+			from.Format(time.RFC3339), to.Format(time.RFC3339), start.Format(time.RFC3339), end.Format(time.RFC3339))
+	}
+	res, err := sl.Concat(*out, from, to, opts)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Concat")
+	}
+	for _, f := range res.Files {
+		logger.Info().Msgf("Wrote %s", f)
+	}
+	logger.Info().Int("segments", res.Segments).Int64("bytes", res.Bytes).Msgf("Concatenated %s", to.Sub(from))
+	if len(res.Missing) > 0 {
+		logger.Error().Int("missing", len(res.Missing)).Msg("Segments missing in recording")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/jdeisenh/lsdalm/pkg/lsdalm"
+	"github.com/rs/zerolog"
+)
+
+func main() {
+
+	logger := zerolog.New(zerolog.ConsoleWriter{
+		Out:        os.Stderr,
+		TimeFormat: time.TimeOnly,
+	}).With().Timestamp().Logger()
+
+	debug := flag.Bool("debug", false, "set log level to debug")
+	dump := flag.String("dumpdir", "", "Recording directory to export from, or s3://bucket/prefix")
+	out := flag.String("out", "", "Directory to write the VOD package to")
+	fromFlag := flag.String("from", "", "Start: RFC3339 time or offset from recording start, e.g. 10m (default: recording start)")
+	toFlag := flag.String("to", "", "End: RFC3339 time, offset from recording start, or negative offset from the end (default: recording end)")
+	splitScte := flag.Bool("splitscte", false, "Start a new period at every SCTE-35 event")
+
+	flag.Parse()
+
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	}
+	if *dump == "" || *out == "" {
+		flag.Usage()
+		return
+	}
+	sl, err := lsdalm.NewStreamLooper(*dump, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Send()
+	}
+	start, end := sl.RecordingRange()
+	from, err := lsdalm.ParseBound(*fromFlag, start, end, start)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("from")
+	}
+	to, err := lsdalm.ParseBound(*toFlag, start, end, end)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("to")
+	}
+	if from.Before(start) || to.After(end) {
+		logger.Fatal().Msgf("Range %s - %s outside of recording %s - %s",
+			from.Format(time.RFC3339), to.Format(time.RFC3339), start.Format(time.RFC3339), end.Format(time.RFC3339))
+	}
+	res, err := sl.Export(*out, from, to, *splitScte)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Export")
+	}
+	logger.Info().Int("periods", res.Periods).Int("segments", res.Segments).Int64("bytes", res.Bytes).
+		Msgf("Exported %s to %s", to.Sub(from), res.Dir)
+	if len(res.Missing) > 0 {
+		logger.Error().Int("missing", len(res.Missing)).Msg("Segments missing in recording")
+		os.Exit(1)
+	}
+}
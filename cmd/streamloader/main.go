@@ -27,6 +27,9 @@ func main() {
 	singleconn := flag.Bool("maxconn", false, "Use one TCP connection per session")
 	requestTimeout := flag.Duration("requestTimeout", 1*time.Second, "Timeout for single request")
 
+	httpConfig := lsdalm.NewHttpConfig()
+	httpConfig.RegisterFlags(flag.CommandLine)
+
 	flag.Parse()
 
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
@@ -45,6 +48,9 @@ func main() {
 		logger.Fatal().Err(err).Send()
 		return
 	}
+	if err := sg.SetHttpConfig(httpConfig); err != nil {
+		logger.Fatal().Err(err).Msg("Http config")
+	}
 
 	if *timeLimit == time.Duration(0) {
 		sg.Do()
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"cmp"
 	"flag"
 	"net/http"
 	"os"
@@ -18,8 +19,23 @@ func main() {
 	}).With().Timestamp().Logger()
 
 	debug := flag.Bool("debug", false, "set log level to debug")
-	dump := flag.String("dumpdir", "", "Directory to dump segments")
+	dump := flag.String("dumpdir", "", "Recording directory, or s3://bucket/prefix")
+	root := flag.String("root", "", "Serve all recordings below this directory, or s3://bucket/prefix, instead of -dumpdir")
+	loopRanges := flag.Bool("loopranges", false, "Loop across all continuous ranges of recordings with gaps, default: the longest range")
+	idle := flag.Duration("idle", streamgetter.DefaultIdleTimeout, "Unload recordings of -root after this time without requests")
 	listen := flag.String("listen", ":9080", "Adress/port to listen")
+	var rewriter streamgetter.UrlRewriter
+	rewriter.RegisterFlags(flag.CommandLine)
+	cacheProxy := flag.Bool("cacheproxy", false, "Fetch media missing in the recording from the origin, store and serve it")
+	httpConfig := streamgetter.NewHttpConfig()
+	httpConfig.RegisterFlags(flag.CommandLine)
+	timeServer := streamgetter.NewTimeServer()
+	timeServer.RegisterFlags(flag.CommandLine)
+	shapeFile := flag.String("shapetraces", "", "JSON file with named bandwidth schedules for "+streamgetter.ShapePathPrefix+"<spec>/ sessions")
+	accessFile := flag.String("accesslog", "", "Append the access log as JSON lines to this file, default: log output")
+	admin := flag.Bool("admin", false, "Serve the admin API below "+streamgetter.AdminPathPrefix+" (with -root: /<recording>"+streamgetter.AdminPathPrefix+")")
+	switchRoot := flag.String("switchroot", "", "Allow the admin API to switch to recordings below this directory, or s3://bucket/prefix, default: -root")
+	faultsFile := flag.String("faults", "", "JSON file with named fault profiles, e.g. {\"flaky\": \"errrate=0.1,errstatus=503\"}")
 
 	flag.Parse()
 
@@ -28,21 +44,105 @@ func main() {
 	if *debug {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	}
-	if *dump == "" {
+	if (*dump == "") == (*root == "") {
 		flag.Usage()
 		return
 	}
 	var err error
-	sg, err := streamgetter.NewStreamLooper(*dump, logger)
-	if err != nil {
-		logger.Fatal().Err(err).Send()
-		return
+	var profiles map[string]streamgetter.FaultProfile
+	if *faultsFile != "" {
+		if profiles, err = streamgetter.LoadFaultProfiles(*faultsFile); err != nil {
+			logger.Fatal().Err(err).Send()
+			return
+		}
+	}
+	var traces map[string]streamgetter.ShapeProfile
+	if *shapeFile != "" {
+		if traces, err = streamgetter.LoadShapeTraces(*shapeFile); err != nil {
+			logger.Fatal().Err(err).Send()
+			return
+		}
+	}
+	// Settings for every recording served
+	configure := func(sg *streamgetter.StreamLooper) error {
+		if err := sg.SetUrlRewriter(&rewriter); err != nil {
+			return err
+		}
+		if err := sg.SetTimeServer(timeServer); err != nil {
+			return err
+		}
+		sg.SetFaultProfiles(profiles)
+		sg.SetLoopAllRanges(*loopRanges)
+		if *cacheProxy {
+			return sg.EnableProxy(httpConfig)
+		}
+		return nil
 	}
 
-	// Paths for segments
-	http.HandleFunc("/manifest.mpd", sg.DynamicHandler)
-	http.HandleFunc("/static.mpd", sg.StaticHandler)
-	http.HandleFunc("/", sg.FileHandler)
+	accessLogger := logger
+	if *accessFile != "" {
+		f, err := os.OpenFile(*accessFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			logger.Fatal().Err(err).Send()
+			return
+		}
+		defer f.Close()
+		accessLogger = zerolog.New(f).With().Timestamp().Logger()
+	}
+	var accessLog *streamgetter.AccessLog
+
+	if *root != "" {
+		// All recordings below root: /<recording>/manifest.mpd
+		mux, err := streamgetter.NewRecordingMux(*root, logger)
+		if err == nil {
+			err = mux.SetIdleTimeout(*idle)
+		}
+		if err != nil {
+			logger.Fatal().Err(err).Send()
+			return
+		}
+		mux.SetSetup(func(sg *streamgetter.StreamLooper, m *http.ServeMux) error {
+			if *admin {
+				api := streamgetter.NewAdmin(sg, logger)
+				api.SetAccessLog(accessLog)
+				api.SetSwitchRoot(cmp.Or(*switchRoot, *root))
+				m.Handle(streamgetter.AdminPathPrefix, api)
+			}
+			return configure(sg)
+		})
+		accessLog = streamgetter.NewMuxAccessLog(mux, accessLogger)
+		http.Handle("/", mux)
+		go mux.Maintain(min(*idle, time.Minute))
+	} else {
+		sg, err := streamgetter.NewStreamLooper(*dump, logger)
+		if err == nil {
+			err = configure(sg)
+		}
+		if err != nil {
+			logger.Fatal().Err(err).Send()
+			return
+		}
+		accessLog = streamgetter.NewAccessLog(sg, accessLogger)
+
+		// Paths for segments
+		http.HandleFunc("/manifest.mpd", sg.DynamicHandler)
+		http.HandleFunc("/static.mpd", sg.StaticHandler)
+		// Sessions with faults: /faults/<spec>/manifest.mpd or /manifest.mpd?faults=<spec>
+		http.HandleFunc(streamgetter.FaultPathPrefix, sg.FaultHandler)
+		http.HandleFunc("/", sg.FileHandler)
+		if *admin {
+			api := streamgetter.NewAdmin(sg, logger)
+			api.SetAccessLog(accessLog)
+			api.SetSwitchRoot(*switchRoot)
+			http.Handle(streamgetter.AdminPathPrefix, api)
+		}
+	}
+	http.Handle(streamgetter.TimePath, timeServer)
+	http.Handle(streamgetter.TimePath+"/", timeServer)
+	// Sessions with network emulation: /shape/<spec>/manifest.mpd
+	http.Handle(streamgetter.ShapePathPrefix, streamgetter.NewShaper(traces, logger).Wrap(http.DefaultServeMux))
+	// Per session player behaviour, ?session=<key> for one
+	http.HandleFunc(streamgetter.AnalyticsPath, accessLog.AnalyticsHandler)
 	logger.Info().Msgf("Listening on %s", *listen)
-	logger.Fatal().Err(http.ListenAndServe(*listen, nil)).Send()
+	logger.Fatal().Err(http.ListenAndServe(*listen, accessLog.Wrap(http.DefaultServeMux))).Send()
 }
@@ -18,8 +18,19 @@ func main() {
 	}).With().Timestamp().Logger()
 
 	debug := flag.Bool("debug", false, "set log level to debug")
-	dump := flag.String("dumpdir", "", "Directory to dump segments")
+	dump := flag.String("dumpdir", "", "Recording directory, or s3://bucket/prefix")
 	listen := flag.String("listen", ":9080", "Adress/port to listen")
+	var rewriter lsdalm.UrlRewriter
+	rewriter.RegisterFlags(flag.CommandLine)
+	cacheProxy := flag.Bool("cacheproxy", false, "Fetch media missing in the recording from the origin, store and serve it")
+	httpConfig := lsdalm.NewHttpConfig()
+	httpConfig.RegisterFlags(flag.CommandLine)
+	timeServer := lsdalm.NewTimeServer()
+	timeServer.RegisterFlags(flag.CommandLine)
+	shapeFile := flag.String("shapetraces", "", "JSON file with named bandwidth schedules for "+lsdalm.ShapePathPrefix+"<spec>/ sessions")
+	accessFile := flag.String("accesslog", "", "Append the access log as JSON lines to this file, default: log output")
+	admin := flag.Bool("admin", false, "Serve the admin API below "+lsdalm.AdminPathPrefix)
+	switchRoot := flag.String("switchroot", "", "Allow the admin API to switch to recordings below this directory, or s3://bucket/prefix")
 
 	flag.Parse()
 
@@ -38,13 +49,58 @@ func main() {
 		logger.Fatal().Err(err).Send()
 		return
 	}
+	if err := sg.SetUrlRewriter(&rewriter); err != nil {
+		logger.Fatal().Err(err).Send()
+		return
+	}
+	if err := sg.SetTimeServer(timeServer); err != nil {
+		logger.Fatal().Err(err).Send()
+		return
+	}
+	var traces map[string]lsdalm.ShapeProfile
+	if *shapeFile != "" {
+		if traces, err = lsdalm.LoadShapeTraces(*shapeFile); err != nil {
+			logger.Fatal().Err(err).Send()
+			return
+		}
+	}
+	if *cacheProxy {
+		if err := sg.EnableProxy(httpConfig); err != nil {
+			logger.Fatal().Err(err).Send()
+			return
+		}
+	}
 	err = sg.LoadArchive()
 	if err != nil {
 		logger.Fatal().Err(err).Msg("Load Archive")
 		return
 	}
+	accessLogger := logger
+	if *accessFile != "" {
+		f, err := os.OpenFile(*accessFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			logger.Fatal().Err(err).Send()
+			return
+		}
+		defer f.Close()
+		accessLogger = zerolog.New(f).With().Timestamp().Logger()
+	}
+	accessLog := lsdalm.NewAccessLog(nil, accessLogger)
+
 	// Paths for segments
 	http.HandleFunc("/manifest.mpd", sg.Handler)
+	http.Handle(lsdalm.TimePath, timeServer)
+	http.Handle(lsdalm.TimePath+"/", timeServer)
 	http.HandleFunc("/", sg.FileHandler)
-	logger.Fatal().Err(http.ListenAndServe(*listen, nil)).Send()
+	// Sessions with network emulation: /shape/<spec>/manifest.mpd
+	http.Handle(lsdalm.ShapePathPrefix, lsdalm.NewShaper(traces, logger).Wrap(http.DefaultServeMux))
+	if *admin {
+		api := lsdalm.NewAdmin(sg, logger)
+		api.SetAccessLog(accessLog)
+		api.SetSwitchRoot(*switchRoot)
+		http.Handle(lsdalm.AdminPathPrefix, api)
+	}
+	// Per session player behaviour, ?session=<key> for one
+	http.HandleFunc(lsdalm.AnalyticsPath, accessLog.AnalyticsHandler)
+	logger.Fatal().Err(http.ListenAndServe(*listen, accessLog.Wrap(http.DefaultServeMux))).Send()
 }
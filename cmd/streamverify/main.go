@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/jdeisenh/lsdalm/pkg/lsdalm"
+	"github.com/rs/zerolog"
+)
+
+func main() {
+
+	logger := zerolog.New(zerolog.ConsoleWriter{
+		Out:        os.Stderr,
+		TimeFormat: time.TimeOnly,
+	}).With().Timestamp().Logger()
+
+	debug := flag.Bool("debug", false, "set log level to debug")
+	dump := flag.String("dumpdir", "", "Recording directory to verify, or s3://bucket/prefix")
+	refetch := flag.Bool("refetch", false, "Refetch broken segments still in the DVR window of the source")
+	jsonOut := flag.Bool("json", false, "Print the report as JSON")
+
+	httpConfig := lsdalm.NewHttpConfig()
+	httpConfig.RegisterFlags(flag.CommandLine)
+
+	flag.Parse()
+
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	}
+	if *dump == "" {
+		flag.Usage()
+		return
+	}
+	report, err := lsdalm.VerifyRecording(*dump, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Send()
+	}
+	if *refetch {
+		client, err := httpConfig.NewClient(0)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Http config")
+		}
+		if err := report.Refetch(context.Background(), client, lsdalm.DefaultRetryPolicy(), logger); err != nil {
+			logger.Error().Err(err).Msg("Refetch")
+		}
+	}
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		report.WriteText(os.Stdout)
+	}
+	if report.HasProblems() {
+		os.Exit(1)
+	}
+}
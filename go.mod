@@ -4,6 +4,7 @@ go 1.23.6
 
 require (
 	github.com/Eyevinn/mp4ff v0.47.0
+	github.com/klauspost/compress v1.17.11
 	github.com/prometheus/client_golang v1.21.1
 	github.com/rs/zerolog v1.33.0
 	github.com/stretchr/testify v1.10.0
@@ -85,11 +85,11 @@ type Period struct {
 
 // BaseURL represents XSD's BaseURLType.
 type BaseURL struct {
-	Value                    string  `xml:",chardata"`
-	ServiceLocation          *string `xml:"serviceLocation,attr"`
-	ByteRange                *string `xml:"byteRange,attr"`
-	AvailabilityTimeOffset   *uint64 `xml:"availabilityTimeOffset,attr"`
-	AvailabilityTimeComplete *bool   `xml:"availabilityTimeComplete,attr"`
+	Value                    string   `xml:",chardata"`
+	ServiceLocation          *string  `xml:"serviceLocation,attr"`
+	ByteRange                *string  `xml:"byteRange,attr"`
+	AvailabilityTimeOffset   *float64 `xml:"availabilityTimeOffset,attr"`
+	AvailabilityTimeComplete *bool    `xml:"availabilityTimeComplete,attr"`
 }
 
 // AdaptationSet represents XSD's AdaptationSetType.
@@ -126,6 +126,7 @@ type AdaptationSet struct {
 // Representation represents XSD's RepresentationType.
 type Representation struct {
 	ID                 *string          `xml:"id,attr"`
+	MimeType           *string          `xml:"mimeType,attr"`
 	Width              *uint64          `xml:"width,attr"`
 	Height             *uint64          `xml:"height,attr"`
 	FrameRate          *string          `xml:"frameRate,attr"`
@@ -154,6 +155,7 @@ type SegmentTemplate struct {
 	Initialization         *string          `xml:"initialization,attr"`
 	StartNumber            *uint64          `xml:"startNumber,attr"`
 	PresentationTimeOffset *uint64          `xml:"presentationTimeOffset,attr"`
+	AvailabilityTimeOffset *float64         `xml:"availabilityTimeOffset,attr"`
 	SegmentTimeline        *SegmentTimeline `xml:"SegmentTimeline,omitempty"`
 }
 
@@ -0,0 +1,502 @@
+package lsdalm
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// AnalyticsPath serves the session summaries of the AccessLog
+const AnalyticsPath = "/analytics"
+
+// accessSessionTimeout drops sessions idle for this long
+const accessSessionTimeout = time.Hour
+
+// Kinds of requests in the access log
+const (
+	AccessManifest = "manifest"
+	AccessInit     = "init"
+	AccessSegment  = "segment"
+	AccessOther    = "other"
+)
+
+// segmentRequest describes a request for a segment of the recording
+type segmentRequest struct {
+	kind        string // AccessInit or AccessSegment
+	track       int    // AdaptationSet index
+	contentType string
+	repId       string
+	start       time.Time     // Media start, shifted to the looped timeline
+	duration    time.Duration // Zero for init segments
+}
+
+// segmentMatcher recognizes the paths of one AdaptationSet
+type segmentMatcher struct {
+	media, init *regexp.Regexp
+	contentType string
+	timescale   uint64
+}
+
+// templateIdentifier matches the identifiers of SegmentTemplate attributes, with optional width format
+var templateIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Time|Bandwidth|SubNumber)?(%0\d+d)?\$`)
+
+// templateGroups are the pattern groups of the identifiers, the first occurrence is named
+var templateGroups = map[string]string{
+	"RepresentationID": "rep",
+	"Number":           "number",
+	"Time":             "time",
+}
+
+// templateRegexp converts a SegmentTemplate attribute to a pattern matching the end of a path
+func templateRegexp(template string) *regexp.Regexp {
+	var expr strings.Builder
+	named := make(map[string]bool)
+	last := 0
+	for _, loc := range templateIdentifier.FindAllStringSubmatchIndex(template, -1) {
+		expr.WriteString(regexp.QuoteMeta(template[last:loc[0]]))
+		last = loc[1]
+		if loc[2] < 0 {
+			// $$
+			expr.WriteString(`\$`)
+			continue
+		}
+		ident := template[loc[2]:loc[3]]
+		value := `\d+`
+		if ident == "RepresentationID" {
+			value = `[^/]+`
+		}
+		if group, ok := templateGroups[ident]; ok && !named[group] {
+			named[group] = true
+			value = `(?P<` + group + `>` + value + `)`
+		}
+		expr.WriteString(value)
+	}
+	expr.WriteString(regexp.QuoteMeta(template[last:]))
+	return regexp.MustCompile(`(^|/)` + expr.String() + `$`)
+}
+
+// segmentMatchers builds the matchers for the AdaptationSets of the recording
+func (sc *StreamLooper) segmentMatchers() []segmentMatcher {
+	var matchers []segmentMatcher
+	if sc.recording.firstMpd == nil || len(sc.recording.firstMpd.Period) == 0 {
+		return nil
+	}
+	for _, as := range sc.recording.firstMpd.Period[0].AdaptationSets {
+		m := segmentMatcher{contentType: as.MimeType}
+		if as.ContentType != nil {
+			m.contentType = *as.ContentType
+		}
+		if st := as.SegmentTemplate; st != nil {
+			m.timescale = max(ZeroIfNil(st.Timescale), 1)
+			if st.Media != nil {
+				m.media = templateRegexp(*st.Media)
+				if m.media.SubexpIndex("time") < 0 {
+					sc.logger.Warn().Str("template", *st.Media).
+						Msg("Media template without $Time$, no availability and stall analytics")
+				}
+			}
+			if st.Initialization != nil {
+				m.init = templateRegexp(*st.Initialization)
+			}
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers
+}
+
+// locateSegment maps a request path at 'at' to a segment of the looped stream
+func (sc *StreamLooper) locateSegment(urlpath string, at time.Time) (segmentRequest, bool) {
+	sc.mutex.RLock()
+	defer sc.mutex.RUnlock()
+	for asi, m := range sc.matchers() {
+		if m.init != nil {
+			if sm := m.init.FindStringSubmatch(urlpath); sm != nil {
+				req := segmentRequest{kind: AccessInit, track: asi, contentType: m.contentType}
+				if i := m.init.SubexpIndex("rep"); i >= 0 {
+					req.repId = sm[i]
+				}
+				return req, true
+			}
+		}
+		if m.media == nil {
+			continue
+		}
+		sm := m.media.FindStringSubmatch(urlpath)
+		if sm == nil {
+			continue
+		}
+		req := segmentRequest{kind: AccessSegment, track: asi, contentType: m.contentType}
+		if i := m.media.SubexpIndex("rep"); i >= 0 {
+			req.repId = sm[i]
+		}
+		if m.media.SubexpIndex("time") < 0 {
+			// $Number$ templates: the looped numbers do not map to media times
+			return req, true
+		}
+		t, err := strconv.ParseInt(sm[m.media.SubexpIndex("time")], 10, 64)
+		if err != nil {
+			return req, true
+		}
+		sections := sc.loopSections()
+		cur := placeLoop(sections, at, at)
+		for i, section := range sections {
+			if asi >= len(section.re.Segments) {
+				continue
+			}
+			d, ok := section.re.Segments[asi].durationAt(t)
+			if !ok {
+				continue
+			}
+			start := GetAst(section.re.firstMpd).Add(TLP2Duration(t, m.timescale)).Add(cur.shiftOf(sections, i))
+			// Around the loop point, the segment may be from the neighbouring loop
+			if start.Sub(at) > cur.length/2 {
+				start = start.Add(-cur.length)
+			} else if at.Sub(start) > cur.length/2 {
+				start = start.Add(cur.length)
+			}
+			// Ranges may overlap at their ends, take the closest
+			if req.start.IsZero() || start.Sub(at).Abs() < req.start.Sub(at).Abs() {
+				req.start, req.duration = start, TLP2Duration(d, m.timescale)
+			}
+		}
+		return req, true
+	}
+	return segmentRequest{}, false
+}
+
+// segmentLocator maps request paths to segments
+type segmentLocator interface {
+	locateSegment(urlpath string, at time.Time) (segmentRequest, bool)
+}
+
+// recordingFinder is a segmentLocator of several recordings, which splits the recording off a path
+type recordingFinder interface {
+	findRecording(urlpath string) (name, rest string, ok bool)
+}
+
+// AccessLog logs every request of the looper per session and summarizes player behaviour
+// A session is a client address and User-Agent, plus the recording, if several are served,
+// and the fault and shaping prefixes of the path
+type AccessLog struct {
+	locator segmentLocator // nil: requests are not mapped to segments
+	logger  zerolog.Logger
+
+	mutex    sync.Mutex
+	sessions map[string]*accessSession
+}
+
+// NewAccessLog creates an access log for sc, writing an entry per request to logger
+// Without looper, only manifests are recognized
+func NewAccessLog(sc *StreamLooper, logger zerolog.Logger) *AccessLog {
+	al := &AccessLog{
+		logger:   logger,
+		sessions: make(map[string]*accessSession),
+	}
+	if sc != nil {
+		al.locator = sc
+	}
+	return al
+}
+
+// NewMuxAccessLog creates an access log for the recordings of rm
+func NewMuxAccessLog(rm *RecordingMux, logger zerolog.Logger) *AccessLog {
+	return &AccessLog{
+		locator:  rm,
+		logger:   logger,
+		sessions: make(map[string]*accessSession),
+	}
+}
+
+// AbrSwitch is a change of the requested representation
+type AbrSwitch struct {
+	At       time.Time
+	Track    string
+	From, To string
+}
+
+// TrackSummary is the behaviour of a session on one AdaptationSet
+type TrackSummary struct {
+	Track     string
+	Segments  map[string]int // By representation
+	Bytes     int64
+	Early     int           // Requested before availability
+	MeanDelay time.Duration // Mean request time after availability
+	Stalls    int           // Estimated: more played than downloaded
+	StallTime time.Duration
+
+	lastRep     string
+	delaySum    time.Duration
+	delayCount  int
+	playStart   time.Time
+	downloaded  time.Duration
+	lastSegment time.Time
+}
+
+// SessionSummary is the behaviour of one player
+type SessionSummary struct {
+	Session       string
+	First, Last   time.Time
+	Requests      int
+	Errors        int // Status 400 and above
+	Bytes         int64
+	ManifestPolls int
+	PollMin       time.Duration `json:",omitempty"`
+	PollMean      time.Duration `json:",omitempty"`
+	PollMax       time.Duration `json:",omitempty"`
+	Tracks        []*TrackSummary
+	Switches      []AbrSwitch
+}
+
+// accessSession collects the summary of a session
+type accessSession struct {
+	summary      SessionSummary
+	lastManifest time.Time
+	pollSum      time.Duration
+}
+
+// sessionKey returns the session of r and the path without session prefixes
+func sessionKey(r *http.Request) (string, string) {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	return cutSessionPrefixes(client+" "+r.UserAgent(), r.URL.Path)
+}
+
+// session returns the session of r and the path without session prefixes,
+// with the recording name in front if several recordings are served
+func (al *AccessLog) session(r *http.Request) (string, string) {
+	key, urlpath := sessionKey(r)
+	if rf, ok := al.locator.(recordingFinder); ok {
+		if name, rest, ok := rf.findRecording(urlpath); ok {
+			// Fault sessions are below the recording
+			key, rest = cutSessionPrefixes(key+" /"+name, rest)
+			urlpath = "/" + name + rest
+		}
+	}
+	return key, urlpath
+}
+
+// cutSessionPrefixes adds the fault and shaping prefixes at the start of rest to key
+// and returns both
+func cutSessionPrefixes(key, rest string) (string, string) {
+	for {
+		var prefix string
+		switch {
+		case strings.HasPrefix(rest, FaultPathPrefix):
+			prefix = FaultPathPrefix
+		case strings.HasPrefix(rest, ShapePathPrefix):
+			prefix = ShapePathPrefix
+		default:
+			return key, rest
+		}
+		spec, after, _ := strings.Cut(strings.TrimPrefix(rest, prefix), "/")
+		key += " " + prefix + spec
+		rest = "/" + after
+	}
+}
+
+// countingWriter records status and body size
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (cw *countingWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	n, err := cw.ResponseWriter.Write(p)
+	cw.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps shaped responses flowing
+func (cw *countingWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Wrap returns a handler logging all requests served by next
+func (al *AccessLog) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, AnalyticsPath) || strings.HasPrefix(r.URL.Path, AdminPathPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		cw := &countingWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		al.record(r, start, time.Since(start), cw.status, cw.bytes)
+	})
+}
+
+// record logs a request and adds it to its session
+func (al *AccessLog) record(r *http.Request, at time.Time, took time.Duration, status int, bytes int64) {
+	key, urlpath := al.session(r)
+	kind := AccessOther
+	var seg segmentRequest
+	var isSegment bool
+	if al.locator != nil {
+		seg, isSegment = al.locator.locateSegment(urlpath, at)
+	}
+	switch {
+	case isSegment:
+		kind = seg.kind
+	case path.Ext(urlpath) == ".mpd":
+		kind = AccessManifest
+	}
+	entry := al.logger.Info().Str("session", key).Str("kind", kind).Str("path", urlpath).
+		Int("status", status).Int64("bytes", bytes).Dur("took", took)
+	var delay time.Duration
+	if isSegment {
+		entry = entry.Str("track", seg.contentType).Str("rep", seg.repId)
+		if seg.kind == AccessSegment && !seg.start.IsZero() {
+			// Positive: after the segment became available
+			delay = at.Sub(seg.start.Add(seg.duration))
+			entry = entry.Time("media", seg.start).Dur("availability", delay)
+		}
+	}
+	entry.Msg("Access")
+
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	sess, ok := al.sessions[key]
+	if !ok {
+		// Forget idle sessions
+		for k, s := range al.sessions {
+			if at.Sub(s.summary.Last) > accessSessionTimeout {
+				delete(al.sessions, k)
+			}
+		}
+		sess = &accessSession{summary: SessionSummary{Session: key, First: at}}
+		al.sessions[key] = sess
+	}
+	sess.add(kind, seg, at, status, bytes, delay)
+}
+
+// add accounts a request
+func (sess *accessSession) add(kind string, seg segmentRequest, at time.Time, status int, bytes int64, delay time.Duration) {
+	sum := &sess.summary
+	sum.Last = at
+	sum.Requests++
+	sum.Bytes += bytes
+	if status >= 400 {
+		sum.Errors++
+		return
+	}
+	switch kind {
+	case AccessManifest:
+		sum.ManifestPolls++
+		if !sess.lastManifest.IsZero() {
+			interval := at.Sub(sess.lastManifest)
+			sess.pollSum += interval
+			if sum.PollMin == 0 || interval < sum.PollMin {
+				sum.PollMin = interval
+			}
+			sum.PollMax = max(sum.PollMax, interval)
+			sum.PollMean = sess.pollSum / time.Duration(sum.ManifestPolls-1)
+		}
+		sess.lastManifest = at
+	case AccessSegment:
+		for len(sum.Tracks) <= seg.track {
+			sum.Tracks = append(sum.Tracks, &TrackSummary{Segments: make(map[string]int)})
+		}
+		track := sum.Tracks[seg.track]
+		track.Track = seg.contentType
+		track.Segments[seg.repId]++
+		track.Bytes += bytes
+		if track.lastRep != "" && track.lastRep != seg.repId {
+			sum.Switches = append(sum.Switches, AbrSwitch{At: at, Track: seg.contentType, From: track.lastRep, To: seg.repId})
+		}
+		track.lastRep = seg.repId
+		if seg.start.IsZero() {
+			return
+		}
+		if delay < 0 {
+			track.Early++
+		}
+		track.delaySum += delay
+		track.delayCount++
+		track.MeanDelay = track.delaySum / time.Duration(track.delayCount)
+		track.addPlayback(at, seg)
+	}
+}
+
+// addPlayback estimates stalls: playback runs from the first segment on, and
+// stalls whenever more wall clock time passed than media was downloaded
+// Requests for already downloaded media, like ABR probes, are not counted
+func (track *TrackSummary) addPlayback(at time.Time, seg segmentRequest) {
+	if !seg.start.After(track.lastSegment) && !track.playStart.IsZero() {
+		return
+	}
+	track.lastSegment = seg.start
+	if track.playStart.IsZero() {
+		track.playStart = at
+	}
+	if buffer := track.downloaded - at.Sub(track.playStart); buffer < 0 {
+		track.Stalls++
+		track.StallTime -= buffer
+		track.playStart = track.playStart.Add(-buffer)
+	}
+	track.downloaded += seg.duration
+}
+
+// Summaries returns copies of the session summaries, sorted by first request
+func (al *AccessLog) Summaries() []SessionSummary {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	ret := make([]SessionSummary, 0, len(al.sessions))
+	for _, sess := range al.sessions {
+		sum := sess.summary
+		sum.Switches = slices.Clone(sum.Switches)
+		sum.Tracks = make([]*TrackSummary, 0, len(sess.summary.Tracks))
+		for _, track := range sess.summary.Tracks {
+			if track == nil {
+				continue
+			}
+			tc := *track
+			tc.Segments = make(map[string]int, len(track.Segments))
+			for k, v := range track.Segments {
+				tc.Segments[k] = v
+			}
+			sum.Tracks = append(sum.Tracks, &tc)
+		}
+		ret = append(ret, sum)
+	}
+	slices.SortFunc(ret, func(a, b SessionSummary) int { return a.First.Compare(b.First) })
+	return ret
+}
+
+// AnalyticsHandler serves the session summaries as JSON, or the one given by the session query parameter
+func (al *AccessLog) AnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	summaries := al.Summaries()
+	if want := r.URL.Query().Get("session"); want != "" {
+		summaries = slices.DeleteFunc(summaries, func(s SessionSummary) bool { return s.Session != want })
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(summaries)
+}
@@ -0,0 +1,77 @@
+package lsdalm
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionKey(t *testing.T) {
+	r := httptest.NewRequest("GET", "/shape/rate=1M/faults/flaky/v/v1/100.m4s", nil)
+	r.Header.Set("User-Agent", "player")
+	key, rest := sessionKey(r)
+	assert.Equal(t, "192.0.2.1 player /shape/rate=1M /faults/flaky", key)
+	assert.Equal(t, "/v/v1/100.m4s", rest)
+
+	m := templateRegexp("v/$RepresentationID$/$Time$.m4s")
+	sm := m.FindStringSubmatch(rest)
+	assert.Equal(t, "v1", sm[m.SubexpIndex("rep")])
+	assert.Equal(t, "100", sm[m.SubexpIndex("time")])
+	assert.Nil(t, m.FindStringSubmatch("/xv/v1/100.m4s"))
+
+	m = templateRegexp("$RepresentationID$/seg-$Time%08d$-$$.m4s")
+	sm = m.FindStringSubmatch("/live/v1/seg-00000100-$.m4s")
+	assert.Equal(t, "v1", sm[m.SubexpIndex("rep")])
+	assert.Equal(t, "00000100", sm[m.SubexpIndex("time")])
+	m = templateRegexp("$RepresentationID$/$Bandwidth$/$Number%05d$.m4s")
+	sm = m.FindStringSubmatch("/v1/800000/00042.m4s")
+	assert.Equal(t, "00042", sm[m.SubexpIndex("number")])
+	assert.Equal(t, -1, m.SubexpIndex("time"))
+}
+
+func TestLocateInit(t *testing.T) {
+	sc := &StreamLooper{matchers: func() []segmentMatcher {
+		return []segmentMatcher{
+			{init: templateRegexp("audio/init.mp4"), contentType: "audio"},
+			{init: templateRegexp("video/$RepresentationID$/init.mp4"), contentType: "video"},
+		}
+	}}
+	req, ok := sc.locateSegment("/audio/init.mp4", time.Now())
+	assert.True(t, ok)
+	assert.Equal(t, segmentRequest{kind: AccessInit, track: 0, contentType: "audio"}, req)
+	req, ok = sc.locateSegment("/video/v1/init.mp4", time.Now())
+	assert.True(t, ok)
+	assert.Equal(t, segmentRequest{kind: AccessInit, track: 1, contentType: "video", repId: "v1"}, req)
+	_, ok = sc.locateSegment("/text/init.mp4", time.Now())
+	assert.False(t, ok)
+}
+
+func TestAccessSession(t *testing.T) {
+	var sess accessSession
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	media := now.Add(-10 * time.Second)
+	seg := func(at time.Duration, rep string) {
+		req := segmentRequest{kind: AccessSegment, contentType: "video", repId: rep, start: media, duration: 2 * time.Second}
+		sess.add(AccessSegment, req, now.Add(at), 200, 1000, now.Add(at).Sub(media.Add(2*time.Second)))
+		media = media.Add(2 * time.Second)
+	}
+	sess.add(AccessManifest, segmentRequest{}, now, 200, 100, 0)
+	sess.add(AccessManifest, segmentRequest{}, now.Add(2*time.Second), 200, 100, 0)
+	// Two segments buffered, then one arriving 3s late
+	seg(0, "v1")
+	seg(0, "v1")
+	seg(7*time.Second, "v2")
+	seg(7*time.Second, "v2")
+
+	sum := sess.summary
+	assert.Equal(t, 6, sum.Requests)
+	assert.Equal(t, 2, sum.ManifestPolls)
+	assert.Equal(t, 2*time.Second, sum.PollMean)
+	assert.Equal(t, []AbrSwitch{{At: now.Add(7 * time.Second), Track: "video", From: "v1", To: "v2"}}, sum.Switches)
+	track := sum.Tracks[0]
+	assert.Equal(t, map[string]int{"v1": 2, "v2": 2}, track.Segments)
+	assert.Equal(t, 1, track.Stalls)
+	assert.Equal(t, 3*time.Second, track.StallTime)
+}
@@ -0,0 +1,316 @@
+package lsdalm
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jdeisenh/lsdalm/pkg/go-mpd"
+	"github.com/rs/zerolog"
+)
+
+// AdminPathPrefix starts the paths of the admin API
+const AdminPathPrefix = "/admin/"
+
+// activeSessionWindow is how recently a session must have made a request to be listed as active
+const activeSessionWindow = time.Minute
+
+var (
+	errSwitchDisabled = errors.New("Switch disabled, no switch root configured")
+	errSwitchName     = errors.New("Recording must be a relative path below the switch root")
+)
+
+// RecordingInfo describes the recording being served
+type RecordingInfo struct {
+	Dumpdir          string
+	Meta             StorageMeta
+	Manifests        int
+	From, To         time.Time // Recorded range
+	LoopFrom, LoopTo time.Time // Range played in a loop, the longest one
+	LoopAllRanges    bool
+	Ranges           []RangeInfo // Continuous ranges, separated by gaps
+	Tracks           []TrackInfo
+	Events           []EventInfo
+}
+
+// RangeInfo describes a continuous range of a recording
+type RangeInfo struct {
+	From, To  time.Time // Loopable range
+	Manifests int
+}
+
+// TrackInfo describes an AdaptationSet of a recording
+type TrackInfo struct {
+	ContentType     string `json:",omitempty"`
+	MimeType        string
+	Representations []string
+	Segments        int
+	From, To        time.Time // Media time of the segments
+}
+
+// EventInfo describes an EventStream of a recording
+type EventInfo struct {
+	SchemeIdUri string
+	Value       string `json:",omitempty"`
+	Events      int
+}
+
+// LoopPosition is the point of the recording played at a time
+type LoopPosition struct {
+	At         time.Time
+	Loop       int64         // Number of the loop
+	Range      int           // Continuous range of the recording played, when looping all
+	Offset     time.Duration // From the range start
+	LoopLength time.Duration
+	Shift      time.Duration // Added to the recording times
+	Original   time.Time     // Recording time played at At
+}
+
+// AdminTarget is a server the admin API controls
+type AdminTarget interface {
+	Info() RecordingInfo
+	Position(at time.Time) LoopPosition
+	Reload() error
+	Switch(dumpdir string) error
+}
+
+// Admin serves a JSON API below AdminPathPrefix:
+// GET recording, position, sessions; POST reload, switch?recording=<name below the switch root>
+type Admin struct {
+	target     AdminTarget
+	sessions   *AccessLog // nil: no sessions
+	switchRoot string     // Directory or s3://bucket/prefix switch is limited to, empty: no switch
+	logger     zerolog.Logger
+}
+
+// NewAdmin creates the admin API for target
+func NewAdmin(target AdminTarget, logger zerolog.Logger) *Admin {
+	return &Admin{target: target, logger: logger}
+}
+
+// SetAccessLog sets the source of the sessions listed
+func (ad *Admin) SetAccessLog(al *AccessLog) {
+	ad.sessions = al
+}
+
+// SetSwitchRoot allows switching to the recordings below root, a local directory or s3://bucket/prefix
+// Without root, switch is refused
+func (ad *Admin) SetSwitchRoot(root string) {
+	ad.switchRoot = strings.TrimSuffix(root, "/")
+}
+
+// switchDir returns the directory of the recording name below the switch root
+func (ad *Admin) switchDir(name string) (string, error) {
+	if ad.switchRoot == "" {
+		return "", errSwitchDisabled
+	}
+	if name == "" || path.IsAbs(name) || path.Clean(name) != name || name == ".." || strings.HasPrefix(name, "../") {
+		return "", errSwitchName
+	}
+	return ad.switchRoot + "/" + name, nil
+}
+
+// ServeHTTP dispatches the admin requests
+func (ad *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(r.URL.Path, AdminPathPrefix)
+	var method string
+	switch action {
+	case "recording", "position", "sessions":
+		method = http.MethodGet
+	case "reload", "switch":
+		method = http.MethodPost
+	default:
+		ad.reply(w, http.StatusNotFound, errors.New("Unknown admin path, use recording, position, sessions, reload or switch"))
+		return
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		ad.reply(w, http.StatusMethodNotAllowed, errors.New("Use "+method))
+		return
+	}
+	switch action {
+	case "recording":
+		ad.reply(w, http.StatusOK, ad.target.Info())
+	case "position":
+		ad.reply(w, http.StatusOK, ad.target.Position(time.Now()))
+	case "sessions":
+		ad.reply(w, http.StatusOK, ad.activeSessions(time.Now()))
+	case "reload":
+		ad.logger.Info().Str("client", r.RemoteAddr).Msg("Admin reload")
+		if err := ad.target.Reload(); err != nil {
+			ad.reply(w, http.StatusInternalServerError, err)
+			return
+		}
+		ad.reply(w, http.StatusOK, ad.target.Info())
+	case "switch":
+		dumpdir, err := ad.switchDir(r.FormValue("recording"))
+		switch {
+		case errors.Is(err, errSwitchDisabled):
+			ad.reply(w, http.StatusForbidden, err)
+			return
+		case err != nil:
+			ad.reply(w, http.StatusBadRequest, err)
+			return
+		}
+		ad.logger.Info().Str("client", r.RemoteAddr).Str("dumpdir", dumpdir).Msg("Admin switch")
+		if err := ad.target.Switch(dumpdir); err != nil {
+			ad.reply(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		ad.reply(w, http.StatusOK, ad.target.Info())
+	}
+}
+
+// activeSessions returns the sessions with requests in activeSessionWindow before now
+func (ad *Admin) activeSessions(now time.Time) []SessionSummary {
+	if ad.sessions == nil {
+		return []SessionSummary{}
+	}
+	return slices.DeleteFunc(ad.sessions.Summaries(), func(s SessionSummary) bool {
+		return now.Sub(s.Last) > activeSessionWindow
+	})
+}
+
+// reply sends v as JSON, errors as {"Error": "..."}
+func (ad *Admin) reply(w http.ResponseWriter, status int, v any) {
+	if err, ok := v.(error); ok {
+		v = struct{ Error string }{err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// mpdTrackInfo lists the AdaptationSets and EventStreams of the first Period of mpde
+// Segments are counted from the SegmentTimelines
+func mpdTrackInfo(mpde *mpd.MPD) ([]TrackInfo, []EventInfo) {
+	if mpde == nil || len(mpde.Period) == 0 {
+		return nil, nil
+	}
+	ast := GetAst(mpde)
+	period := mpde.Period[0]
+	tracks := make([]TrackInfo, 0, len(period.AdaptationSets))
+	for _, as := range period.AdaptationSets {
+		ti := TrackInfo{ContentType: EmptyIfNil(as.ContentType), MimeType: as.MimeType}
+		for _, rep := range as.Representations {
+			ti.Representations = append(ti.Representations, EmptyIfNil(rep.ID))
+		}
+		if st := as.SegmentTemplate; st != nil && st.SegmentTimeline != nil {
+			timescale := max(ZeroIfNil(st.Timescale), 1)
+			for t, d := range All(st.SegmentTimeline) {
+				if ti.Segments == 0 {
+					ti.From = ast.Add(TLP2Duration(int64(t), timescale))
+				}
+				ti.Segments++
+				ti.To = ast.Add(TLP2Duration(int64(t+d), timescale))
+			}
+		}
+		tracks = append(tracks, ti)
+	}
+	events := make([]EventInfo, 0, len(period.EventStream))
+	for _, evs := range period.EventStream {
+		events = append(events, EventInfo{SchemeIdUri: EmptyIfNil(evs.SchemeIdUri), Value: EmptyIfNil(evs.Value), Events: len(evs.Event)})
+	}
+	return tracks, events
+}
+
+// Info describes the recording looped
+func (sc *StreamLooper) Info() RecordingInfo {
+	sc.mutex.RLock()
+	defer sc.mutex.RUnlock()
+	re := sc.recording
+	info := RecordingInfo{Dumpdir: sc.source, Meta: sc.storageMeta, Manifests: len(re.history)}
+	info.From, info.To = re.getRecordingRange()
+	info.LoopFrom, info.LoopTo = re.getLoopableRange()
+	info.LoopAllRanges = sc.loopAll
+	for _, r := range sc.ranges {
+		ri := RangeInfo{Manifests: len(r.history)}
+		ri.From, ri.To = r.getLoopableRange()
+		info.Ranges = append(info.Ranges, ri)
+	}
+	// Segments are collected from all manifests, the first only has the structure
+	info.Tracks, _ = mpdTrackInfo(re.firstMpd)
+	ast := GetAst(re.firstMpd)
+	for asi := range info.Tracks {
+		if asi >= len(re.Segments) {
+			break
+		}
+		as := re.Segments[asi]
+		timescale := max(ZeroIfNil(re.firstMpd.Period[0].AdaptationSets[asi].SegmentTemplate.Timescale), 1)
+		info.Tracks[asi].Segments = 0
+		for _, e := range as.elements {
+			info.Tracks[asi].Segments += int(e.r + 1)
+		}
+		info.Tracks[asi].From = ast.Add(TLP2Duration(as.start, timescale))
+		info.Tracks[asi].To = ast.Add(TLP2Duration(as.end, timescale))
+	}
+	info.Events = make([]EventInfo, 0, len(re.EventStreamMap))
+	for _, evs := range re.EventStreamMap {
+		info.Events = append(info.Events, EventInfo{SchemeIdUri: EmptyIfNil(evs.SchemeIdUri), Value: EmptyIfNil(evs.Value), Events: len(evs.Event)})
+	}
+	slices.SortFunc(info.Events, func(a, b EventInfo) int { return strings.Compare(a.SchemeIdUri, b.SchemeIdUri) })
+	return info
+}
+
+// Position returns the point of the recording played at 'at'
+func (sc *StreamLooper) Position(at time.Time) LoopPosition {
+	sc.mutex.RLock()
+	defer sc.mutex.RUnlock()
+	sections := sc.loopSections()
+	p := placeLoop(sections, at, at)
+	return LoopPosition{
+		At:         at,
+		Loop:       p.loop,
+		Range:      p.section,
+		Offset:     p.offset,
+		LoopLength: p.length,
+		Shift:      p.shift,
+		Original:   sections[p.section].from.Add(p.offset),
+	}
+}
+
+// Info describes the recording replayed, tracks and events are from its last manifest
+func (sc *StreamReplay) Info() RecordingInfo {
+	sc.mutex.RLock()
+	defer sc.mutex.RUnlock()
+	info := RecordingInfo{Dumpdir: cmp.Or(sc.source, sc.dumpdir), Meta: sc.storageMeta, Manifests: len(sc.history)}
+	if len(sc.history) == 0 {
+		return info
+	}
+	info.From, info.To = sc.getRecordingRange()
+	info.LoopFrom = info.From
+	info.LoopTo = info.From.Add(sc.historyEnd.Sub(sc.historyStart))
+	last, err := sc.loadHistoricMpd(info.To)
+	if err != nil {
+		sc.logger.Warn().Err(err).Msg("Load last manifest")
+		return info
+	}
+	info.Tracks, info.Events = mpdTrackInfo(sc.storageMeta.Filter.Apply(last))
+	return info
+}
+
+// Position returns the point of the recording played at 'at'
+// Recordings in progress are not looped, clients choose their timeshift
+func (sc *StreamReplay) Position(at time.Time) LoopPosition {
+	sc.mutex.RLock()
+	defer sc.mutex.RUnlock()
+	if !sc.isPast || len(sc.history) == 0 {
+		return LoopPosition{At: at, Original: at}
+	}
+	offset, shift, loopLength, start := sc.getLoopMeta(at, at, 0)
+	return LoopPosition{
+		At:         at,
+		Loop:       int64(shift / loopLength),
+		Offset:     offset,
+		LoopLength: loopLength,
+		Shift:      shift,
+		Original:   start.Add(offset),
+	}
+}
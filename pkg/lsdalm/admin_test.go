@@ -0,0 +1,61 @@
+package lsdalm
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// adminStub records the calls of the admin API
+type adminStub struct {
+	dumpdir string
+	reloads int
+}
+
+func (as *adminStub) Info() RecordingInfo                { return RecordingInfo{Dumpdir: as.dumpdir} }
+func (as *adminStub) Position(at time.Time) LoopPosition { return LoopPosition{At: at} }
+func (as *adminStub) Reload() error                      { as.reloads++; return nil }
+func (as *adminStub) Switch(dumpdir string) error {
+	if dumpdir == "/rec/missing" {
+		return errors.New("Not enough manifests")
+	}
+	as.dumpdir = dumpdir
+	return nil
+}
+
+func TestAdmin(t *testing.T) {
+	stub := &adminStub{dumpdir: "first"}
+	api := NewAdmin(stub, zerolog.Nop())
+	call := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	w := call("GET", "/admin/recording")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"Dumpdir": "first"`)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, call("GET", "/admin/reload").Code)
+	assert.Equal(t, http.StatusOK, call("POST", "/admin/reload").Code)
+	assert.Equal(t, 1, stub.reloads)
+
+	assert.Equal(t, http.StatusForbidden, call("POST", "/admin/switch?recording=second").Code)
+	api.SetSwitchRoot("/rec/")
+	assert.Equal(t, http.StatusBadRequest, call("POST", "/admin/switch").Code)
+	for _, name := range []string{"/etc", "..", "../x", "a/../../x", "s3://bucket/x"} {
+		assert.Equal(t, http.StatusBadRequest, call("POST", "/admin/switch?recording="+name).Code, name)
+	}
+	assert.Equal(t, http.StatusUnprocessableEntity, call("POST", "/admin/switch?recording=missing").Code)
+	w = call("POST", "/admin/switch?recording=b/second")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "/rec/b/second", stub.dumpdir)
+
+	assert.Equal(t, "[]\n", call("GET", "/admin/sessions").Body.String())
+	assert.Equal(t, http.StatusNotFound, call("GET", "/admin/unknown").Code)
+}
@@ -0,0 +1,244 @@
+package lsdalm
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jdeisenh/lsdalm/pkg/prom"
+)
+
+const (
+	availabilityProbeEarly = 500 * time.Millisecond // Probe this long before the announced availability
+	availabilityRetry      = 250 * time.Millisecond // Probe interval while the segment is not available
+	availabilityGiveUp     = 10 * time.Second       // Report as missing if not available after this time
+	availabilityTolerance  = 500 * time.Millisecond // Tolerated delay before a segment counts as late
+	availabilitySamples    = 1000                   // Max number of delay samples kept per track
+	availabilityMaxProbes  = 64                     // Max number of segments probed in parallel
+)
+
+// Results of an availability probe
+const (
+	AvailabilityOnTime  = "ontime"  // Available at announced time
+	AvailabilityLate    = "late"    // Available, but later than announced
+	AvailabilityEarly   = "early"   // Available before the announced availability time
+	AvailabilityMissing = "missing" // Announced, but not available (404)
+)
+
+// TrackAvailability summarizes the probe results of one track
+type TrackAvailability struct {
+	Track   string `json:"track"`
+	Probed  int    `json:"probed"`
+	OnTime  int    `json:"onTime"`
+	Late    int    `json:"late"`
+	Early   int    `json:"early"`
+	Missing int    `json:"missing"`
+	Skipped int    `json:"skipped,omitempty"` // Not probed due to too many parallel probes
+	// Distribution of delays from announced to real availability
+	DelayMin    Duration `json:"delayMin"`
+	DelayMedian Duration `json:"delayMedian"`
+	DelayP95    Duration `json:"delayP95"`
+	DelayMax    Duration `json:"delayMax"`
+
+	delays []time.Duration
+}
+
+// AvailabilityChecker probes newly announced segments around their availability start time
+type AvailabilityChecker struct {
+	sc        *StreamChecker
+	mutex     sync.Mutex
+	seen      map[string]int // Segment paths already announced, with the number of the manifest last listing them
+	manifests int            // Number of the manifest being announced
+	tracks    map[string]*TrackAvailability
+	primed    bool          // Set after the first manifest: segments in there are not new
+	probes    chan struct{} // Semaphore limiting parallel probes
+	probing   sync.WaitGroup
+}
+
+func NewAvailabilityChecker(sc *StreamChecker) *AvailabilityChecker {
+	return &AvailabilityChecker{
+		sc:     sc,
+		seen:   make(map[string]int),
+		tracks: make(map[string]*TrackAvailability),
+		probes: make(chan struct{}, availabilityMaxProbes),
+	}
+}
+
+// Announce is called for every segment in a manifest and starts a probe for new ones
+func (ac *AvailabilityChecker) Announce(seg SegmentInfo) {
+	if seg.Available.IsZero() {
+		// Init segment
+		return
+	}
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	_, ok := ac.seen[seg.Url.Path]
+	ac.seen[seg.Url.Path] = ac.manifests
+	if ok || !ac.primed {
+		return
+	}
+	select {
+	case ac.probes <- struct{}{}:
+		ac.probing.Add(1)
+		go func() {
+			defer ac.probing.Done()
+			ac.probe(seg, time.Now())
+			<-ac.probes
+		}()
+	default:
+		ac.track(seg.Track).Skipped++
+	}
+}
+
+// EndOfManifest is called after all segments of a manifest were announced
+// it drops the segments no longer listed, the whole DVR window stays known
+func (ac *AvailabilityChecker) EndOfManifest() {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	ac.primed = true
+	for p, n := range ac.seen {
+		if n != ac.manifests {
+			delete(ac.seen, p)
+		}
+	}
+	ac.manifests++
+}
+
+// track returns the stats for a track, mutex must be held
+func (ac *AvailabilityChecker) track(name string) *TrackAvailability {
+	ta, ok := ac.tracks[name]
+	if !ok {
+		ta = &TrackAvailability{Track: name}
+		ac.tracks[name] = ta
+	}
+	return ta
+}
+
+// probe checks the segment before and after its availability time until it is available
+// It ends without result when the fetch context is cancelled
+func (ac *AvailabilityChecker) probe(seg SegmentInfo, announced time.Time) {
+	ctx := ac.sc.fetchCtx
+	// Check if it is served before its time
+	if wait := time.Until(seg.Available.Add(-availabilityProbeEarly)); wait > 0 {
+		if sleepContext(ctx, wait) != nil {
+			return
+		}
+	}
+	if time.Now().Before(seg.Available) {
+		if ac.head(seg) {
+			ac.report(seg, AvailabilityEarly, time.Until(seg.Available))
+			return
+		}
+		if sleepContext(ctx, time.Until(seg.Available)) != nil {
+			return
+		}
+	}
+	// Segments announced after their availability time can only be available at announcement
+	expected := seg.Available
+	if announced.After(expected) {
+		expected = announced
+	}
+	for {
+		if ac.head(seg) {
+			delay := time.Since(expected)
+			if delay > availabilityTolerance {
+				ac.report(seg, AvailabilityLate, delay)
+			} else {
+				ac.report(seg, AvailabilityOnTime, delay)
+			}
+			return
+		}
+		if ctx.Err() != nil {
+			// Shutting down, the request failed for that
+			return
+		}
+		if time.Since(expected) > availabilityGiveUp {
+			ac.report(seg, AvailabilityMissing, time.Since(expected))
+			return
+		}
+		if sleepContext(ctx, availabilityRetry) != nil {
+			return
+		}
+	}
+}
+
+// Wait waits for running probes, which end when the fetch context is cancelled
+func (ac *AvailabilityChecker) Wait() {
+	ac.probing.Wait()
+}
+
+// head does a single HEAD request and returns true on success
+func (ac *AvailabilityChecker) head(seg SegmentInfo) bool {
+	ctx, cancel := context.WithTimeout(ac.sc.fetchCtx, availabilityGiveUp)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "HEAD", seg.Url.String(), nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("User-Agent", ac.sc.userAgent)
+	resp, err := ac.sc.client.Do(req)
+	if err != nil {
+		ac.sc.logger.Debug().Err(err).Str("url", seg.Url.String()).Msg("Probe")
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// report adds a probe result to the track statistics
+func (ac *AvailabilityChecker) report(seg SegmentInfo, result string, delay time.Duration) {
+	ac.mutex.Lock()
+	ta := ac.track(seg.Track)
+	ta.Probed++
+	switch result {
+	case AvailabilityOnTime:
+		ta.OnTime++
+	case AvailabilityLate:
+		ta.Late++
+	case AvailabilityEarly:
+		ta.Early++
+		delay = -delay
+	case AvailabilityMissing:
+		ta.Missing++
+	}
+	if result != AvailabilityMissing {
+		if len(ta.delays) >= availabilitySamples {
+			ta.delays = ta.delays[1:]
+		}
+		ta.delays = append(ta.delays, delay)
+	}
+	ac.mutex.Unlock()
+
+	prom.SegmentAvailability.WithLabelValues(ac.sc.name, seg.Track, result).Inc()
+	if result != AvailabilityMissing {
+		prom.SegmentAvailabilityDelay.WithLabelValues(ac.sc.name, seg.Track).Observe(delay.Seconds())
+	}
+	if result != AvailabilityOnTime {
+		ac.sc.checkerLog.LogAvailability(seg.Track, seg.Url.String(), result, delay)
+	}
+}
+
+// Snapshot returns the statistics per track, with distributions calculated
+func (ac *AvailabilityChecker) Snapshot() []TrackAvailability {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	ret := make([]TrackAvailability, 0, len(ac.tracks))
+	for _, ta := range ac.tracks {
+		c := *ta
+		if n := len(ta.delays); n > 0 {
+			sorted := slices.Clone(ta.delays)
+			slices.Sort(sorted)
+			c.DelayMin = Duration(sorted[0])
+			c.DelayMedian = Duration(sorted[n/2])
+			c.DelayP95 = Duration(sorted[n*95/100])
+			c.DelayMax = Duration(sorted[n-1])
+		}
+		c.delays = nil
+		ret = append(ret, c)
+	}
+	slices.SortFunc(ret, func(a, b TrackAvailability) int { return strings.Compare(a.Track, b.Track) })
+	return ret
+}
@@ -0,0 +1,43 @@
+package lsdalm
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAvailabilityShutdown(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	sc := &StreamChecker{name: "test", fetchCtx: ctx, client: server.Client(), logger: zerolog.Nop()}
+	ac := NewAvailabilityChecker(sc)
+	ac.EndOfManifest()
+
+	segUrl, _ := url.Parse(server.URL + "/v/1.m4s")
+	// Waiting for its availability, and retrying after it
+	ac.Announce(SegmentInfo{Url: segUrl, Track: "video", Available: time.Now().Add(time.Hour)})
+	segUrl, _ = url.Parse(server.URL + "/v/2.m4s")
+	ac.Announce(SegmentInfo{Url: segUrl, Track: "video", Available: time.Now()})
+	time.Sleep(2 * availabilityRetry)
+
+	// Probes end on shutdown without reporting the segments as missing
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		ac.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Probes still running")
+	}
+	assert.Empty(t, ac.Snapshot())
+}
@@ -0,0 +1,135 @@
+package lsdalm
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+)
+
+const backfillProgressInterval = 10 * time.Second // How often backfill progress is logged
+
+// Values for the backfill order
+const (
+	BackfillOldest = "oldest" // Start with the oldest segment of the DVR window
+	BackfillNewest = "newest" // Start next to the live edge and go back in time
+)
+
+// backfill fetches the segments of the DVR window that are older than the fetch window
+type backfill struct {
+	order    string
+	rate     float64       // Segments per second, 0: unlimited
+	segments []SegmentInfo // Collected from the first manifest
+	started  bool
+}
+
+// EnableBackfill fetches the whole DVR window of the first manifest, not only the live fetch window
+// rate limits the requests per second (0: unlimited)
+func (sc *StreamChecker) EnableBackfill(order string, rate float64) error {
+	switch order {
+	case BackfillOldest, BackfillNewest:
+	default:
+		return errors.New("Backfill order must be oldest or newest")
+	}
+	if sc.fetchMode < MODE_ACCESS {
+		return errors.New("Backfill needs media access")
+	}
+	sc.backfill = &backfill{order: order, rate: rate}
+	if err := sc.updateStorageMeta(func(m *StorageMeta) { m.Backfill = m.Previous == "" }); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetFetchWindow changes the range of segments fetched behind the live edge (0: all)
+func (sc *StreamChecker) SetFetchWindow(window time.Duration) error {
+	sc.cutSegmentsAt = window
+	sc.scheduler.SetWindow(window)
+	return sc.updateStorageMeta(func(m *StorageMeta) {
+		d := Duration(window)
+		m.FetchWindow = &d
+	})
+}
+
+// collectBackfill remembers a segment outside the fetch window, if the first manifest is processed
+func (sc *StreamChecker) collectBackfill(seg SegmentInfo) bool {
+	if sc.backfill == nil || sc.backfill.started {
+		return false
+	}
+	sc.backfill.segments = append(sc.backfill.segments, seg)
+	return true
+}
+
+// startBackfill starts fetching the collected segments in the background
+func (sc *StreamChecker) startBackfill(ctx context.Context) {
+	if sc.backfill == nil || sc.backfill.started {
+		return
+	}
+	bf := sc.backfill
+	bf.started = true
+	segs := bf.segments
+	bf.segments = nil
+	if len(segs) == 0 {
+		return
+	}
+	slices.SortStableFunc(segs, func(a, b SegmentInfo) int {
+		if bf.order == BackfillNewest {
+			return b.At.Compare(a.At)
+		}
+		return a.At.Compare(b.At)
+	})
+	sc.logger.Info().Int("segments", len(segs)).Str("order", bf.order).
+		Msgf("Backfill %s - %s", shortT(segs[0].At), shortT(segs[len(segs)-1].At))
+	sc.workers.Add(1)
+	go func() {
+		defer sc.workers.Done()
+		sc.runBackfill(ctx, segs, bf.rate)
+	}()
+}
+
+// runBackfill fetches segs rate limited until done or ctx is cancelled
+func (sc *StreamChecker) runBackfill(ctx context.Context, segs []SegmentInfo, rate float64) {
+	var limit <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		limit = ticker.C
+	}
+	progress := time.NewTicker(backfillProgressInterval)
+	defer progress.Stop()
+	started := time.Now()
+	var failed int
+	for done, seg := range segs {
+		if limit != nil {
+			select {
+			case <-limit:
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			sc.logger.Warn().Int("done", done).Int("total", len(segs)).Msg("Backfill cancelled")
+			return
+		}
+		select {
+		case <-progress.C:
+			if done == 0 {
+				// No rate to estimate from yet
+				sc.logger.Info().Int("done", done).Int("total", len(segs)).Msg("Backfill started")
+				break
+			}
+			elapsed := time.Since(started)
+			eta := time.Duration(float64(elapsed) / float64(done) * float64(len(segs)-done))
+			sc.logger.Info().Int("done", done).Int("total", len(segs)).Int("failed", failed).
+				Msgf("Backfill %d%% ETA %s", done*100/len(segs), RoundToS(eta))
+		default:
+		}
+		if err := sc.executeFetchAndStore(sc.fetchCtx, seg); err != nil {
+			if sc.fetchCtx.Err() != nil {
+				return
+			}
+			failed++
+		}
+	}
+	sc.logger.Info().Int("total", len(segs)).Int("failed", failed).
+		Msgf("Backfill done in %s", RoundToS(time.Since(started)))
+}
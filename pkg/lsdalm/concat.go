@@ -0,0 +1,284 @@
+package lsdalm
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/jdeisenh/lsdalm/pkg/go-mpd"
+)
+
+// ConcatOptions controls how recorded segments are joined
+type ConcatOptions struct {
+	RepIds   []string // Representations to write, empty: all recorded
+	ZeroTfdt bool     // Rewrite decode times to start at zero
+	Mux      bool     // Write the one video and the one audio representation into a single file
+}
+
+// ConcatResult describes the written files
+type ConcatResult struct {
+	Files    []string
+	Segments int
+	Bytes    int64
+	Missing  []string // Segments referenced but not in the recording
+}
+
+// concatTrack reads the fragments of a representation segment by segment
+type concatTrack struct {
+	repId     string
+	mimeType  string
+	init      string   // Local path of the init segment
+	media     []string // Local paths of the media segments, in time order
+	trackId   uint32   // Track id in the output
+	timescale uint32
+	offset    uint64 // Subtracted from the decode times
+	pending   []*mp4.Fragment
+}
+
+// Concat writes the recorded segments of from-to as one fragmented MP4 per representation,
+// or a single muxed file of the selected video and audio representation, to outdir
+func (sc *StreamLooper) Concat(outdir string, from, to time.Time, opts ConcatOptions) (*ConcatResult, error) {
+	if !to.After(from) {
+		return nil, errors.New("Empty range")
+	}
+	if sc.originalBaseUrl == nil || !sc.storageMeta.HaveMedia {
+		return nil, errors.New("Recording has no media")
+	}
+	manifestUrl, err := url.Parse(sc.storageMeta.MediaBase())
+	if err != nil {
+		return nil, err
+	}
+	rangeMpd := sc.storageMeta.Filter.Apply(sc.RangeMpd(from, to.Add(-time.Nanosecond)))
+	tracks, err := sc.concatTracks(rangeMpd.Period[0], manifestUrl, opts.RepIds)
+	if err != nil {
+		return nil, err
+	}
+	if len(tracks) == 0 {
+		return nil, errors.New("No matching representations")
+	}
+	if err := os.MkdirAll(outdir, 0777); err != nil {
+		return nil, err
+	}
+	res := &ConcatResult{}
+	if opts.Mux {
+		var video, audio []*concatTrack
+		for _, ct := range tracks {
+			switch {
+			case strings.HasPrefix(ct.mimeType, "video/"):
+				video = append(video, ct)
+			case strings.HasPrefix(ct.mimeType, "audio/"):
+				audio = append(audio, ct)
+			}
+		}
+		if len(video) != 1 || len(audio) != 1 {
+			return nil, fmt.Errorf("Mux needs exactly one video and one audio representation, have %d and %d", len(video), len(audio))
+		}
+		name := path.Join(outdir, video[0].repId+"+"+audio[0].repId+".mp4")
+		if err := sc.concatFile(name, []*concatTrack{video[0], audio[0]}, opts.ZeroTfdt, res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	for _, ct := range tracks {
+		if err := sc.concatFile(path.Join(outdir, ct.repId+".mp4"), []*concatTrack{ct}, opts.ZeroTfdt, res); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// concatTracks lists the local init and media files of the representations in period
+func (sc *StreamLooper) concatTracks(period *mpd.Period, manifestUrl *url.URL, repIds []string) ([]*concatTrack, error) {
+	segmentPath := segmentPathFromPeriod(period, manifestUrl)
+	var tracks []*concatTrack
+	for _, as := range period.AdaptationSets {
+		st := as.SegmentTemplate
+		if st == nil || st.Media == nil || st.Initialization == nil || strings.Contains(*st.Media, "$Number") {
+			return nil, errors.New("Only $Time$ based SegmentTemplates with initialization can be concatenated")
+		}
+		pathTemplate := NewPathReplacer(*st.Media)
+		for _, rep := range as.Representations {
+			if rep.ID == nil || (len(repIds) > 0 && !slices.Contains(repIds, *rep.ID)) {
+				continue
+			}
+			repId := *rep.ID
+			if !safeRepId.MatchString(repId) {
+				return nil, fmt.Errorf("Representation id %q cannot be used as file name", repId)
+			}
+			ct := &concatTrack{
+				repId:    repId,
+				mimeType: as.MimeType,
+				init:     path.Join(sc.dumpdir, segmentPath.JoinPath(strings.Replace(*st.Initialization, "$RepresentationID$", repId, 1)).Path),
+			}
+			if st.SegmentTimeline != nil {
+				for t := range All(st.SegmentTimeline) {
+					ct.media = append(ct.media, path.Join(sc.dumpdir, segmentPath.JoinPath(pathTemplate.ToPath(int(t), 0, repId)).Path))
+				}
+			}
+			tracks = append(tracks, ct)
+		}
+	}
+	return tracks, nil
+}
+
+// concatFile writes the init segments of tracks as one moov and their fragments interleaved by decode time
+func (sc *StreamLooper) concatFile(name string, tracks []*concatTrack, zeroTfdt bool, res *ConcatResult) error {
+	var init *mp4.InitSegment
+	var maxTrackId uint32
+	for _, ct := range tracks {
+		parsed, err := readMp4(sc.store, ct.init)
+		if err != nil {
+			return fmt.Errorf("Init segment of %s: %w", ct.repId, err)
+		}
+		in := parsed.Init
+		if in == nil || in.Moov == nil || in.Moov.Trak == nil || in.Moov.Mvex == nil || in.Moov.Mvex.Trex == nil {
+			return fmt.Errorf("Init segment of %s is not fragmented", ct.repId)
+		}
+		ct.timescale = in.Moov.Trak.Mdia.Mdhd.Timescale
+		if ct.timescale == 0 {
+			return fmt.Errorf("Init segment of %s has no timescale", ct.repId)
+		}
+		if init == nil {
+			init = in
+			ct.trackId = in.Moov.Trak.Tkhd.TrackID
+			maxTrackId = ct.trackId
+			continue
+		}
+		// Add the track with a new id
+		maxTrackId++
+		ct.trackId = maxTrackId
+		in.Moov.Trak.Tkhd.TrackID = ct.trackId
+		in.Moov.Mvex.Trex.TrackID = ct.trackId
+		init.Moov.AddChild(in.Moov.Trak)
+		init.Moov.Mvex.AddChild(in.Moov.Mvex.Trex)
+		init.Moov.Mvhd.NextTrackID = maxTrackId + 1
+	}
+
+	if zeroTfdt {
+		// Use a common start, so the tracks stay in sync
+		var start time.Duration = -1
+		for _, ct := range tracks {
+			if frag := ct.peek(sc, res); frag != nil {
+				if at := ct.decodeTime(frag); start < 0 || at < start {
+					start = at
+				}
+			}
+		}
+		for _, ct := range tracks {
+			if frag := ct.peek(sc, res); frag != nil && start > 0 {
+				first := ct.baseMediaDecodeTime(frag)
+				ct.offset = min(uint64(Duration2TLP(start, uint64(ct.timescale))), first)
+			}
+		}
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if err := init.Encode(w); err != nil {
+		return err
+	}
+	seq := uint32(1)
+	for {
+		// Next is the fragment with the lowest decode time
+		var next *concatTrack
+		var nextAt time.Duration
+		for _, ct := range tracks {
+			frag := ct.peek(sc, res)
+			if frag == nil {
+				continue
+			}
+			if at := ct.decodeTime(frag); next == nil || at < nextAt {
+				next, nextAt = ct, at
+			}
+		}
+		if next == nil {
+			break
+		}
+		frag := next.pending[0]
+		next.pending = next.pending[1:]
+		frag.Moof.Mfhd.SequenceNumber = seq
+		seq++
+		for _, traf := range frag.Moof.Trafs {
+			traf.Tfhd.TrackID = next.trackId
+			if traf.Tfdt != nil && next.offset > 0 {
+				// Keep the box version, so the trun data offsets stay valid
+				version := traf.Tfdt.Version
+				bmdt := traf.Tfdt.BaseMediaDecodeTime()
+				traf.Tfdt.SetBaseMediaDecodeTime(bmdt - min(next.offset, bmdt))
+				traf.Tfdt.Version = version
+			}
+		}
+		if err := frag.Encode(w); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if info, err := f.Stat(); err == nil {
+		res.Bytes += info.Size()
+	}
+	res.Files = append(res.Files, name)
+	return nil
+}
+
+// peek returns the next fragment of the track, reading segments as needed; nil at the end
+// Segments that cannot be read are logged and recorded as missing
+func (ct *concatTrack) peek(sc *StreamLooper, res *ConcatResult) *mp4.Fragment {
+	for len(ct.pending) == 0 && len(ct.media) > 0 {
+		localpath := ct.media[0]
+		ct.media = ct.media[1:]
+		parsed, err := readMp4(sc.store, localpath)
+		if err != nil {
+			sc.logger.Warn().Err(err).Str("segment", localpath).Msg("Concat")
+			res.Missing = append(res.Missing, localpath)
+			continue
+		}
+		res.Segments++
+		for _, seg := range parsed.Segments {
+			for _, frag := range seg.Fragments {
+				if frag.Moof != nil && frag.Mdat != nil {
+					ct.pending = append(ct.pending, frag)
+				}
+			}
+		}
+	}
+	if len(ct.pending) == 0 {
+		return nil
+	}
+	return ct.pending[0]
+}
+
+// baseMediaDecodeTime returns the decode time of a fragment in the track timescale
+func (ct *concatTrack) baseMediaDecodeTime(frag *mp4.Fragment) uint64 {
+	if frag.Moof.Traf == nil || frag.Moof.Traf.Tfdt == nil {
+		return 0
+	}
+	return frag.Moof.Traf.Tfdt.BaseMediaDecodeTime()
+}
+
+// decodeTime returns the decode time of a fragment, after the offset is applied
+func (ct *concatTrack) decodeTime(frag *mp4.Fragment) time.Duration {
+	return TLP2Duration(int64(ct.baseMediaDecodeTime(frag)-min(ct.offset, ct.baseMediaDecodeTime(frag))), uint64(ct.timescale))
+}
+
+// readMp4 decodes a complete stored mp4 file
+func readMp4(store Storage, localpath string) (*mp4.File, error) {
+	buf, err := store.ReadFile(localpath)
+	if err != nil {
+		return nil, err
+	}
+	return mp4.DecodeFile(bytes.NewReader(buf))
+}
@@ -0,0 +1,44 @@
+package lsdalm
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcat(t *testing.T) {
+	dir := t.TempDir()
+	writeTestRecording(t, dir, StorageMeta{ManifestUrl: "http://origin/live/manifest.mpd", MediaUrl: "http://origin/session/s1/manifest.mpd"}, 20)
+	sc, err := NewStreamLooper(dir, zerolog.Nop())
+	assert.NoError(t, err)
+
+	out := t.TempDir()
+	from := testRecordingStart.Add(10 * time.Second)
+	res, err := sc.Concat(out, from, from.Add(10*time.Second), ConcatOptions{ZeroTfdt: true})
+	assert.NoError(t, err)
+	assert.Empty(t, res.Missing)
+	assert.Equal(t, 5, res.Segments)
+	assert.Equal(t, []string{path.Join(out, "v1.mp4")}, res.Files)
+
+	f, err := os.Open(res.Files[0])
+	assert.NoError(t, err)
+	defer f.Close()
+	parsed, err := mp4.DecodeFile(f)
+	assert.NoError(t, err)
+	assert.NotNil(t, parsed.Init)
+	var decodeTimes []uint64
+	for _, seg := range parsed.Segments {
+		for _, frag := range seg.Fragments {
+			decodeTimes = append(decodeTimes, frag.Moof.Traf.Tfdt.BaseMediaDecodeTime())
+		}
+	}
+	assert.Equal(t, []uint64{0, 2000, 4000, 6000, 8000}, decodeTimes)
+
+	_, err = sc.Concat(out, from, from.Add(10*time.Second), ConcatOptions{RepIds: []string{"a1"}})
+	assert.Error(t, err)
+}
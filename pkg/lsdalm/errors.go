@@ -3,3 +3,9 @@ package lsdalm
 import "errors"
 
 var noncont = errors.New("Not in sequence")
+
+// errNotSuccessful is returned for final http status codes other than success
+var errNotSuccessful = errors.New("Not successful")
+
+// errInvalidRequest wraps errors building a request, which are permanent
+var errInvalidRequest = errors.New("Invalid request")
@@ -0,0 +1,298 @@
+package lsdalm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jdeisenh/lsdalm/pkg/go-mpd"
+)
+
+const (
+	ExportManifestName = "manifest.mpd" // Name of the static MPD in an export
+	ExportChecksumName = "SHA256SUMS"   // Checksum file in an export, sha256sum format
+)
+
+var safeRepId = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// ExportResult describes a written VOD package
+type ExportResult struct {
+	Dir      string
+	From, To time.Time
+	Periods  int
+	Segments int
+	Bytes    int64
+	Missing  []string // Segments referenced but not in the recording
+}
+
+// RecordingRange returns the range of the recording that can be played
+func (sc *StreamLooper) RecordingRange() (from, to time.Time) {
+	return sc.recording.getLoopableRange()
+}
+
+// ParseBound parses a RFC3339 time, or a duration relative to the recording start
+// (negative: relative to the end). Empty returns def
+func ParseBound(v string, start, end, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if strings.HasPrefix(v, "-") {
+		return end.Add(d), nil
+	}
+	return start.Add(d), nil
+}
+
+// periodStart returns the wall clock start of the recordings period
+func (sc *StreamLooper) periodStart() time.Time {
+	return GetAst(sc.recording.firstMpd).Add(GetStart(sc.recording.firstMpd.Period[0]))
+}
+
+// RangeMpd returns an MPD with the original timing holding all recorded segments overlapping from-to
+func (sc *StreamLooper) RangeMpd(from, to time.Time) *mpd.MPD {
+	return sc.BuildMpd(0, "p0", sc.periodStart(), from, to)
+}
+
+// scteSplits returns the video segment boundaries at or after SCTE-35 events between from and to
+func (sc *StreamLooper) scteSplits(from, to time.Time) []time.Time {
+	periodStart := sc.periodStart()
+	var events []time.Time
+	for scheme, es := range sc.recording.EventStreamMap {
+		if scheme != SchemeScteXml {
+			continue
+		}
+		timescale := ZeroIfNil(es.Timescale)
+		pto := ZeroIfNil(es.PresentationTimeOffset)
+		for _, e := range es.Event {
+			events = append(events, periodStart.Add(TLP2Duration(int64(ZeroIfNil(e.PresentationTime)-pto), timescale)))
+		}
+	}
+	// Align to video segments
+	var splits []time.Time
+	for k, as := range sc.recording.Segments {
+		ras := sc.recording.firstMpd.Period[0].AdaptationSets[k]
+		if ras.MimeType != "video/mp4" {
+			continue
+		}
+		timescale := ZeroIfNil(ras.SegmentTemplate.Timescale)
+		pto := int64(ZeroIfNil(ras.SegmentTemplate.PresentationTimeOffset))
+		for _, ev := range events {
+			start := as.start
+		search:
+			for _, element := range as.elements {
+				for r := int64(0); r < element.r+1; r++ {
+					at := periodStart.Add(TLP2Duration(start-pto, timescale))
+					if !at.Before(ev) {
+						if at.After(from) && at.Before(to) {
+							splits = append(splits, at)
+						}
+						break search
+					}
+					start += element.d
+				}
+			}
+		}
+		break
+	}
+	slices.SortFunc(splits, func(a, b time.Time) int { return a.Compare(b) })
+	return slices.CompactFunc(splits, func(a, b time.Time) bool { return a.Equal(b) })
+}
+
+// Export writes the range from-to as a static VOD package to outdir:
+// a static MPD with relative paths, the referenced segments and a checksum file.
+// If splitScte is set, a new period starts at every SCTE-35 event
+func (sc *StreamLooper) Export(outdir string, from, to time.Time, splitScte bool) (*ExportResult, error) {
+	if !to.After(from) {
+		return nil, errors.New("Empty export range")
+	}
+	if sc.originalBaseUrl == nil || !sc.storageMeta.HaveMedia {
+		return nil, errors.New("Recording has no media")
+	}
+	if err := os.MkdirAll(outdir, 0777); err != nil {
+		return nil, err
+	}
+	manifestUrl, err := url.Parse(sc.storageMeta.MediaBase())
+	if err != nil {
+		return nil, err
+	}
+	res := &ExportResult{Dir: outdir, From: from, To: to}
+
+	bounds := []time.Time{from}
+	if splitScte {
+		bounds = append(bounds, sc.scteSplits(from, to)...)
+	}
+	bounds = append(bounds, to)
+
+	periodStart := sc.periodStart()
+	out := Copy(sc.recording.firstMpd)
+	out.Period = nil
+	checksums := make(map[string]string)
+	for i := 0; i < len(bounds)-1; i++ {
+		start, end := bounds[i], bounds[i+1]
+		// Exclude segments starting at the end, they belong to the next period
+		rangeMpd := sc.BuildMpd(0, fmt.Sprintf("p%d", i), periodStart, start, end.Add(-time.Nanosecond))
+		rangeMpd = sc.storageMeta.Filter.Apply(rangeMpd)
+		period := rangeMpd.Period[0]
+		if err := sc.exportSegments(period, manifestUrl, outdir, res, checksums); err != nil {
+			return nil, err
+		}
+		// Presentation time 0 of the period is 'start'
+		shift := start.Sub(periodStart)
+		for _, as := range period.AdaptationSets {
+			ShiftPto(as.SegmentTemplate, shift)
+		}
+		for _, es := range period.EventStream {
+			pto := uint64(int64(ZeroIfNil(es.PresentationTimeOffset)) + Duration2TLP(shift, ZeroIfNil(es.Timescale)))
+			es.PresentationTimeOffset = &pto
+		}
+		ps := DurationToXsdDuration(start.Sub(from))
+		pd := DurationToXsdDuration(end.Sub(start))
+		period.Start = &ps
+		period.Duration = &pd
+		period.BaseURL = nil
+		out.Period = append(out.Period, period)
+	}
+	res.Periods = len(out.Period)
+
+	static := "static"
+	dur := DurationToXsdDuration(to.Sub(from))
+	out.Type = &static
+	out.MediaPresentationDuration = &dur
+	out.BaseURL = nil
+	out.AvailabilityStartTime = nil
+	out.AvailabilityEndTime = nil
+	out.PublishTime = nil
+	out.MinimumUpdatePeriod = nil
+	out.TimeShiftBufferDepth = nil
+	out.SuggestedPresentationDelay = nil
+	out.UTCTiming = nil
+	contents, err := out.Encode()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path.Join(outdir, ExportManifestName), contents, 0644); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(contents)
+	checksums[ExportManifestName] = hex.EncodeToString(sum[:])
+
+	// Checksum file in sha256sum format
+	names := make([]string, 0, len(checksums))
+	for name := range checksums {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var sums strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sums, "%s  %s\n", checksums[name], name)
+	}
+	if err := os.WriteFile(path.Join(outdir, ExportChecksumName), []byte(sums.String()), 0644); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// exportSegments copies the segments of a period and rewrites its templates
+// to '<RepresentationID>/<Time>' relative to the MPD
+func (sc *StreamLooper) exportSegments(period *mpd.Period, manifestUrl *url.URL, outdir string, res *ExportResult, checksums map[string]string) error {
+	segmentPath := segmentPathFromPeriod(period, manifestUrl)
+	for _, as := range period.AdaptationSets {
+		st := as.SegmentTemplate
+		if st.Media == nil || strings.Contains(*st.Media, "$Number") {
+			return errors.New("Only $Time$ based SegmentTemplates can be exported")
+		}
+		mediaExt := templateExt(*st.Media, ".m4s")
+		initExt := ".mp4"
+		if st.Initialization != nil {
+			initExt = templateExt(*st.Initialization, initExt)
+		}
+		pathTemplate := NewPathReplacer(*st.Media)
+		for _, rep := range as.Representations {
+			if rep.ID == nil {
+				continue
+			}
+			repId := *rep.ID
+			if !safeRepId.MatchString(repId) {
+				return fmt.Errorf("Representation id %q cannot be used as path", repId)
+			}
+			if st.Initialization != nil {
+				src := segmentPath.JoinPath(strings.Replace(*st.Initialization, "$RepresentationID$", repId, 1))
+				sc.exportFile(src, path.Join(repId, "init"+initExt), outdir, res, checksums)
+			}
+			if st.SegmentTimeline == nil {
+				continue
+			}
+			for t := range All(st.SegmentTimeline) {
+				src := segmentPath.JoinPath(pathTemplate.ToPath(int(t), 0, repId))
+				sc.exportFile(src, path.Join(repId, fmt.Sprintf("%d%s", t, mediaExt)), outdir, res, checksums)
+			}
+		}
+		media := "$RepresentationID$/$Time$" + mediaExt
+		init := "$RepresentationID$/init" + initExt
+		nst := Copy(st)
+		nst.Media = &media
+		if st.Initialization != nil {
+			nst.Initialization = &init
+		}
+		as.SegmentTemplate = nst
+		as.BaseURL = nil
+		as.Representations = slices.Clone(as.Representations)
+		for ri := range as.Representations {
+			as.Representations[ri].BaseURL = nil
+		}
+	}
+	return nil
+}
+
+// exportFile copies a recorded segment into the export, once
+func (sc *StreamLooper) exportFile(src *url.URL, dst, outdir string, res *ExportResult, checksums map[string]string) {
+	if _, ok := checksums[dst]; ok {
+		return
+	}
+	if err := sc.copyWithChecksum(path.Join(sc.dumpdir, src.Path), path.Join(outdir, dst), checksums, dst, res); err != nil {
+		sc.logger.Warn().Err(err).Str("segment", src.Path).Msg("Export")
+		res.Missing = append(res.Missing, src.Path)
+	}
+}
+
+// copyWithChecksum copies a stored file to the local dst and records its sha256
+func (sc *StreamLooper) copyWithChecksum(src, dst string, checksums map[string]string, name string, res *ExportResult) error {
+	data, err := sc.store.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(dst), 0777); err != nil {
+		return err
+	}
+	if err := os.WriteFile(dst, data, 0644); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	checksums[name] = hex.EncodeToString(sum[:])
+	res.Segments++
+	res.Bytes += int64(len(data))
+	return nil
+}
+
+// templateExt returns the file extension of a segment template, def if there is none
+func templateExt(template, def string) string {
+	ext := path.Ext(strings.NewReplacer("$Time$", "", "$Number$", "", "$RepresentationID$", "").Replace(template))
+	if ext == "" || strings.ContainsAny(ext, "$/?") {
+		return def
+	}
+	return ext
+}
@@ -0,0 +1,105 @@
+package lsdalm
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// testRecordingStart is the availabilityStartTime of recordings written by writeTestRecording
+var testRecordingStart = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// writeTestRecording writes a recording of polls manifests to dir, one every 2s, each listing one more 2s segment
+// The media is stored below the path of meta.MediaBase(), as the recorder does for sessions,
+// and all files have the time they were recorded at
+func writeTestRecording(t *testing.T, dir string, meta StorageMeta, polls int) {
+	t.Helper()
+	meta.HaveMedia = true
+	assert.NoError(t, WriteStorageMeta(LocalStorage{}, dir, meta))
+	mediaUrl, err := url.Parse(meta.MediaBase())
+	assert.NoError(t, err)
+	base := path.Join(dir, path.Dir(mediaUrl.Path))
+	write := func(name string, data []byte, at time.Time) {
+		assert.NoError(t, LocalStorage{}.WriteFile(name, data))
+		assert.NoError(t, os.Chtimes(name, at, at))
+	}
+
+	var init bytes.Buffer
+	in := mp4.CreateEmptyInit()
+	in.AddEmptyTrack(1000, "video", "und")
+	assert.NoError(t, in.Encode(&init))
+	write(path.Join(base, "v1/init.mp4"), init.Bytes(), testRecordingStart)
+
+	mw := newManifestWriter(ManifestPlain)
+	for n := 0; n < polls; n++ {
+		t0 := uint64(n * 2000)
+		frag, err := mp4.CreateFragment(uint32(n+1), 1)
+		assert.NoError(t, err)
+		frag.AddFullSample(mp4.FullSample{Sample: mp4.NewSample(mp4.SyncSampleFlags, 2000, 4, 0), DecodeTime: t0, Data: []byte("data")})
+		var seg bytes.Buffer
+		assert.NoError(t, frag.Encode(&seg))
+		at := testRecordingAt(n)
+		write(path.Join(base, fmt.Sprintf("v1/%d.m4s", t0)), seg.Bytes(), at)
+
+		name, err := mw.Write(LocalStorage{}, path.Join(dir, ManifestPath), at, testManifest(n))
+		assert.NoError(t, err)
+		assert.NoError(t, os.Chtimes(name, at, at))
+	}
+}
+
+// testRecordingAt returns the time of poll n of a test recording
+func testRecordingAt(n int) time.Time {
+	return testRecordingStart.Add(time.Duration(n+1) * 2 * time.Second)
+}
+
+// testManifest returns the manifest of poll n of a test recording, listing the last 5 segments
+func testManifest(n int) []byte {
+	first := max(n-4, 0)
+	return []byte(fmt.Sprintf(`<?xml version="1.0"?><MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic" `+
+		`availabilityStartTime="%s" publishTime="%s" minimumUpdatePeriod="PT2S" timeShiftBufferDepth="PT10S">`+
+		`<Period id="p0" start="PT0S"><AdaptationSet mimeType="video/mp4" contentType="video">`+
+		`<SegmentTemplate timescale="1000" media="$RepresentationID$/$Time$.m4s" initialization="$RepresentationID$/init.mp4">`+
+		`<SegmentTimeline><S t="%d" d="2000" r="%d"/></SegmentTimeline></SegmentTemplate>`+
+		`<Representation id="v1" bandwidth="100000" codecs="avc1.64001f"/></AdaptationSet></Period></MPD>`,
+		testRecordingStart.Format(time.RFC3339), testRecordingAt(n).Format(time.RFC3339), first*2000, n-first))
+}
+
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	// Media of a session is below the session URL, not the manifest URL
+	writeTestRecording(t, dir, StorageMeta{ManifestUrl: "http://origin/live/manifest.mpd", MediaUrl: "http://origin/session/s1/manifest.mpd"}, 20)
+	sc, err := NewStreamLooper(dir, zerolog.Nop())
+	assert.NoError(t, err)
+
+	out := t.TempDir()
+	from := testRecordingStart.Add(10 * time.Second)
+	res, err := sc.Export(out, from, from.Add(10*time.Second), false)
+	assert.NoError(t, err)
+	assert.Empty(t, res.Missing)
+	assert.Equal(t, 1, res.Periods)
+	// Init and 5 segments
+	assert.Equal(t, 6, res.Segments)
+	for _, name := range []string{ExportManifestName, ExportChecksumName, "v1/init.mp4", "v1/10000.m4s", "v1/18000.m4s"} {
+		_, err := os.Stat(path.Join(out, name))
+		assert.NoError(t, err, name)
+	}
+	manifest, err := os.ReadFile(path.Join(out, ExportManifestName))
+	assert.NoError(t, err)
+	assert.Contains(t, string(manifest), `type="static"`)
+	assert.Contains(t, string(manifest), `media="$RepresentationID$/$Time$.m4s"`)
+	sums, err := os.ReadFile(path.Join(out, ExportChecksumName))
+	assert.NoError(t, err)
+	assert.Equal(t, 7, strings.Count(string(sums), "\n"))
+
+	_, err = sc.Export(out, from, from, false)
+	assert.Error(t, err)
+}
@@ -0,0 +1,290 @@
+package lsdalm
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdeisenh/lsdalm/pkg/go-mpd"
+	"github.com/rs/zerolog"
+)
+
+// FaultPathPrefix starts the path of a faulty session: /faults/<spec>/manifest.mpd
+// Segment URLs are relative to the manifest, so they carry the spec too
+const FaultPathPrefix = "/faults/"
+
+// FaultProfile describes the errors injected into manifests and segments of a session
+// Rates are fractions of the responses, from 0 to 1
+type FaultProfile struct {
+	ManifestDelay   time.Duration // Delay of every manifest response
+	StaleRate       float64       // Manifests generated StaleBy in the past
+	StaleBy         time.Duration
+	DropPeriodRate  float64       // Manifests missing their last Period, or its segments if it is the only one
+	TimestampShift  time.Duration // Added to the presentationTimeOffsets, moving media against the Period timeline
+	DuplicateEvents bool          // Every event is listed twice
+	ErrorRate       float64       // Segment requests failing with ErrorStatus
+	ErrorStatus     int           // Default 404
+	TruncateRate    float64       // Segments cut to half their size
+	Throughput      int64         // Bit per second for segments, as rate= of shaping sessions, 0: unlimited
+}
+
+// faultKeys lists the keys of the spec syntax
+var faultKeys = "delay, stale, stalerate, droprate, tsshift, dupevents, errrate, errstatus, truncrate, rate (bit/s)"
+
+// ParseFaultSpec parses a comma separated list of profile names and key=value settings,
+// applied in order, e.g. "flaky,errstatus=503" or "delay=2s,rate=800k"
+func ParseFaultSpec(spec string, profiles map[string]FaultProfile) (FaultProfile, error) {
+	var fp FaultProfile
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(item, "=")
+		if !ok {
+			profile, found := profiles[item]
+			if !found {
+				return fp, fmt.Errorf("Unknown fault profile %q", item)
+			}
+			fp = profile
+			continue
+		}
+		if err := fp.set(key, value); err != nil {
+			return fp, fmt.Errorf("Fault %s: %w", key, err)
+		}
+	}
+	return fp, nil
+}
+
+// set assigns one setting of the spec syntax
+func (fp *FaultProfile) set(key, value string) error {
+	var err error
+	rate := func(target *float64) {
+		*target, err = strconv.ParseFloat(value, 64)
+		if err == nil && (*target < 0 || *target > 1) {
+			err = fmt.Errorf("Rate %s not between 0 and 1", value)
+		}
+	}
+	switch key {
+	case "delay":
+		fp.ManifestDelay, err = time.ParseDuration(value)
+	case "stale":
+		fp.StaleBy, err = time.ParseDuration(value)
+		if fp.StaleRate == 0 {
+			fp.StaleRate = 1
+		}
+	case "stalerate":
+		rate(&fp.StaleRate)
+	case "droprate":
+		rate(&fp.DropPeriodRate)
+	case "tsshift":
+		fp.TimestampShift, err = time.ParseDuration(value)
+	case "dupevents":
+		fp.DuplicateEvents, err = strconv.ParseBool(value)
+	case "errrate":
+		rate(&fp.ErrorRate)
+	case "errstatus":
+		fp.ErrorStatus, err = strconv.Atoi(value)
+		if err == nil && (fp.ErrorStatus < 400 || fp.ErrorStatus > 599) {
+			err = fmt.Errorf("Status %d is no error", fp.ErrorStatus)
+		}
+	case "truncrate":
+		rate(&fp.TruncateRate)
+	case "rate":
+		fp.Throughput, err = ParseBitrate(value)
+	default:
+		err = fmt.Errorf("Unknown key, use one of %s", faultKeys)
+	}
+	return err
+}
+
+// LoadFaultProfiles reads named profiles from a JSON object mapping names to specs
+func LoadFaultProfiles(filename string) (map[string]FaultProfile, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var specs map[string]string
+	if err := json.Unmarshal(buf, &specs); err != nil {
+		return nil, err
+	}
+	profiles := make(map[string]FaultProfile, len(specs))
+	for name, spec := range specs {
+		if strings.ContainsAny(name, ",=/") {
+			return nil, fmt.Errorf("Invalid fault profile name %q", name)
+		}
+		if profiles[name], err = ParseFaultSpec(spec, nil); err != nil {
+			return nil, fmt.Errorf("Fault profile %s: %w", name, err)
+		}
+	}
+	return profiles, nil
+}
+
+// faultSession is a profile in use by a client
+type faultSession struct {
+	FaultProfile
+	spec   string
+	logger zerolog.Logger
+}
+
+// newFaultSession creates a session logging with spec and client address
+func newFaultSession(fp FaultProfile, spec string, r *http.Request, logger zerolog.Logger) *faultSession {
+	return &faultSession{
+		FaultProfile: fp,
+		spec:         spec,
+		logger:       logger.With().Str("faults", spec).Str("client", r.RemoteAddr).Logger(),
+	}
+}
+
+// hit decides randomly for a rate
+func (sess *faultSession) hit(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+// log records an injected fault
+func (sess *faultSession) log(fault, path string) {
+	sess.logger.Info().Str("fault", fault).Str("path", path).Msg("Inject")
+}
+
+// manifestTime returns the time to generate the manifest for, stale or now
+func (sess *faultSession) manifestTime(now time.Time, path string) time.Time {
+	if sess.StaleBy > 0 && sess.hit(sess.StaleRate) {
+		sess.log("stale "+sess.StaleBy.String(), path)
+		return now.Add(-sess.StaleBy)
+	}
+	return now
+}
+
+// applyManifest modifies a generated manifest
+func (sess *faultSession) applyManifest(mpde *mpd.MPD, path string) {
+	if len(mpde.Period) > 0 && sess.hit(sess.DropPeriodRate) {
+		if len(mpde.Period) > 1 {
+			sess.log("drop period", path)
+			mpde.Period = mpde.Period[:len(mpde.Period)-1]
+		} else {
+			// Looped manifests mostly have a single Period, it loses its segments instead
+			sess.log("blank period", path)
+			editTemplates(mpde.Period[0], func(st, _ *mpd.SegmentTemplate) {
+				if st.SegmentTimeline != nil {
+					st.SegmentTimeline = &mpd.SegmentTimeline{}
+				}
+			})
+		}
+	}
+	if sess.TimestampShift != 0 {
+		sess.log("timestamp shift "+sess.TimestampShift.String(), path)
+		for _, period := range mpde.Period {
+			editTemplates(period, func(st, inherited *mpd.SegmentTemplate) {
+				if inherited != nil {
+					st.Timescale = cmp.Or(st.Timescale, inherited.Timescale)
+					st.PresentationTimeOffset = cmp.Or(st.PresentationTimeOffset, inherited.PresentationTimeOffset)
+				}
+				ShiftPto(st, sess.TimestampShift)
+			})
+		}
+	}
+	if sess.DuplicateEvents {
+		for _, period := range mpde.Period {
+			for i, evs := range period.EventStream {
+				if len(evs.Event) == 0 {
+					continue
+				}
+				sess.log("duplicate events", path)
+				nevs := Copy(evs)
+				nevs.Event = slices.Concat(evs.Event, evs.Event)
+				period.EventStream[i] = nevs
+			}
+		}
+	}
+}
+
+// editTemplates replaces the SegmentTemplates of the AdaptationSets and Representations of period
+// by copies changed by edit, which gets the AdaptationSet template a Representation template inherits from
+func editTemplates(period *mpd.Period, edit func(st, inherited *mpd.SegmentTemplate)) {
+	for i, as := range period.AdaptationSets {
+		nas := Copy(as)
+		if as.SegmentTemplate != nil {
+			nas.SegmentTemplate = Copy(as.SegmentTemplate)
+			edit(nas.SegmentTemplate, nil)
+		}
+		nas.Representations = slices.Clone(as.Representations)
+		for ri, rep := range nas.Representations {
+			if rep.SegmentTemplate != nil {
+				nas.Representations[ri].SegmentTemplate = Copy(rep.SegmentTemplate)
+				edit(nas.Representations[ri].SegmentTemplate, as.SegmentTemplate)
+			}
+		}
+		period.AdaptationSets[i] = nas
+	}
+}
+
+// delayManifest waits ManifestDelay or until the request is cancelled
+func (sess *faultSession) delayManifest(r *http.Request) {
+	if sess.ManifestDelay <= 0 {
+		return
+	}
+	sess.log("delay "+sess.ManifestDelay.String(), r.URL.Path)
+	sleepContext(r.Context(), sess.ManifestDelay)
+}
+
+// segmentWriter returns the writer to serve a segment through, nil if an error was sent instead
+func (sess *faultSession) segmentWriter(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if sess.hit(sess.ErrorRate) {
+		status := cmp.Or(sess.ErrorStatus, http.StatusNotFound)
+		sess.log("status "+strconv.Itoa(status), r.URL.Path)
+		http.Error(w, http.StatusText(status), status)
+		return nil
+	}
+	if sess.hit(sess.TruncateRate) {
+		sess.log("truncate", r.URL.Path)
+		w = &truncatingWriter{ResponseWriter: w, remaining: -1}
+	}
+	if sess.Throughput > 0 {
+		sess.log("throughput "+strconv.FormatInt(sess.Throughput, 10), r.URL.Path)
+		pace := newShapeSession(ShapeProfile{{Rate: sess.Throughput}}, zerolog.Nop())
+		w = &shapedWriter{ResponseWriter: w, sess: pace, ctx: r.Context()}
+	}
+	return w
+}
+
+// truncatingWriter sends only the first half of the body, with a matching Content-Length
+type truncatingWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	remaining   int64 // -1: unknown length, pass through
+}
+
+func (tw *truncatingWriter) WriteHeader(status int) {
+	tw.wroteHeader = true
+	if n, err := strconv.ParseInt(tw.Header().Get("Content-Length"), 10, 64); err == nil && status == http.StatusOK {
+		tw.remaining = n / 2
+		tw.Header().Set("Content-Length", strconv.FormatInt(tw.remaining, 10))
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *truncatingWriter) Write(p []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	if tw.remaining < 0 {
+		return tw.ResponseWriter.Write(p)
+	}
+	n := int64(len(p))
+	if n > tw.remaining {
+		if _, err := tw.ResponseWriter.Write(p[:tw.remaining]); err != nil {
+			return 0, err
+		}
+		tw.remaining = 0
+		// Pretend success, the rest is dropped
+		return len(p), nil
+	}
+	tw.remaining -= n
+	return tw.ResponseWriter.Write(p)
+}
@@ -0,0 +1,98 @@
+package lsdalm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdeisenh/lsdalm/pkg/go-mpd"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultSpec(t *testing.T) {
+	profiles := map[string]FaultProfile{"flaky": {ErrorRate: 0.1, ErrorStatus: 503}}
+	fp, err := ParseFaultSpec("flaky,errstatus=500,delay=2s,stale=30s,rate=800k", profiles)
+	assert.NoError(t, err)
+	assert.Equal(t, FaultProfile{ErrorRate: 0.1, ErrorStatus: 500, ManifestDelay: 2 * time.Second,
+		StaleRate: 1, StaleBy: 30 * time.Second, Throughput: 800000}, fp)
+
+	for _, spec := range []string{"unknown", "errrate=2", "errstatus=200", "color=red", "delay=soon"} {
+		_, err := ParseFaultSpec(spec, profiles)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestFaultManifest(t *testing.T) {
+	manifest := func() *mpd.MPD {
+		mpde := new(mpd.MPD)
+		assert.NoError(t, mpde.Decode([]byte(`<?xml version="1.0"?><MPD xmlns="urn:mpeg:dash:schema:mpd:2011"><Period id="p0">`+
+			`<AdaptationSet><SegmentTemplate timescale="1000" presentationTimeOffset="5000">`+
+			`<SegmentTimeline><S t="5000" d="2000" r="3"/></SegmentTimeline></SegmentTemplate>`+
+			`<Representation id="v1"/><Representation id="v2"><SegmentTemplate media="v2/$Time$.m4s"/></Representation></AdaptationSet>`+
+			`</Period></MPD>`)))
+		return mpde
+	}
+	fp, err := ParseFaultSpec("tsshift=1s", nil)
+	assert.NoError(t, err)
+	mpde := manifest()
+	org := mpde.Period[0].AdaptationSets[0]
+	newFaultSession(fp, "", httptest.NewRequest("GET", "/", nil), zerolog.Nop()).applyManifest(mpde, "/manifest.mpd")
+	as := mpde.Period[0].AdaptationSets[0]
+	assert.Equal(t, uint64(6000), *as.SegmentTemplate.PresentationTimeOffset)
+	// Representation templates inherit the offset
+	assert.Equal(t, uint64(6000), *as.Representations[1].SegmentTemplate.PresentationTimeOffset)
+	assert.Equal(t, uint64(5000), *org.SegmentTemplate.PresentationTimeOffset)
+	assert.Nil(t, org.Representations[1].SegmentTemplate.PresentationTimeOffset)
+
+	// A single Period loses its segments
+	fp, err = ParseFaultSpec("droprate=1", nil)
+	assert.NoError(t, err)
+	mpde = manifest()
+	newFaultSession(fp, "", httptest.NewRequest("GET", "/", nil), zerolog.Nop()).applyManifest(mpde, "/manifest.mpd")
+	assert.Len(t, mpde.Period, 1)
+	assert.Empty(t, mpde.Period[0].AdaptationSets[0].SegmentTemplate.SegmentTimeline.S)
+	mpde = manifest()
+	mpde.Period = append(mpde.Period, Copy(mpde.Period[0]))
+	newFaultSession(fp, "", httptest.NewRequest("GET", "/", nil), zerolog.Nop()).applyManifest(mpde, "/manifest.mpd")
+	assert.Len(t, mpde.Period, 1)
+	assert.Len(t, mpde.Period[0].AdaptationSets[0].SegmentTemplate.SegmentTimeline.S, 1)
+}
+
+func TestFaultSegmentWriter(t *testing.T) {
+	body := strings.Repeat("x", 40000)
+	writer := func(spec string, w http.ResponseWriter) (http.ResponseWriter, *http.Request) {
+		fp, err := ParseFaultSpec(spec, nil)
+		assert.NoError(t, err)
+		r := httptest.NewRequest("GET", "/v/1.m4s", nil)
+		return newFaultSession(fp, spec, r, zerolog.Nop()).segmentWriter(w, r), r
+	}
+	serve := func(spec string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		if fw, r := writer(spec, w); fw != nil {
+			http.ServeContent(fw, r, "1.m4s", time.Time{}, strings.NewReader(body))
+		}
+		return w
+	}
+
+	w := serve("errrate=1,errstatus=503")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	w = serve("truncrate=1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "20000", w.Header().Get("Content-Length"))
+	assert.Equal(t, 20000, w.Body.Len())
+
+	// Bit per second, as in shaping sessions: the body is due after 40000*8/16000000 s
+	w = serve("rate=16M")
+	assert.Equal(t, body, w.Body.String())
+	fw, _ := writer("rate=16M", httptest.NewRecorder())
+	sw, ok := fw.(*shapedWriter)
+	assert.True(t, ok)
+	before := time.Now()
+	due := sw.sess.reserve(len(body))
+	assert.WithinRange(t, due, before.Add(20*time.Millisecond), time.Now().Add(20*time.Millisecond))
+	assert.Equal(t, 20*time.Millisecond, sw.sess.reserve(len(body)).Sub(due))
+}
@@ -0,0 +1,187 @@
+package lsdalm
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jdeisenh/lsdalm/pkg/prom"
+)
+
+const fetchStatsInterval = time.Minute // How often aggregated fetch stats are logged
+
+// Cache results derived from the response headers
+const (
+	CacheUnknown = ""
+	CacheHit     = "hit"
+	CacheMiss    = "miss"
+)
+
+// SegmentFetchRecord holds the timing, size and caching data of a single segment request
+type SegmentFetchRecord struct {
+	Url          string   `json:"url"`
+	RepId        string   `json:"representation"`
+	Status       int      `json:"status"`
+	Ttfb         Duration `json:"ttfb"`
+	Total        Duration `json:"total"`
+	Bytes        int64    `json:"bytes"`
+	Throughput   float64  `json:"throughput"` // bit/s
+	Age          string   `json:"age,omitempty"`
+	XCache       string   `json:"xCache,omitempty"`
+	Via          string   `json:"via,omitempty"`
+	CacheControl string   `json:"cacheControl,omitempty"`
+	ETag         string   `json:"etag,omitempty"`
+	Cache        string   `json:"cache,omitempty"` // One of the Cache constants
+	Early        bool     `json:"early,omitempty"` // Served before the segment was complete
+}
+
+// NewSegmentFetchRecord fills a record from the response and the measured times
+// 'requested' is the start of the request and is used to detect segments served before 'available'
+func NewSegmentFetchRecord(fetchme SegmentInfo, resp *http.Response, requested time.Time, ttfb, total time.Duration, size int64) *SegmentFetchRecord {
+	rec := &SegmentFetchRecord{
+		Url:   fetchme.Url.String(),
+		RepId: fetchme.RepId,
+		Ttfb:  Duration(ttfb),
+		Total: Duration(total),
+		Bytes: size,
+	}
+	if total > 0 {
+		rec.Throughput = float64(size*8) / total.Seconds()
+	}
+	if resp == nil {
+		return rec
+	}
+	rec.Status = resp.StatusCode
+	rec.Age = resp.Header.Get("Age")
+	rec.XCache = resp.Header.Get("X-Cache")
+	rec.Via = resp.Header.Get("Via")
+	rec.CacheControl = resp.Header.Get("Cache-Control")
+	rec.ETag = resp.Header.Get("ETag")
+
+	age, _ := strconv.Atoi(rec.Age)
+	switch xc := strings.ToUpper(rec.XCache); {
+	case strings.Contains(xc, "HIT"):
+		rec.Cache = CacheHit
+	case strings.Contains(xc, "MISS"):
+		rec.Cache = CacheMiss
+	case age > 0:
+		rec.Cache = CacheHit
+	}
+	// The response was generated 'Age' seconds before we requested it
+	generated := requested.Add(-time.Duration(age) * time.Second)
+	if rec.Status == http.StatusOK && !fetchme.Available.IsZero() && generated.Before(fetchme.Available.Add(-maxTimeDiff)) {
+		rec.Early = true
+	}
+	return rec
+}
+
+// RepFetchStats aggregates the fetch records of one representation
+type RepFetchStats struct {
+	RepId      string   `json:"representation"`
+	Count      int      `json:"count"`
+	Errors     int      `json:"errors"`
+	Bytes      int64    `json:"bytes"`
+	TotalTime  Duration `json:"totalTime"`
+	TtfbAvg    Duration `json:"ttfbAvg"`
+	TtfbMax    Duration `json:"ttfbMax"`
+	Throughput float64  `json:"throughput"` // bit/s, average over all successful requests
+	Hits       int      `json:"hits"`
+	Misses     int      `json:"misses"`
+	Early      int      `json:"early"`
+	Retried    int      `json:"retried"` // Succeeded after retries
+	Failed     int      `json:"failed"`  // Failed after all retries
+
+	ttfbSum time.Duration
+}
+
+// FetchStats collects per representation statistics of segment fetches
+type FetchStats struct {
+	channel string
+	mutex   sync.Mutex
+	reps    map[string]*RepFetchStats
+}
+
+func NewFetchStats(channel string) *FetchStats {
+	return &FetchStats{
+		channel: channel,
+		reps:    make(map[string]*RepFetchStats),
+	}
+}
+
+// Add adds a record to the aggregation and exports it
+func (fs *FetchStats) Add(rec *SegmentFetchRecord) {
+	fs.mutex.Lock()
+	rs, ok := fs.reps[rec.RepId]
+	if !ok {
+		rs = &RepFetchStats{RepId: rec.RepId}
+		fs.reps[rec.RepId] = rs
+	}
+	rs.Count++
+	if rec.Status != http.StatusOK {
+		rs.Errors++
+	} else {
+		rs.Bytes += rec.Bytes
+		rs.TotalTime += rec.Total
+		rs.ttfbSum += time.Duration(rec.Ttfb)
+		rs.TtfbMax = max(rs.TtfbMax, rec.Ttfb)
+	}
+	switch rec.Cache {
+	case CacheHit:
+		rs.Hits++
+	case CacheMiss:
+		rs.Misses++
+	}
+	if rec.Early {
+		rs.Early++
+	}
+	fs.mutex.Unlock()
+
+	prom.SegmentRequests.WithLabelValues(fs.channel, rec.RepId, strconv.Itoa(rec.Status), rec.Cache).Inc()
+	if rec.Status == http.StatusOK {
+		prom.SegmentFetchSeconds.WithLabelValues(fs.channel, rec.RepId).Observe(time.Duration(rec.Total).Seconds())
+		prom.SegmentTtfbSeconds.WithLabelValues(fs.channel, rec.RepId).Observe(time.Duration(rec.Ttfb).Seconds())
+		prom.SegmentBytes.WithLabelValues(fs.channel, rec.RepId).Add(float64(rec.Bytes))
+	}
+	if rec.Early {
+		prom.SegmentEarly.WithLabelValues(fs.channel, rec.RepId).Inc()
+	}
+}
+
+// AddOutcome counts the final result of a segment request with retries
+func (fs *FetchStats) AddOutcome(repId, outcome string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	rs, ok := fs.reps[repId]
+	if !ok {
+		rs = &RepFetchStats{RepId: repId}
+		fs.reps[repId] = rs
+	}
+	switch outcome {
+	case OutcomeRetriedOk:
+		rs.Retried++
+	case OutcomeFailed:
+		rs.Failed++
+	}
+}
+
+// Snapshot returns a copy of the aggregated statistics, sorted by representation
+func (fs *FetchStats) Snapshot() []RepFetchStats {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	ret := make([]RepFetchStats, 0, len(fs.reps))
+	for _, rs := range fs.reps {
+		c := *rs
+		if ok := c.Count - c.Errors; ok > 0 {
+			c.TtfbAvg = Duration(c.ttfbSum / time.Duration(ok))
+		}
+		if c.TotalTime > 0 {
+			c.Throughput = float64(c.Bytes*8) / time.Duration(c.TotalTime).Seconds()
+		}
+		ret = append(ret, c)
+	}
+	slices.SortFunc(ret, func(a, b RepFetchStats) int { return strings.Compare(a.RepId, b.RepId) })
+	return ret
+}
@@ -0,0 +1,173 @@
+package lsdalm
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"slices"
+	"strings"
+
+	"github.com/jdeisenh/lsdalm/pkg/go-mpd"
+)
+
+// Values for TrackFilter.Select
+const (
+	SelectAll     = ""        // Keep all matching representations
+	SelectHighest = "highest" // Keep the matching representation with the highest bandwidth per AdaptationSet
+	SelectLowest  = "lowest"  // Keep the matching representation with the lowest bandwidth per AdaptationSet
+)
+
+// TrackFilter selects the AdaptationSets and Representations to record
+// Empty lists match everything
+type TrackFilter struct {
+	MimeTypes    []string `json:",omitempty"` // mimeType or its type part, e.g. "video/mp4" or "audio"
+	Langs        []string `json:",omitempty"` // Language, "de" matches "de-DE"
+	Roles        []string `json:",omitempty"` // Value of a Role descriptor
+	Codecs       []string `json:",omitempty"` // Codec prefix, e.g. "avc1" or "mp4a.40"
+	RepIds       []string `json:",omitempty"` // Representation ids
+	MinBandwidth uint64   `json:",omitempty"`
+	MaxBandwidth uint64   `json:",omitempty"` // 0: unlimited
+	Select       string   `json:",omitempty"` // One of the Select constants
+}
+
+// RegisterFlags adds command line flags for all settings to fs
+func (tf *TrackFilter) RegisterFlags(fs *flag.FlagSet) {
+	list := func(target *[]string) func(string) error {
+		return func(v string) error {
+			for _, e := range strings.Split(v, ",") {
+				if e = strings.TrimSpace(e); e != "" {
+					*target = append(*target, e)
+				}
+			}
+			return nil
+		}
+	}
+	fs.Func("mime", "Record only these mimeTypes, comma separated (e.g. video/mp4,audio)", list(&tf.MimeTypes))
+	fs.Func("lang", "Record only these languages, comma separated", list(&tf.Langs))
+	fs.Func("role", "Record only these roles, comma separated (e.g. main)", list(&tf.Roles))
+	fs.Func("codec", "Record only these codecs, comma separated prefixes (e.g. avc1,mp4a)", list(&tf.Codecs))
+	fs.Func("rep", "Record only these representation ids, comma separated", list(&tf.RepIds))
+	fs.Uint64Var(&tf.MinBandwidth, "minbw", 0, "Record only representations with at least this bandwidth")
+	fs.Uint64Var(&tf.MaxBandwidth, "maxbw", 0, "Record only representations with at most this bandwidth (0 = unlimited)")
+	fs.StringVar(&tf.Select, "select", SelectAll, "Record only the highest or lowest matching representation per track")
+}
+
+// Validate checks the settings
+func (tf *TrackFilter) Validate() error {
+	switch tf.Select {
+	case SelectAll, SelectHighest, SelectLowest:
+	default:
+		return errors.New("select must be highest or lowest")
+	}
+	if tf.MaxBandwidth > 0 && tf.MaxBandwidth < tf.MinBandwidth {
+		return errors.New("maxbw below minbw")
+	}
+	return nil
+}
+
+// IsEmpty returns true if the filter matches everything
+func (tf *TrackFilter) IsEmpty() bool {
+	return tf == nil || (len(tf.MimeTypes) == 0 && len(tf.Langs) == 0 && len(tf.Roles) == 0 &&
+		len(tf.Codecs) == 0 && len(tf.RepIds) == 0 && tf.MinBandwidth == 0 && tf.MaxBandwidth == 0 &&
+		tf.Select == SelectAll)
+}
+
+// Apply returns a copy of mpde with only the matching AdaptationSets and Representations
+// AdaptationSets without matching Representations are dropped. The input is not modified
+func (tf *TrackFilter) Apply(mpde *mpd.MPD) *mpd.MPD {
+	if tf.IsEmpty() || mpde == nil {
+		return mpde
+	}
+	out := Copy(mpde)
+	out.Period = make([]*mpd.Period, 0, len(mpde.Period))
+	for _, period := range mpde.Period {
+		np := Copy(period)
+		np.AdaptationSets = make([]*mpd.AdaptationSet, 0, len(period.AdaptationSets))
+		for _, as := range period.AdaptationSets {
+			if !tf.matchAdaptationSet(as) {
+				continue
+			}
+			reps := make([]mpd.Representation, 0, len(as.Representations))
+			for _, rep := range as.Representations {
+				if tf.matchRepresentation(as, &rep) {
+					reps = append(reps, rep)
+				}
+			}
+			if len(reps) == 0 {
+				continue
+			}
+			if tf.Select != SelectAll {
+				best := slices.MaxFunc(reps, func(a, b mpd.Representation) int {
+					if tf.Select == SelectLowest {
+						a, b = b, a
+					}
+					return cmp.Compare(ZeroIfNil(a.Bandwidth), ZeroIfNil(b.Bandwidth))
+				})
+				reps = []mpd.Representation{best}
+			}
+			nas := Copy(as)
+			nas.Representations = reps
+			np.AdaptationSets = append(np.AdaptationSets, nas)
+		}
+		out.Period = append(out.Period, np)
+	}
+	return out
+}
+
+// matchAdaptationSet checks the AdaptationSet level attributes
+func (tf *TrackFilter) matchAdaptationSet(as *mpd.AdaptationSet) bool {
+	if len(tf.Langs) > 0 {
+		if as.Lang == nil || !slices.ContainsFunc(tf.Langs, func(l string) bool {
+			return strings.EqualFold(l, *as.Lang) || strings.HasPrefix(strings.ToLower(*as.Lang), strings.ToLower(l)+"-")
+		}) {
+			return false
+		}
+	}
+	if len(tf.Roles) > 0 {
+		if !slices.ContainsFunc(as.Role, func(d *mpd.Descriptor) bool {
+			return d != nil && d.Value != nil && slices.Contains(tf.Roles, *d.Value)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchRepresentation checks the Representation level attributes
+func (tf *TrackFilter) matchRepresentation(as *mpd.AdaptationSet, rep *mpd.Representation) bool {
+	if len(tf.RepIds) > 0 && (rep.ID == nil || !slices.Contains(tf.RepIds, *rep.ID)) {
+		return false
+	}
+	if len(tf.MimeTypes) > 0 {
+		// The mimeType may be set on the Representations only
+		mimeType := as.MimeType
+		if rep.MimeType != nil {
+			mimeType = *rep.MimeType
+		}
+		contentType := ""
+		if as.ContentType != nil {
+			contentType = *as.ContentType
+		}
+		if !slices.ContainsFunc(tf.MimeTypes, func(m string) bool {
+			return m == mimeType || m == contentType || strings.HasPrefix(mimeType, m+"/")
+		}) {
+			return false
+		}
+	}
+	if len(tf.Codecs) > 0 {
+		codecs := ""
+		if rep.Codecs != nil {
+			codecs = *rep.Codecs
+		} else if as.Codecs != nil {
+			codecs = *as.Codecs
+		}
+		if !slices.ContainsFunc(tf.Codecs, func(c string) bool { return strings.HasPrefix(codecs, c) }) {
+			return false
+		}
+	}
+	bw := ZeroIfNil(rep.Bandwidth)
+	if bw < tf.MinBandwidth || (tf.MaxBandwidth > 0 && bw > tf.MaxBandwidth) {
+		return false
+	}
+	return true
+}
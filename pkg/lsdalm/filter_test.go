@@ -0,0 +1,58 @@
+package lsdalm
+
+import (
+	"testing"
+
+	"github.com/jdeisenh/lsdalm/pkg/go-mpd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackFilter(t *testing.T) {
+	mpde := new(mpd.MPD)
+	assert.NoError(t, mpde.Decode([]byte(`<?xml version="1.0"?><MPD xmlns="urn:mpeg:dash:schema:mpd:2011"><Period id="p0">`+
+		`<AdaptationSet mimeType="video/mp4" contentType="video"><Role schemeIdUri="urn:mpeg:dash:role:2011" value="main"/>`+
+		`<Representation id="v1" bandwidth="1000000" codecs="avc1.64001f"/>`+
+		`<Representation id="v2" bandwidth="3000000" codecs="hvc1.1.6.L93"/></AdaptationSet>`+
+		`<AdaptationSet mimeType="audio/mp4" lang="de-DE" codecs="mp4a.40.2"><Role schemeIdUri="urn:mpeg:dash:role:2011" value="main"/>`+
+		`<Representation id="a-de" bandwidth="128000"/></AdaptationSet>`+
+		`<AdaptationSet mimeType="audio/mp4" lang="en"><Role schemeIdUri="urn:mpeg:dash:role:2011" value="commentary"/>`+
+		`<Representation id="a-en" bandwidth="64000" codecs="ec-3"/></AdaptationSet>`+
+		`<AdaptationSet lang="en"><Representation id="t-en" mimeType="application/mp4" bandwidth="1000" codecs="stpp"/></AdaptationSet>`+
+		`</Period></MPD>`)))
+
+	var testdata = []struct {
+		name   string
+		filter TrackFilter
+		expect []string
+	}{
+		{"all", TrackFilter{}, []string{"v1", "v2", "a-de", "a-en", "t-en"}},
+		{"mime type", TrackFilter{MimeTypes: []string{"audio/mp4"}}, []string{"a-de", "a-en"}},
+		{"mime type part", TrackFilter{MimeTypes: []string{"video"}}, []string{"v1", "v2"}},
+		{"mime type of representation", TrackFilter{MimeTypes: []string{"application"}}, []string{"t-en"}},
+		{"language", TrackFilter{Langs: []string{"de"}}, []string{"a-de"}},
+		{"language exact", TrackFilter{Langs: []string{"EN"}}, []string{"a-en", "t-en"}},
+		{"role", TrackFilter{Roles: []string{"main"}}, []string{"v1", "v2", "a-de"}},
+		{"representation id", TrackFilter{RepIds: []string{"v2", "a-en"}}, []string{"v2", "a-en"}},
+		{"codecs", TrackFilter{Codecs: []string{"avc1", "mp4a.40"}}, []string{"v1", "a-de"}},
+		{"bandwidth", TrackFilter{MinBandwidth: 100000, MaxBandwidth: 2000000}, []string{"v1", "a-de"}},
+		{"highest", TrackFilter{MimeTypes: []string{"video"}, Select: SelectHighest}, []string{"v2"}},
+		{"lowest", TrackFilter{Select: SelectLowest}, []string{"v1", "a-de", "a-en", "t-en"}},
+		{"none", TrackFilter{Langs: []string{"fr"}}, nil},
+	}
+	for _, elem := range testdata {
+		out := elem.filter.Apply(mpde)
+		var ids []string
+		for _, as := range out.Period[0].AdaptationSets {
+			for _, rep := range as.Representations {
+				ids = append(ids, *rep.ID)
+			}
+		}
+		assert.Equal(t, elem.expect, ids, elem.name)
+	}
+	// The input is not modified
+	assert.Len(t, mpde.Period[0].AdaptationSets, 4)
+	assert.Len(t, mpde.Period[0].AdaptationSets[0].Representations, 2)
+
+	assert.Error(t, (&TrackFilter{Select: "best"}).Validate())
+	assert.Error(t, (&TrackFilter{MinBandwidth: 2, MaxBandwidth: 1}).Validate())
+}
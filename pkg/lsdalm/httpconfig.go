@@ -0,0 +1,242 @@
+package lsdalm
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values for HttpConfig.HTTP2
+const (
+	HTTP2Auto  = "auto"  // Use HTTP/2 if the server offers it
+	HTTP2Force = "force" // Fail requests not done with HTTP/2
+	HTTP2Off   = "off"   // Always use HTTP/1.1
+)
+
+const DefaultTokenRefresh = 5 * time.Minute // Token refresh interval if not configured
+
+// HttpConfig holds the settings for all outgoing requests of a channel:
+// manifests, sessions and segments
+type HttpConfig struct {
+	UserAgent    string        `json:"userAgent,omitempty"`
+	Headers      http.Header   `json:"headers,omitempty"`      // Added to every request, e.g. Authorization or Cookie
+	CertFile     string        `json:"certFile,omitempty"`     // Client certificate (PEM)
+	KeyFile      string        `json:"keyFile,omitempty"`      // Key for the client certificate (PEM)
+	CAFile       string        `json:"caFile,omitempty"`       // CA bundle added to the system CAs (PEM)
+	Proxy        string        `json:"proxy,omitempty"`        // Proxy URL, "env" for the environment settings
+	HTTP2        string        `json:"http2,omitempty"`        // One of the HTTP2 constants
+	TokenCommand string        `json:"tokenCommand,omitempty"` // Shell command printing a token
+	TokenUrl     string        `json:"tokenUrl,omitempty"`     // Endpoint returning a token
+	TokenParam   string        `json:"tokenParam,omitempty"`   // Query parameter the token is added as
+	TokenRefresh time.Duration `json:"tokenRefresh,omitempty"` // Fetch a new token after this time
+
+	tokenMutex   sync.Mutex
+	token        string
+	tokenFetched time.Time
+}
+
+func NewHttpConfig() *HttpConfig {
+	return &HttpConfig{
+		UserAgent:    DefaultUserAgent,
+		Headers:      make(http.Header),
+		HTTP2:        HTTP2Auto,
+		TokenParam:   "token",
+		TokenRefresh: DefaultTokenRefresh,
+	}
+}
+
+// RegisterFlags adds command line flags for all settings to fs
+func (hc *HttpConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&hc.UserAgent, "useragent", hc.UserAgent, "User-Agent for all requests")
+	fs.Func("header", "Extra request header 'Name: value', repeatable", func(v string) error {
+		name, value, ok := strings.Cut(v, ":")
+		if !ok {
+			return errors.New("header must be 'Name: value'")
+		}
+		hc.Headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		return nil
+	})
+	fs.Func("cookie", "Cookie 'name=value' sent with all requests, repeatable", func(v string) error {
+		// All cookies go into one header
+		if c := hc.Headers.Get("Cookie"); c != "" {
+			v = c + "; " + v
+		}
+		hc.Headers.Set("Cookie", v)
+		return nil
+	})
+	fs.StringVar(&hc.CertFile, "cert", hc.CertFile, "Client TLS certificate file (PEM)")
+	fs.StringVar(&hc.KeyFile, "key", hc.KeyFile, "Client TLS key file (PEM)")
+	fs.StringVar(&hc.CAFile, "cacert", hc.CAFile, "Additional CA bundle (PEM)")
+	fs.StringVar(&hc.Proxy, "proxy", hc.Proxy, "Proxy URL, 'env' to use HTTP_PROXY/HTTPS_PROXY")
+	fs.StringVar(&hc.HTTP2, "http2", hc.HTTP2, "HTTP/2 usage: auto, force or off")
+	fs.StringVar(&hc.TokenCommand, "tokencmd", hc.TokenCommand, "Shell command printing a URL token")
+	fs.StringVar(&hc.TokenUrl, "tokenurl", hc.TokenUrl, "Endpoint returning a URL token")
+	fs.StringVar(&hc.TokenParam, "tokenparam", hc.TokenParam, "Query parameter for the URL token")
+	fs.DurationVar(&hc.TokenRefresh, "tokenrefresh", hc.TokenRefresh, "Refresh interval of the URL token")
+}
+
+// NewTransport creates a transport with the TLS, proxy and HTTP/2 settings applied
+func (hc *HttpConfig) NewTransport() (*http.Transport, error) {
+	tr := &http.Transport{}
+
+	switch hc.Proxy {
+	case "":
+	case "env":
+		tr.Proxy = http.ProxyFromEnvironment
+	default:
+		proxyUrl, err := url.Parse(hc.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Proxy URL: %w", err)
+		}
+		tr.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	if hc.CertFile != "" || hc.CAFile != "" {
+		tlsConfig := &tls.Config{}
+		if hc.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(hc.CertFile, hc.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("Client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		if hc.CAFile != "" {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			pem, err := os.ReadFile(hc.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("No certificates in %s", hc.CAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		tr.TLSClientConfig = tlsConfig
+	}
+
+	switch hc.HTTP2 {
+	case HTTP2Auto, HTTP2Force, "":
+		// Needed as soon as TLSClientConfig or dialers are customized
+		tr.ForceAttemptHTTP2 = true
+	case HTTP2Off:
+		// A non-nil empty map disables HTTP/2
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	default:
+		return nil, fmt.Errorf("Unknown http2 setting %s", hc.HTTP2)
+	}
+	return tr, nil
+}
+
+// Wrap returns a RoundTripper applying headers, token and HTTP/2 enforcement to every request
+func (hc *HttpConfig) Wrap(rt http.RoundTripper) http.RoundTripper {
+	return &configTransport{base: rt, config: hc}
+}
+
+// NewClient creates a client with all settings applied
+func (hc *HttpConfig) NewClient(timeout time.Duration) (*http.Client, error) {
+	tr, err := hc.NewTransport()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Timeout: timeout, Transport: hc.Wrap(tr)}, nil
+}
+
+// Token returns the current URL token, refreshing it if expired
+func (hc *HttpConfig) Token(ctx context.Context) (string, error) {
+	if hc.TokenCommand == "" && hc.TokenUrl == "" {
+		return "", nil
+	}
+	hc.tokenMutex.Lock()
+	defer hc.tokenMutex.Unlock()
+	refresh := hc.TokenRefresh
+	if refresh <= 0 {
+		refresh = DefaultTokenRefresh
+	}
+	if hc.token != "" && time.Since(hc.tokenFetched) < refresh {
+		return hc.token, nil
+	}
+	var out []byte
+	var err error
+	if hc.TokenCommand != "" {
+		out, err = exec.CommandContext(ctx, "sh", "-c", hc.TokenCommand).Output()
+	} else {
+		out, err = getToken(ctx, hc.TokenUrl)
+	}
+	if err != nil {
+		// Keep using the old token, it might still be valid
+		if hc.token != "" {
+			return hc.token, nil
+		}
+		return "", fmt.Errorf("Token refresh: %w", err)
+	}
+	hc.token = strings.TrimSpace(string(out))
+	hc.tokenFetched = time.Now()
+	return hc.token, nil
+}
+
+// getToken fetches a token from a (local) endpoint
+func getToken(ctx context.Context, tokenUrl string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", tokenUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Token endpoint status %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// configTransport applies a HttpConfig to every request
+type configTransport struct {
+	base   http.RoundTripper
+	config *HttpConfig
+}
+
+func (ct *configTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	hc := ct.config
+	// RoundTrippers must not modify the request
+	req = req.Clone(req.Context())
+	if hc.UserAgent != "" {
+		req.Header.Set("User-Agent", hc.UserAgent)
+	}
+	for name, values := range hc.Headers {
+		req.Header.Del(name)
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+	token, err := hc.Token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		q := req.URL.Query()
+		q.Set(hc.TokenParam, token)
+		req.URL.RawQuery = q.Encode()
+	}
+	resp, err := ct.base.RoundTrip(req)
+	if err == nil && hc.HTTP2 == HTTP2Force && resp.ProtoMajor != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: HTTP/2 required, got %s", req.URL.Host, resp.Proto)
+	}
+	return resp, err
+}
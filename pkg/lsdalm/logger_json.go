@@ -49,3 +49,35 @@ func (o *jsonCheckerLogger) LogManifest(m *ManifestLog) {
 func (o *jsonCheckerLogger) LogPollFailure(err error, consecutive int) {
 	o.logger.Error().Err(err).Int("consecutive", consecutive).Msg("poll failure")
 }
+
+func (o *jsonCheckerLogger) LogSegmentFetch(rec *SegmentFetchRecord) {
+	lvl := o.logger.Debug()
+	if rec.Early {
+		lvl = o.logger.Warn()
+	}
+	lvl.Interface("fetch", rec).Msg("segment fetch")
+}
+
+func (o *jsonCheckerLogger) LogFetchStats(stats []RepFetchStats) {
+	o.logger.Info().Interface("representations", stats).Msg("fetch stats")
+}
+
+func (o *jsonCheckerLogger) LogFetchOutcome(kind, url, outcome string, attempts int) {
+	lvl := o.logger.Info()
+	if outcome == OutcomeFailed {
+		lvl = o.logger.Warn()
+	}
+	lvl.Str("kind", kind).Str("url", url).Str("outcome", outcome).Int("attempts", attempts).Msg("fetch outcome")
+}
+
+func (o *jsonCheckerLogger) LogAvailability(track, url, result string, delay time.Duration) {
+	lvl := o.logger.Info()
+	if result == AvailabilityMissing || result == AvailabilityLate {
+		lvl = o.logger.Warn()
+	}
+	lvl.Str("track", track).Str("url", url).Str("result", result).Dur("delay", delay).Msg("segment availability")
+}
+
+func (o *jsonCheckerLogger) LogAvailabilityStats(stats []TrackAvailability) {
+	o.logger.Info().Interface("tracks", stats).Msg("availability stats")
+}
@@ -83,3 +83,51 @@ func (o *textCheckerLogger) LogManifest(m *ManifestLog) {
 		o.logger.Info().Msg(msg)
 	}
 }
+
+func (o *textCheckerLogger) LogSegmentFetch(rec *SegmentFetchRecord) {
+	msg := fmt.Sprintf("%s %d TTFB %s Total %s %d bytes %.0f kbit/s Cache %s Age %s",
+		rec.Url, rec.Status, rec.Ttfb, rec.Total, rec.Bytes, rec.Throughput/1000, rec.Cache, rec.Age)
+	if rec.Early {
+		o.logger.Warn().Msgf("Served before complete: %s", msg)
+	} else {
+		o.logger.Debug().Msg(msg)
+	}
+}
+
+// LogFetchStats renders one line per representation
+func (o *textCheckerLogger) LogFetchStats(stats []RepFetchStats) {
+	for _, s := range stats {
+		o.logger.Info().Msgf("%20s: %5d req %3d err TTFB avg %8s max %8s %8.0f kbit/s hit/miss %d/%d early %d retried %d failed %d",
+			s.RepId, s.Count, s.Errors, Round(time.Duration(s.TtfbAvg)), Round(time.Duration(s.TtfbMax)),
+			s.Throughput/1000, s.Hits, s.Misses, s.Early, s.Retried, s.Failed)
+	}
+}
+
+func (o *textCheckerLogger) LogFetchOutcome(kind, url, outcome string, attempts int) {
+	if outcome == OutcomeFailed {
+		o.logger.Warn().Msgf("Failed %s %s after %d attempts", kind, url, attempts)
+	} else {
+		o.logger.Info().Msgf("Got %s %s after %d attempts", kind, url, attempts)
+	}
+}
+
+func (o *textCheckerLogger) LogAvailability(track, url, result string, delay time.Duration) {
+	switch result {
+	case AvailabilityMissing:
+		o.logger.Warn().Msgf("%s: Announced but not available after %s: %s", track, Round(delay), url)
+	case AvailabilityLate:
+		o.logger.Warn().Msgf("%s: Available %s too late: %s", track, Round(delay), url)
+	case AvailabilityEarly:
+		o.logger.Info().Msgf("%s: Available %s before announced: %s", track, Round(-delay), url)
+	}
+}
+
+// LogAvailabilityStats renders one line per track
+func (o *textCheckerLogger) LogAvailabilityStats(stats []TrackAvailability) {
+	for _, s := range stats {
+		o.logger.Info().Msgf("%20s: %5d probed %d ontime %d late %d early %d missing delay min %s median %s p95 %s max %s",
+			s.Track, s.Probed, s.OnTime, s.Late, s.Early, s.Missing,
+			Round(time.Duration(s.DelayMin)), Round(time.Duration(s.DelayMedian)),
+			Round(time.Duration(s.DelayP95)), Round(time.Duration(s.DelayMax)))
+	}
+}
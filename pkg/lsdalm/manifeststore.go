@@ -0,0 +1,477 @@
+package lsdalm
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Storage formats for manifests
+const (
+	ManifestPlain = "plain" // MPD as fetched
+	ManifestGzip  = "gzip"  // gzip compressed
+	ManifestZstd  = "zstd"  // zstd compressed
+	ManifestDelta = "delta" // Differences to the previous manifest, with periodic full copies
+)
+
+// Polls of manifests identical to the previous one, in the manifest directory
+// Lines are "<RFC3339 poll time> <stored file name>". There is one index per hour,
+// named ManifestIndexPrefix+<UTC hour>+".txt", so appending does not rewrite the
+// whole index on object storage. Older recordings have a single ManifestIndexName
+const (
+	ManifestIndexName   = "index.txt"
+	ManifestIndexPrefix = "index-"
+	manifestIndexHour   = "2006010215"
+)
+
+const (
+	deltaKeyframeEvery = 120              // Store a full manifest every N manifests in delta format
+	deltaMaxChain      = 10000            // Max number of deltas followed to a full manifest
+	deltaMagic         = "lsdalm-delta 1" // First line of files in delta format
+)
+
+// File name extension by format, appended to ManifestFormat
+var manifestExt = map[string]string{
+	ManifestPlain: "",
+	ManifestGzip:  ".gz",
+	ManifestZstd:  ".zst",
+	ManifestDelta: ".delta",
+}
+
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		return dec
+	})
+)
+
+// ValidManifestFormat checks the name of a storage format
+func ValidManifestFormat(format string) error {
+	if _, ok := manifestExt[format]; !ok {
+		return errors.New("Manifest format must be plain, gzip, zstd or delta")
+	}
+	return nil
+}
+
+// ParseManifestName returns the fetch time of a stored manifest in any format
+func ParseManifestName(name string) (time.Time, error) {
+	for _, ext := range manifestExt {
+		if ext != "" && strings.HasSuffix(name, ext) {
+			name = strings.TrimSuffix(name, ext)
+			break
+		}
+	}
+	return time.Parse(ManifestFormat, name)
+}
+
+// manifestWriter stores manifests in one of the formats
+type manifestWriter struct {
+	format    string
+	prevDir   string   // Directory of the previous manifest
+	prevName  string   // File name of the previous manifest
+	prevToken [][]byte // Tokens of the previous manifest
+	sinceFull int      // Deltas written since the last full manifest
+	dedup     bool     // Do not store manifests identical to the previous one
+	lastHash  [sha256.Size]byte
+	lastPath  string // Path of the last stored manifest
+	indexPath string // Index of the last deduplicated poll
+	indexData []byte // Contents of indexPath
+}
+
+// newManifestWriter returns a writer for format, which must be valid
+func newManifestWriter(format string) *manifestWriter {
+	return &manifestWriter{format: format}
+}
+
+// Write stores contents fetched at 'at' in dir and returns the file path
+// Duplicates are added to the index, and the path of the stored copy is returned
+func (mw *manifestWriter) Write(store Storage, dir string, at time.Time, contents []byte) (string, error) {
+	if mw.dedup {
+		hash := sha256.Sum256(contents)
+		if hash == mw.lastHash && mw.lastPath != "" && path.Dir(mw.lastPath) == dir {
+			return mw.lastPath, mw.appendIndex(store, dir, at, path.Base(mw.lastPath))
+		}
+		mw.lastHash = hash
+		mw.lastPath = ""
+	}
+	name := at.UTC().Format(ManifestFormat) + manifestExt[mw.format]
+	filepath := path.Join(dir, name)
+	var data []byte
+	switch mw.format {
+	case ManifestGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(contents)
+		if err := zw.Close(); err != nil {
+			return filepath, err
+		}
+		data = buf.Bytes()
+	case ManifestZstd:
+		data = zstdEncoder().EncodeAll(contents, nil)
+	case ManifestDelta:
+		tokens := tokenizeManifest(contents)
+		if dir != mw.prevDir || mw.prevName == "" || mw.sinceFull >= deltaKeyframeEvery {
+			data = encodeFull(contents)
+			mw.sinceFull = 0
+		} else {
+			data = encodeDelta(mw.prevName, mw.prevToken, tokens)
+			mw.sinceFull++
+		}
+		mw.prevDir, mw.prevName, mw.prevToken = dir, name, tokens
+	default:
+		data = contents
+	}
+	err := store.WriteFile(filepath, data)
+	if err != nil {
+		// Next one must not depend on it
+		mw.prevName = ""
+		return filepath, err
+	}
+	mw.lastPath = filepath
+	return filepath, nil
+}
+
+// appendIndex records a poll returning the manifest stored in name, in the index of its hour
+// The index is kept in memory and written as a whole, it is only read when a new one starts
+func (mw *manifestWriter) appendIndex(store Storage, dir string, at time.Time, name string) error {
+	indexPath := path.Join(dir, ManifestIndexPrefix+at.UTC().Format(manifestIndexHour)+".txt")
+	if indexPath != mw.indexPath {
+		// Continue an index of a previous run
+		data, err := store.ReadFile(indexPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		mw.indexPath, mw.indexData = indexPath, data
+	}
+	mw.indexData = append(mw.indexData, at.UTC().Format(time.RFC3339Nano)+" "+name+"\n"...)
+	if err := store.WriteFile(indexPath, mw.indexData); err != nil {
+		// Read again on the next poll
+		mw.indexPath = ""
+		return err
+	}
+	return nil
+}
+
+// isManifestIndex returns true for the file names of manifest indexes
+func isManifestIndex(name string) bool {
+	return name == ManifestIndexName || (strings.HasPrefix(name, ManifestIndexPrefix) && strings.HasSuffix(name, ".txt"))
+}
+
+// readManifestIndex returns the polls of deduplicated manifests in the index file indexPath
+func readManifestIndex(store Storage, indexPath string) ([]HistoryElement, error) {
+	buf, err := store.ReadFile(indexPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var polls []HistoryElement
+	for _, line := range strings.Split(string(buf), "\n") {
+		ts, name, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil || strings.ContainsRune(name, '/') {
+			continue
+		}
+		polls = append(polls, HistoryElement{At: at, Filename: name})
+	}
+	return polls, nil
+}
+
+// ListManifests returns all polls of the manifests stored in dir, oldest first
+// Deduplicated polls refer to the file of the identical manifest stored before
+func ListManifests(store Storage, dir string) ([]HistoryElement, error) {
+	files, err := store.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]HistoryElement, 0, len(files))
+	stored := make(map[string]bool, len(files))
+	var polls []HistoryElement
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if isManifestIndex(f.Name()) {
+			indexed, err := readManifestIndex(store, path.Join(dir, f.Name()))
+			if err != nil {
+				return nil, err
+			}
+			polls = append(polls, indexed...)
+			continue
+		}
+		at, err := ParseManifestName(f.Name())
+		if err != nil {
+			continue
+		}
+		list = append(list, HistoryElement{At: at, Filename: f.Name()})
+		stored[f.Name()] = true
+	}
+	for _, p := range polls {
+		// The stored copy might have been deleted by retention
+		if stored[p.Filename] {
+			list = append(list, p)
+		}
+	}
+	slices.SortStableFunc(list, func(a, b HistoryElement) int { return a.At.Compare(b.At) })
+	return list, nil
+}
+
+// pruneManifestIndex removes polls before cutoff from the indexes in dir
+// Indexes with only older polls are deleted
+func pruneManifestIndex(store Storage, dir string, cutoff time.Time) error {
+	files, err := store.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || !isManifestIndex(f.Name()) {
+			continue
+		}
+		indexPath := path.Join(dir, f.Name())
+		polls, err := readManifestIndex(store, indexPath)
+		if err != nil {
+			return err
+		}
+		var buf strings.Builder
+		pruned := 0
+		for _, p := range polls {
+			if p.At.Before(cutoff) {
+				pruned++
+				continue
+			}
+			fmt.Fprintf(&buf, "%s %s\n", p.At.UTC().Format(time.RFC3339Nano), p.Filename)
+		}
+		switch {
+		case pruned == 0:
+		case buf.Len() == 0:
+			err = store.Remove(indexPath)
+		default:
+			err = store.WriteFile(indexPath, []byte(buf.String()))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ManifestReader reads stored manifests in all formats
+// It remembers the last manifest in delta format, so reading in time order is cheap
+type ManifestReader struct {
+	store      Storage
+	mutex      sync.Mutex
+	lastPath   string
+	lastTokens [][]byte
+}
+
+// NewManifestReader returns a reader for stored manifests
+func NewManifestReader(store Storage) *ManifestReader {
+	return &ManifestReader{store: store}
+}
+
+// Read returns the MPD stored in localpath
+func (mr *ManifestReader) Read(localpath string) ([]byte, error) {
+	switch {
+	case strings.HasSuffix(localpath, manifestExt[ManifestGzip]):
+		buf, err := mr.store.ReadFile(localpath)
+		if err != nil {
+			return nil, err
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(zr)
+	case strings.HasSuffix(localpath, manifestExt[ManifestZstd]):
+		buf, err := mr.store.ReadFile(localpath)
+		if err != nil {
+			return nil, err
+		}
+		return zstdDecoder().DecodeAll(buf, nil)
+	case strings.HasSuffix(localpath, manifestExt[ManifestDelta]):
+		mr.mutex.Lock()
+		defer mr.mutex.Unlock()
+		tokens, err := mr.readDelta(localpath, 0)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.Join(tokens, nil), nil
+	default:
+		return mr.store.ReadFile(localpath)
+	}
+}
+
+// readDelta reconstructs the tokens of a manifest in delta format
+func (mr *ManifestReader) readDelta(localpath string, depth int) ([][]byte, error) {
+	if localpath == mr.lastPath {
+		return mr.lastTokens, nil
+	}
+	if depth > deltaMaxChain {
+		return nil, errors.New("Delta chain too long")
+	}
+	buf, err := mr.store.ReadFile(localpath)
+	if err != nil {
+		return nil, err
+	}
+	header, body, ok := bytes.Cut(buf, []byte("\n"))
+	if !ok || !bytes.HasPrefix(header, []byte(deltaMagic)) {
+		return nil, fmt.Errorf("%s: not in delta format", localpath)
+	}
+	var tokens [][]byte
+	if base := strings.TrimSpace(strings.TrimPrefix(string(header), deltaMagic)); base == "" {
+		tokens = tokenizeManifest(body)
+	} else {
+		baseTokens, err := mr.readDelta(path.Join(path.Dir(localpath), base), depth+1)
+		if err != nil {
+			return nil, fmt.Errorf("Base of %s: %w", path.Base(localpath), err)
+		}
+		tokens, err = applyDelta(baseTokens, body)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path.Base(localpath), err)
+		}
+	}
+	mr.lastPath, mr.lastTokens = localpath, tokens
+	return tokens, nil
+}
+
+// RewriteFull stores a manifest in delta format as full copy, so it does not depend on older files
+func (mr *ManifestReader) RewriteFull(localpath string) error {
+	if !strings.HasSuffix(localpath, manifestExt[ManifestDelta]) {
+		return nil
+	}
+	buf, err := mr.store.ReadFile(localpath)
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(buf, []byte(deltaMagic+"\n")) {
+		// Already full
+		return nil
+	}
+	contents, err := mr.Read(localpath)
+	if err != nil {
+		return err
+	}
+	return mr.store.WriteFile(localpath, encodeFull(contents))
+}
+
+// tokenizeManifest splits a manifest after every '>', most manifests have few line breaks
+func tokenizeManifest(contents []byte) [][]byte {
+	var tokens [][]byte
+	for len(contents) > 0 {
+		i := bytes.IndexByte(contents, '>')
+		if i < 0 {
+			i = len(contents) - 1
+		}
+		tokens = append(tokens, contents[:i+1])
+		contents = contents[i+1:]
+	}
+	return tokens
+}
+
+// encodeFull returns a manifest in delta format without base
+func encodeFull(contents []byte) []byte {
+	return append([]byte(deltaMagic+"\n"), contents...)
+}
+
+// encodeDelta returns cur as copies of base tokens and added tokens
+// Ops are "c <start> <count>\n" to copy from base, "a <bytes>\n" followed by the data to add
+func encodeDelta(baseName string, base, cur [][]byte) []byte {
+	index := make(map[string][]int, len(base))
+	for i, t := range base {
+		index[string(t)] = append(index[string(t)], i)
+	}
+	var out bytes.Buffer
+	out.WriteString(deltaMagic + " " + baseName + "\n")
+	var added []byte
+	flush := func() {
+		if len(added) > 0 {
+			fmt.Fprintf(&out, "a %d\n", len(added))
+			out.Write(added)
+			added = added[:0]
+		}
+	}
+	expected := 0
+	for i := 0; i < len(cur); {
+		start := -1
+		if expected < len(base) && bytes.Equal(base[expected], cur[i]) {
+			start = expected
+		} else if pos := index[string(cur[i])]; len(pos) > 0 {
+			// Prefer the first match after the last copy
+			j, _ := slices.BinarySearch(pos, expected)
+			start = pos[j%len(pos)]
+		}
+		if start < 0 {
+			added = append(added, cur[i]...)
+			i++
+			continue
+		}
+		n := 0
+		for start+n < len(base) && i+n < len(cur) && bytes.Equal(base[start+n], cur[i+n]) {
+			n++
+		}
+		flush()
+		fmt.Fprintf(&out, "c %d %d\n", start, n)
+		i += n
+		expected = start + n
+	}
+	flush()
+	return out.Bytes()
+}
+
+// applyDelta reconstructs the tokens of a manifest from base and the ops of encodeDelta
+func applyDelta(base [][]byte, ops []byte) ([][]byte, error) {
+	var tokens [][]byte
+	r := bufio.NewReader(bytes.NewReader(ops))
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return tokens, nil
+		}
+		if err != nil {
+			return nil, errors.New("Truncated delta")
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 3 && fields[0] == "c":
+			start, err1 := strconv.Atoi(fields[1])
+			count, err2 := strconv.Atoi(fields[2])
+			if err1 != nil || err2 != nil || start < 0 || count < 0 || start+count > len(base) {
+				return nil, fmt.Errorf("Bad copy %q", strings.TrimSpace(line))
+			}
+			tokens = append(tokens, base[start:start+count]...)
+		case len(fields) == 2 && fields[0] == "a":
+			size, err := strconv.Atoi(fields[1])
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("Bad add %q", strings.TrimSpace(line))
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, errors.New("Truncated delta")
+			}
+			tokens = append(tokens, tokenizeManifest(data)...)
+		default:
+			return nil, fmt.Errorf("Bad delta op %q", strings.TrimSpace(line))
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package lsdalm
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifestStore(t *testing.T) {
+	manifest := func(n int) []byte {
+		reps := ""
+		for r := range 10 {
+			reps += fmt.Sprintf(`<Representation id="v%d" bandwidth="%d" width="1280" height="720" codecs="avc1.64001f"/>`, r, r*100000)
+		}
+		return []byte(fmt.Sprintf(`<?xml version="1.0"?><MPD publishTime="%d"><Period><AdaptationSet><SegmentTimeline>`+
+			`<S t="%d" d="2000" r="%d"/></SegmentTimeline>%s</AdaptationSet><AdaptationSet><SegmentTimeline>`+
+			`<S t="%d" d="2000" r="%d"/></SegmentTimeline></AdaptationSet></Period></MPD>`, n, 1000+n, n, reps, 1000+n, n))
+	}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, format := range []string{ManifestPlain, ManifestGzip, ManifestZstd, ManifestDelta} {
+		dir := t.TempDir()
+		mw := newManifestWriter(format)
+		var files []string
+		for n := 0; n < deltaKeyframeEvery+5; n++ {
+			at := start.Add(time.Duration(n) * time.Second)
+			filepath, err := mw.Write(LocalStorage{}, dir, at, manifest(n))
+			assert.NoError(t, err)
+			parsed, err := ParseManifestName(path.Base(filepath))
+			assert.NoError(t, err)
+			assert.Equal(t, at, parsed)
+			files = append(files, filepath)
+		}
+		if format == ManifestDelta {
+			info, err := os.Stat(files[5])
+			assert.NoError(t, err)
+			assert.Less(t, info.Size(), int64(len(manifest(5))/2))
+		}
+		// In order, and random access
+		mr := NewManifestReader(LocalStorage{})
+		for n, filepath := range files {
+			got, err := mr.Read(filepath)
+			assert.NoError(t, err, format)
+			assert.Equal(t, string(manifest(n)), string(got), format)
+		}
+		got, err := NewManifestReader(LocalStorage{}).Read(files[50])
+		assert.NoError(t, err)
+		assert.Equal(t, string(manifest(50)), string(got))
+
+		// Older files can be deleted after rewriting
+		assert.NoError(t, NewManifestReader(LocalStorage{}).RewriteFull(files[10]))
+		for _, filepath := range files[:10] {
+			os.Remove(filepath)
+		}
+		got, err = NewManifestReader(LocalStorage{}).Read(files[20])
+		assert.NoError(t, err, format)
+		assert.Equal(t, string(manifest(20)), string(got), format)
+	}
+}
+
+func TestManifestDedup(t *testing.T) {
+	dir := t.TempDir()
+	mw := newManifestWriter(ManifestDelta)
+	mw.dedup = true
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	contents := [][]byte{[]byte("<MPD>a</MPD>"), []byte("<MPD>a</MPD>"), []byte("<MPD>a</MPD>"), []byte("<MPD>b</MPD>"), []byte("<MPD>b</MPD>")}
+	var paths []string
+	for n, c := range contents {
+		p, err := mw.Write(LocalStorage{}, dir, start.Add(time.Duration(n)*time.Second), c)
+		assert.NoError(t, err)
+		paths = append(paths, p)
+	}
+	assert.Equal(t, paths[0], paths[2])
+	assert.Equal(t, paths[3], paths[4])
+	assert.NotEqual(t, paths[0], paths[3])
+
+	list, err := ListManifests(LocalStorage{}, dir)
+	assert.NoError(t, err)
+	assert.Len(t, list, len(contents))
+	mr := NewManifestReader(LocalStorage{})
+	for n, he := range list {
+		assert.Equal(t, start.Add(time.Duration(n)*time.Second), he.At)
+		got, err := mr.Read(path.Join(dir, he.Filename))
+		assert.NoError(t, err)
+		assert.Equal(t, string(contents[n]), string(got))
+	}
+
+	assert.NoError(t, pruneManifestIndex(LocalStorage{}, dir, start.Add(2*time.Second)))
+	list, err = ListManifests(LocalStorage{}, dir)
+	assert.NoError(t, err)
+	assert.Len(t, list, 4)
+
+	// A new index every hour, merged when listing, and continued by a new writer
+	mw2 := newManifestWriter(ManifestDelta)
+	mw2.dedup = true
+	for n, at := range []time.Duration{time.Hour, time.Hour + time.Second, time.Hour + 2*time.Second} {
+		_, err := mw2.Write(LocalStorage{}, dir, start.Add(at), contents[3])
+		assert.NoError(t, err, n)
+	}
+	_, err = mw.Write(LocalStorage{}, dir, start.Add(time.Hour+3*time.Second), contents[3])
+	assert.NoError(t, err)
+	_, err = os.Stat(path.Join(dir, ManifestIndexPrefix+"2025010101.txt"))
+	assert.NoError(t, err)
+	list, err = ListManifests(LocalStorage{}, dir)
+	assert.NoError(t, err)
+	assert.Len(t, list, 8)
+	assert.NoError(t, pruneManifestIndex(LocalStorage{}, dir, start.Add(time.Hour)))
+	_, err = os.Stat(path.Join(dir, ManifestIndexPrefix+"2025010100.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,247 @@
+package lsdalm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jdeisenh/lsdalm/pkg/go-mpd"
+	"github.com/rs/zerolog"
+)
+
+// proxyTimeout limits a single origin request
+const proxyTimeout = 30 * time.Second
+
+// ProxyCachePath is the subdirectory of a recording for proxied files, below <scheme>/<host>/<path>
+const ProxyCachePath = "proxied"
+
+// errOriginNotFound is returned if the origin does not have a segment
+var errOriginNotFound = errors.New("Not found at origin")
+
+// errHostNotAllowed is returned for proxy paths to hosts the recording does not use
+var errHostNotAllowed = errors.New("Host not allowed")
+
+// MediaProxy serves files of a recording, fetching and storing missing ones from the origin
+// Paths below DefaultProxyPrefix carry the origin as written by ProxyPath, other paths use the
+// scheme and host of the original manifest. Only the origin, hosts of the manifests BaseURLs and
+// hosts of proxy rules are fetched from. Recorded files are served from their URL path, like the
+// recorder stores them, fetched ones are stored below ProxyCachePath and never replace recorded files
+type MediaProxy struct {
+	store   Storage
+	dumpdir string
+	origin  *url.URL // Scheme and host for paths without proxy prefix
+	client  *http.Client
+	logger  zerolog.Logger
+
+	mutex    sync.Mutex
+	hosts    map[string]bool       // Allowed <scheme>://<host>
+	inflight map[string]*proxyCall // Running fetches by local path
+}
+
+// proxyCall is a fetch shared by all concurrent requests for the same file
+type proxyCall struct {
+	done chan struct{}
+	err  error
+}
+
+// NewMediaProxy creates a proxy storing to dumpdir of store
+// origin is the original manifest URL or nil
+func NewMediaProxy(store Storage, dumpdir string, origin *url.URL, hc *HttpConfig, logger zerolog.Logger) (*MediaProxy, error) {
+	client, err := hc.NewClient(proxyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	mp := &MediaProxy{
+		store:    store,
+		dumpdir:  dumpdir,
+		origin:   origin,
+		client:   client,
+		logger:   logger,
+		hosts:    make(map[string]bool),
+		inflight: make(map[string]*proxyCall),
+	}
+	if origin != nil {
+		mp.allow(origin)
+	}
+	return mp, nil
+}
+
+// AllowManifest allows fetching from the hosts of all BaseURLs of mpde, resolved against base
+func (mp *MediaProxy) AllowManifest(mpde *mpd.MPD, base *url.URL) {
+	if mpde == nil || base == nil {
+		return
+	}
+	bases := []*url.URL{base}
+	bases = mp.allowBaseUrls(bases, mpde.BaseURL)
+	for _, period := range mpde.Period {
+		periodBases := mp.allowBaseUrls(bases, period.BaseURL)
+		for _, as := range period.AdaptationSets {
+			asBases := mp.allowBaseUrls(periodBases, as.BaseURL)
+			for _, rep := range as.Representations {
+				mp.allowBaseUrls(asBases, rep.BaseURL)
+			}
+		}
+	}
+}
+
+// allowBaseUrls allows the hosts of baseUrls resolved against each of parents, and returns the resolved URLs
+// Without BaseURLs, the parents apply
+func (mp *MediaProxy) allowBaseUrls(parents []*url.URL, baseUrls []*mpd.BaseURL) []*url.URL {
+	if len(baseUrls) == 0 {
+		return parents
+	}
+	var ret []*url.URL
+	for _, parent := range parents {
+		for _, bu := range baseUrls {
+			if u := ConcatURL(parent, bu.Value); u != nil {
+				mp.allow(u)
+				ret = append(ret, u)
+			}
+		}
+	}
+	return ret
+}
+
+// AllowRules allows fetching from the hosts of the proxy rules of ur
+func (mp *MediaProxy) AllowRules(ur *UrlRewriter) {
+	if ur == nil {
+		return
+	}
+	for _, rule := range ur.Rules {
+		if rule.Action != RewriteProxy || rule.Prefix == "" {
+			continue
+		}
+		if u, err := url.Parse(rule.Prefix); err == nil {
+			mp.allow(u)
+		}
+	}
+}
+
+// allow adds the scheme and host of u to the allowed hosts
+func (mp *MediaProxy) allow(u *url.URL) {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return
+	}
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.hosts[u.Scheme+"://"+u.Host] = true
+}
+
+// allowed returns true if files may be fetched from the host of u
+func (mp *MediaProxy) allowed(u *url.URL) bool {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	return mp.hosts[u.Scheme+"://"+u.Host]
+}
+
+// ServeHTTP serves the request path from the recording or the origin
+func (mp *MediaProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var source *url.URL
+	var err error
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/"+DefaultProxyPrefix); ok {
+		source, err = ProxyUrl(rest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if mp.origin != nil {
+		source = &url.URL{Scheme: mp.origin.Scheme, Host: mp.origin.Host, Path: r.URL.Path}
+	}
+	localpath := path.Join(mp.dumpdir, r.URL.Path)
+	if source == nil {
+		mp.store.ServeFile(w, r, localpath)
+		return
+	}
+	if !mp.allowed(source) {
+		mp.logger.Warn().Str("url", source.String()).Msg("Proxy host not allowed")
+		http.Error(w, errHostNotAllowed.Error(), http.StatusForbidden)
+		return
+	}
+	// Recorded
+	localpath = path.Join(mp.dumpdir, source.Path)
+	if _, err := mp.store.Stat(localpath); err == nil {
+		mp.store.ServeFile(w, r, localpath)
+		return
+	}
+	localpath = mp.cachePath(source)
+	if _, err := mp.store.Stat(localpath); err != nil {
+		if err := mp.fetch(localpath, source); err != nil {
+			mp.logger.Warn().Err(err).Str("url", source.String()).Msg("Proxy")
+			if errors.Is(err, errOriginNotFound) {
+				http.NotFound(w, r)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+			}
+			return
+		}
+	}
+	mp.store.ServeFile(w, r, localpath)
+}
+
+// cachePath returns where the file fetched from source is stored, separate per host
+func (mp *MediaProxy) cachePath(source *url.URL) string {
+	return path.Join(mp.dumpdir, ProxyCachePath, source.Scheme, source.Host, source.Path)
+}
+
+// fetch gets source and stores it to localpath; concurrent calls for the same path share one request
+func (mp *MediaProxy) fetch(localpath string, source *url.URL) error {
+	mp.mutex.Lock()
+	if call, ok := mp.inflight[localpath]; ok {
+		mp.mutex.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &proxyCall{done: make(chan struct{})}
+	mp.inflight[localpath] = call
+	mp.mutex.Unlock()
+
+	// A fetch may have finished between the callers check and registering this one
+	if _, err := mp.store.Stat(localpath); err != nil {
+		call.err = mp.fetchAndStore(localpath, source)
+	}
+
+	mp.mutex.Lock()
+	delete(mp.inflight, localpath)
+	mp.mutex.Unlock()
+	close(call.done)
+	return call.err
+}
+
+// fetchAndStore does the origin request
+func (mp *MediaProxy) fetchAndStore(localpath string, source *url.URL) error {
+	resp, err := mp.client.Get(source.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return errOriginNotFound
+	default:
+		return fmt.Errorf("Origin status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	mp.logger.Debug().Str("url", source.String()).Int("size", len(body)).Msg("Proxy fetched")
+	return mp.store.WriteFile(localpath, body)
+}
+
+// proxyRewriter returns the rewriter for generated manifests, sending media through the proxy
+// if it is enabled and the recording has no media, unless a default is configured
+func proxyRewriter(ur *UrlRewriter, proxy *MediaProxy, haveMedia bool) *UrlRewriter {
+	if proxy == nil || haveMedia || ur.Default != "" {
+		return ur
+	}
+	r := *ur
+	r.Default = RewriteProxy
+	return &r
+}
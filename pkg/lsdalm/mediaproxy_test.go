@@ -0,0 +1,90 @@
+package lsdalm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jdeisenh/lsdalm/pkg/go-mpd"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMediaProxy(t *testing.T) {
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path != "/live/v/1.m4s" {
+			http.NotFound(w, r)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("segment"))
+	}))
+	defer origin.Close()
+	originUrl, _ := url.Parse(origin.URL + "/live/m.mpd")
+
+	dumpdir := t.TempDir()
+	mp, err := NewMediaProxy(LocalStorage{}, dumpdir, originUrl, NewHttpConfig(), zerolog.Nop())
+	assert.NoError(t, err)
+
+	// Concurrent requests share one origin request
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			mp.ServeHTTP(w, httptest.NewRequest("GET", "/live/v/1.m4s", nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "segment", w.Body.String())
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), hits.Load())
+	// Stored per host, not as recorded file
+	data, err := os.ReadFile(path.Join(dumpdir, ProxyCachePath, "http", originUrl.Host, "live/v/1.m4s"))
+	assert.NoError(t, err)
+	assert.Equal(t, "segment", string(data))
+	_, err = os.Stat(path.Join(dumpdir, "live/v/1.m4s"))
+	assert.Error(t, err)
+
+	// Served from the cache, also through the proxy prefix
+	w := httptest.NewRecorder()
+	mp.ServeHTTP(w, httptest.NewRequest("GET", "/"+ProxyPath(DefaultProxyPrefix, originUrl.JoinPath("../v/1.m4s")), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int32(1), hits.Load())
+	// Stored by a fetch finishing before this one was registered
+	source := originUrl.JoinPath("../v/1.m4s")
+	assert.NoError(t, mp.fetch(mp.cachePath(source), source))
+	assert.Equal(t, int32(1), hits.Load())
+
+	// Recorded files win, other hosts are only fetched from if the manifests use them
+	os.MkdirAll(path.Join(dumpdir, "live/v"), 0755)
+	os.WriteFile(path.Join(dumpdir, "live/v/3.m4s"), []byte("recorded"), 0644)
+	w = httptest.NewRecorder()
+	mp.ServeHTTP(w, httptest.NewRequest("GET", "/proxy/https/evil.example/live/v/3.m4s", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	cdn, _ := url.Parse("https://cdn.example/live/v/3.m4s")
+	assert.False(t, mp.allowed(cdn))
+	mp.AllowManifest(&mpd.MPD{BaseURL: []*mpd.BaseURL{{Value: "https://cdn.example/live/"}}}, originUrl)
+	assert.True(t, mp.allowed(cdn))
+	w = httptest.NewRecorder()
+	mp.ServeHTTP(w, httptest.NewRequest("GET", "/"+ProxyPath(DefaultProxyPrefix, cdn), nil))
+	assert.Equal(t, "recorded", w.Body.String())
+	mp.AllowRules(&UrlRewriter{Rules: []RewriteRule{{Prefix: "https://other.example/", Action: RewriteProxy}}})
+	assert.True(t, mp.allowed(&url.URL{Scheme: "https", Host: "other.example"}))
+
+	w = httptest.NewRecorder()
+	mp.ServeHTTP(w, httptest.NewRequest("GET", "/live/v/2.m4s", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	mp.ServeHTTP(w, httptest.NewRequest("GET", "/proxy/ftp/host/x", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -2,6 +2,7 @@ package lsdalm
 
 import (
 	"errors"
+	"math"
 	"net/url"
 	"path"
 	"strings"
@@ -81,12 +82,13 @@ func Append(st *mpd.SegmentTimeline, t, d uint64, r int64) {
 }
 
 // walkSegmentTemplate walks a segmentTemplate and calls 'action' on all media Segments with their full URL
-func WalkSegmentTemplate(st *mpd.SegmentTemplate, segmentPath *url.URL, repId string, start time.Duration, action func(*url.URL, time.Duration, time.Duration, time.Duration) error) error {
+// periodStart is the wall clock start of the period the template belongs to
+func WalkSegmentTemplate(st *mpd.SegmentTemplate, segmentPath *url.URL, repId string, periodStart time.Time, action func(SegmentInfo) error) error {
 
 	pathTemplate := NewPathReplacer(*st.Media)
 	if st.Initialization != nil {
 		init := strings.Replace(*st.Initialization, "$RepresentationID$", repId, 1)
-		action(segmentPath.JoinPath(init), 0, 0, 0)
+		action(SegmentInfo{Url: segmentPath.JoinPath(init), RepId: repId})
 	}
 	// Walk the Segment
 	if st.SegmentTimeline == nil {
@@ -99,14 +101,22 @@ func WalkSegmentTemplate(st *mpd.SegmentTemplate, segmentPath *url.URL, repId st
 	}
 	timescale := ZeroIfNil(st.Timescale)
 	pto := ZeroIfNil(st.PresentationTimeOffset)
-
-	offset := start + TLP2Duration(int64(pto), timescale)
+	ato := secondsToDuration(st.AvailabilityTimeOffset)
 
 	for t, d := range All(stl) {
 		ppa := pathTemplate.ToPath(int(t), number, repId)
 		//fmt.Printf("Path %s:%s\n", media, ppa)
 		fullUrl := segmentPath.JoinPath(ppa)
-		action(fullUrl, TLP2Duration(int64(t), timescale), TLP2Duration(int64(d), timescale), offset)
+		at := periodStart.Add(TLP2Duration(int64(t-pto), timescale))
+		duration := TLP2Duration(int64(d), timescale)
+		action(SegmentInfo{
+			Url:       fullUrl,
+			T:         TLP2Duration(int64(t), timescale),
+			D:         duration,
+			RepId:     repId,
+			At:        at,
+			Available: at.Add(duration - ato),
+		})
 		number++
 	}
 	return nil
@@ -176,14 +186,18 @@ func segmentPathFromPeriod(period *mpd.Period, mpdUrl *url.URL) *url.URL {
 			log.Warn().Err(err).Msg("Parse URL")
 		}
 	}
-	if baseurl.IsAbs() {
+	if baseurl != nil && baseurl.IsAbs() {
 		segmentPath = baseurl
 	} else {
 		// Combine mpd URL and base
 		segmentPath = new(url.URL)
 		*segmentPath = *mpdUrl
+		basePath := ""
+		if baseurl != nil {
+			basePath = baseurl.Path
+		}
 		// Cut to directory, extend by base path
-		joined, err := url.JoinPath(path.Dir(segmentPath.Path), baseurl.Path)
+		joined, err := url.JoinPath(path.Dir(segmentPath.Path), basePath)
 		if err != nil {
 			log.Fatal().Err(err).Msg("Path extension")
 		}
@@ -228,24 +242,38 @@ func ShiftPto(st *mpd.SegmentTemplate, shiftValue time.Duration) {
 }
 
 // Iterate through all periods, representation, segmentTimeline and
-// call 'action' with the URL
-func OnAllSegmentUrls(mpd *mpd.MPD, mpdUrl *url.URL, action func(*url.URL, time.Duration, time.Duration, time.Duration) error) error {
+// call 'action' with the segment data
+func OnAllSegmentUrls(mpde *mpd.MPD, mpdUrl *url.URL, action func(SegmentInfo) error) error {
+	ast := GetAst(mpde)
 	// Walk all Periods, AdaptationSets and Representations
-	for _, period := range mpd.Period {
-		start := GetStart(period)
+	for _, period := range mpde.Period {
+		periodStart := ast.Add(GetStart(period))
 		segmentPath := segmentPathFromPeriod(period, mpdUrl)
+		// The availabilityTimeOffset of the BaseURL adds to the one of the template
+		var baseAto time.Duration
+		if len(period.BaseURL) > 0 {
+			baseAto = secondsToDuration(period.BaseURL[0].AvailabilityTimeOffset)
+		}
 		for _, as := range period.AdaptationSets {
+			track := TrackName(as)
+			withTrack := func(seg SegmentInfo) error {
+				seg.Track = track
+				if !seg.Available.IsZero() {
+					seg.Available = seg.Available.Add(-baseAto)
+				}
+				return action(seg)
+			}
 			for _, pres := range as.Representations {
 				if pres.ID == nil {
 					continue
 				}
 				repId := *pres.ID
 				if as.SegmentTemplate != nil {
-					if err := WalkSegmentTemplate(as.SegmentTemplate, segmentPath, repId, start, action); err != nil {
+					if err := WalkSegmentTemplate(as.SegmentTemplate, segmentPath, repId, periodStart, withTrack); err != nil {
 						break
 					}
 				} else if pres.SegmentTemplate != nil {
-					if err := WalkSegmentTemplate(pres.SegmentTemplate, segmentPath, repId, start, action); err != nil {
+					if err := WalkSegmentTemplate(pres.SegmentTemplate, segmentPath, repId, periodStart, withTrack); err != nil {
 						break
 					}
 				}
@@ -255,41 +283,6 @@ func OnAllSegmentUrls(mpd *mpd.MPD, mpdUrl *url.URL, action func(*url.URL, time.
 	return nil
 }
 
-// ReBaseMpd wil change BaseURL, append path of originalBase and then, if localMedia is true, dropping the protocol/host
-func ReBaseMpd(mpde *mpd.MPD, originalBase *url.URL, localMedia bool) *mpd.MPD {
-	if len(mpde.Period) == 0 {
-		return nil
-	}
-	outMpd := new(mpd.MPD)
-	*outMpd = *mpde
-	outMpd.Period = make([]*mpd.Period, 0, 1)
-
-	for _, period := range mpde.Period {
-		np := new(mpd.Period)
-		*np = *period
-
-		// Expand to full URL first
-		if originalBase != nil {
-			baseurl := ""
-			if len(np.BaseURL) > 0 {
-				baseurl = np.BaseURL[0].Value
-			}
-			baseurlUrl := ConcatURL(originalBase, baseurl)
-			np.BaseURL = make([]*mpd.BaseURL, 0, 1)
-			nburl := new(mpd.BaseURL)
-			np.BaseURL = append(np.BaseURL, nburl)
-			if localMedia {
-				np.BaseURL[0].Value = baseurlUrl.Path[1:]
-			} else {
-				np.BaseURL[0].Value = baseurlUrl.String()
-			}
-		}
-		outMpd.Period = append(outMpd.Period, np)
-
-	}
-	return outMpd
-}
-
 // mergeMpd appends the periods from mpd2 into mpd1,
 func mergeMpd(mpd1, mpd2 *mpd.MPD) *mpd.MPD {
 	if mpd1 == nil {
@@ -357,6 +350,23 @@ func PeriodWithStart(in *mpd.Period, start time.Duration, id string) *mpd.Period
 	return p
 }
 
+// TrackName returns a display name for an AdaptationSet from mimeType and language
+func TrackName(as *mpd.AdaptationSet) string {
+	if as.Lang != nil {
+		return as.MimeType + ":" + *as.Lang
+	}
+	return as.MimeType
+}
+
+// secondsToDuration converts an optional value in seconds (like availabilityTimeOffset) to a duration
+// returns 0 if not given or infinite
+func secondsToDuration(in *float64) time.Duration {
+	if in == nil || math.IsInf(*in, 0) || math.IsNaN(*in) {
+		return 0
+	}
+	return time.Duration(*in * float64(time.Second))
+}
+
 // GetAst finds the AvailabilityStartTime in an MPD
 // Returns empty time if not found
 func GetAst(in *mpd.MPD) time.Time {
@@ -3,7 +3,6 @@ package lsdalm
 import (
 	"errors"
 	"fmt"
-	"os"
 	"path"
 	"time"
 
@@ -12,9 +11,10 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-// Recording is a representation of a recording
+// Recording is a representation of a continuous range of a recording
 type Recording struct {
 	manifestDir string
+	reader      *ManifestReader
 	// Map timestamps to mpd files
 	history []HistoryElement
 
@@ -43,6 +43,7 @@ type Element struct {
 type AdaptationSet struct {
 	elements   []Element
 	start, end int64
+	floor      int64 // Segments before are ignored while empty, they belong to the previous range
 }
 
 func NewAdaptationSet() *AdaptationSet {
@@ -51,52 +52,97 @@ func NewAdaptationSet() *AdaptationSet {
 	}
 }
 
-func NewRecording(manifestDir string) *Recording {
+func NewRecording(store Storage, manifestDir string) *Recording {
 
 	return &Recording{
 		manifestDir:    manifestDir,
+		reader:         NewManifestReader(store),
 		history:        make([]HistoryElement, 0, 1000),
 		Segments:       make([]*AdaptationSet, 0, 5),
 		EventStreamMap: make(map[string]*mpd.EventStream),
 	}
 }
 
-// fillData reads and adds stored manifests
-func (re *Recording) fillData(logger zerolog.Logger) error {
-	files, err := os.ReadDir(re.manifestDir)
+// LoadRanges reads the stored manifests in manifestDir, from notBefore on, into continuous ranges
+// A range ends where manifests are missing for more than maxMpdGap or the segment timeline
+// has a gap. Ranges too short to loop are dropped. Gaps are logged
+func LoadRanges(store Storage, manifestDir string, notBefore time.Time, logger zerolog.Logger) ([]*Recording, error) {
+	manifests, err := ListManifests(store, manifestDir)
 	if err != nil {
 		logger.Error().Err(err).Msg("Scan directories")
-		return err
+		return nil, err
 	}
+	re := NewRecording(store, manifestDir)
+	ranges := []*Recording{re}
 	var lasttime time.Time
-	for _, f := range files {
-		if f.IsDir() {
-			continue
-		}
-		logger.Trace().Msg(f.Name())
-		ctime, err := time.Parse(ManifestFormat, f.Name())
-		if err != nil {
-			logger.Warn().Err(err).Msg("Parse String")
+	var lastFile string
+	for _, newOne := range manifests {
+		logger.Trace().Msg(newOne.Filename)
+		ctime := newOne.At
+		if ctime.Before(notBefore) {
 			continue
 		}
 		if !lasttime.IsZero() && (ctime.Sub(lasttime) > maxMpdGap) {
-			logger.Error().Msgf("Too large a gap between %s and %s, dropping",
-				lasttime.Format(time.TimeOnly), ctime.Format(time.TimeOnly))
-			re.history = re.history[:0]
+			logger.Warn().Str("from", shortT(lasttime)).Str("to", shortT(ctime)).Dur("gap", ctime.Sub(lasttime)).
+				Msg("Gap in recording, no manifests")
+			re = re.next()
+			ranges = append(ranges, re)
 		}
-		newOne := HistoryElement{At: ctime, Filename: f.Name()}
+		lasttime = ctime
 		re.history = append(re.history, newOne)
+		if newOne.Filename == lastFile {
+			// Deduplicated poll, nothing new
+			continue
+		}
+		lastFile = newOne.Filename
 		got, err := re.loadHistoricMpd(newOne.At)
 		if err != nil {
 			logger.Error().Err(err).Msg("Load manifest")
+			continue
 		}
 		err = re.AddMpdToHistory(got)
+		if errors.Is(err, noncont) {
+			logger.Warn().Err(err).Str("at", shortT(ctime)).Msg("Gap in recording, segments missing")
+			re.history = re.history[:len(re.history)-1]
+			re = re.next()
+			ranges = append(ranges, re)
+			re.history = append(re.history, newOne)
+			err = re.AddMpdToHistory(got)
+		}
 		if err != nil {
-			logger.Error().Err(err).Str("path", f.Name()).Msg("Add manifest")
+			logger.Error().Err(err).Str("path", newOne.Filename).Msg("Add manifest")
 			break
 		}
 	}
 
+	ret := ranges[:0]
+	for _, re := range ranges {
+		if re.firstMpd == nil {
+			continue
+		}
+		re.finish(logger)
+		if from, to := re.getLoopableRange(); to.Sub(from) < 2*segmentSize {
+			logger.Warn().Str("from", shortT(from)).Str("to", shortT(to)).Msg("Range too short to loop, dropping")
+			continue
+		}
+		ret = append(ret, re)
+	}
+	return ret, nil
+}
+
+// next starts the range after a gap, continuing the timelines where re ends
+func (re *Recording) next() *Recording {
+	nr := NewRecording(re.reader.store, re.manifestDir)
+	for _, as := range re.Segments {
+		nas := NewAdaptationSet()
+		nas.floor = as.end
+		nr.Segments = append(nr.Segments, nas)
+	}
+	return nr
+}
+
+// finish sets the range of the loaded samples
+func (re *Recording) finish(logger zerolog.Logger) {
 	ast := GetAst(re.firstMpd)
 	for k, as := range re.Segments {
 		ras := re.firstMpd.Period[0].AdaptationSets[k]
@@ -116,8 +162,6 @@ func (re *Recording) fillData(logger zerolog.Logger) error {
 	for sId, elem := range re.EventStreamMap {
 		logger.Info().Msgf("Events: %s: %+v", sId, len(elem.Event))
 	}
-
-	return nil
 }
 
 // findSub finds a HistoryElement recursively
@@ -308,25 +352,10 @@ func (re *Recording) getRecordingRange() (from, to time.Time) {
 	return
 }
 
-// Return loop metadata
-// for the position at, return offset (to recording), timeshift und loop duration
-func (re *Recording) getLoopMeta(at, now time.Time) (offset, shift, duration time.Duration, start time.Time) {
-
-	// Calculate the offset in the recording buffer and the timeshift (added to timestamps)
-	// Invariants:
-	// start+offset+shift=now => shift=now-offset-start
-	// We play at at%duration => (start+offset)%duration == at%duration => offset=(at-start)%duration
-
-	// Data from history buffer
-	// This is inexact, the last might not have all Segments downloaded
-	var end time.Time
-	start, end = re.getLoopableRange()
-	duration = end.Sub(start)
-
-	offset = at.Sub(start) % duration
-	shift = now.Add(-offset).Sub(start)
-	//log.Info().Msgf("RecordingRange %s %s", start, end)
-	return
+// loopLength returns the duration of the loopable range
+func (re *Recording) loopLength() time.Duration {
+	from, to := re.getLoopableRange()
+	return to.Sub(from)
 }
 
 // Load a manifest close to 'at'
@@ -337,7 +366,7 @@ func (re *Recording) loadHistoricMpd(at time.Time) (*mpd.MPD, error) {
 	if sourceElement == nil {
 		return nil, errors.New("No source found")
 	}
-	buf, err := os.ReadFile(sourceElement.Filename)
+	buf, err := re.reader.Read(sourceElement.Filename)
 	if err != nil {
 		return nil, err
 	}
@@ -352,6 +381,9 @@ func (re *Recording) loadHistoricMpd(at time.Time) (*mpd.MPD, error) {
 func (as *AdaptationSet) Add(t, d, r int64) error {
 
 	last := len(as.elements) - 1
+	if last < 0 && t < as.floor {
+		return nil
+	}
 	if last < 0 {
 		as.elements = make([]Element, 0, 1000)
 		as.start, as.end = t, t
@@ -374,6 +406,22 @@ func (as *AdaptationSet) Add(t, d, r int64) error {
 	return nil
 }
 
+// durationAt returns the duration of the segment starting at t
+func (as *AdaptationSet) durationAt(t int64) (int64, bool) {
+	start := as.start
+	for _, e := range as.elements {
+		end := start + e.d*(e.r+1)
+		if t < end {
+			if t < start || (t-start)%e.d != 0 {
+				return 0, false
+			}
+			return e.d, true
+		}
+		start = end
+	}
+	return 0, false
+}
+
 func (re *Recording) ShowStats(logger zerolog.Logger) {
 	if len(re.history) > 0 {
 		first := re.history[0].At
@@ -0,0 +1,309 @@
+package lsdalm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// DefaultIdleTimeout is how long a loaded recording stays in memory without requests
+const DefaultIdleTimeout = 10 * time.Minute
+
+// reservedNames are top level paths of the server, recordings with these names are not mounted
+var reservedNames = []string{"time", "faults", "shape", "admin", "analytics"}
+
+// mountPrefixKey is the request context key of the path prefix RecordingMux stripped
+type mountPrefixKey struct{}
+
+// mountPrefix returns the path prefix stripped from r before it reached the handler, to build absolute URLs
+func mountPrefix(r *http.Request) string {
+	prefix, _ := r.Context().Value(mountPrefixKey{}).(string)
+	return prefix
+}
+
+// RecordingMux serves all recordings below a root directory, each below /<recording>/
+// A recording is a directory with a StorageMeta file, its path relative to the root is its name
+// Recordings are loaded on first access and dropped again when idle
+type RecordingMux struct {
+	store  Storage
+	root   string
+	logger zerolog.Logger
+	idle   time.Duration
+	setup  func(sc *StreamLooper, mux *http.ServeMux) error
+
+	mutex      sync.Mutex
+	recordings map[string]*muxRecording
+}
+
+// muxRecording is a recording found by the scan
+type muxRecording struct {
+	name string
+
+	mutex    sync.Mutex // Held while loading
+	looper   *StreamLooper
+	handler  http.Handler
+	err      error // Of the last load, kept until evicted
+	lastUsed time.Time
+}
+
+// MuxRecordingInfo describes a recording in the index of a RecordingMux
+type MuxRecordingInfo struct {
+	Name     string
+	Manifest string
+	Loaded   bool
+	LastUsed time.Time
+	Error    string `json:",omitempty"`
+}
+
+// NewRecordingMux scans root, a local directory or s3://bucket/prefix, for recordings
+func NewRecordingMux(root string, logger zerolog.Logger) (*RecordingMux, error) {
+	store, root, err := OpenStorage(root)
+	if err != nil {
+		return nil, err
+	}
+	rm := &RecordingMux{
+		store:      store,
+		root:       root,
+		logger:     logger,
+		idle:       DefaultIdleTimeout,
+		recordings: make(map[string]*muxRecording),
+	}
+	if err := rm.Scan(); err != nil {
+		return nil, err
+	}
+	return rm, nil
+}
+
+// SetIdleTimeout sets how long loaded recordings are kept without requests
+func (rm *RecordingMux) SetIdleTimeout(idle time.Duration) error {
+	if idle <= 0 {
+		return errors.New("Idle timeout must be positive")
+	}
+	rm.idle = idle
+	return nil
+}
+
+// SetSetup sets a function called for every loaded recording, to apply settings
+// and to add handlers to its mux, which already serves the manifests and files
+func (rm *RecordingMux) SetSetup(setup func(sc *StreamLooper, mux *http.ServeMux) error) {
+	rm.setup = setup
+}
+
+// Scan looks for added and removed recordings
+func (rm *RecordingMux) Scan() error {
+	var names []string
+	if err := rm.scanDir(rm.root, &names); err != nil {
+		return err
+	}
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	found := make(map[string]bool, len(names))
+	for _, name := range names {
+		found[name] = true
+		if _, ok := rm.recordings[name]; !ok {
+			rm.logger.Info().Str("recording", name).Msg("Found recording")
+			rm.recordings[name] = &muxRecording{name: name}
+		}
+	}
+	for name := range rm.recordings {
+		if !found[name] {
+			rm.logger.Info().Str("recording", name).Msg("Recording removed")
+			delete(rm.recordings, name)
+		}
+	}
+	return nil
+}
+
+// scanDir adds the recordings below dir to names, not descending into recordings
+func (rm *RecordingMux) scanDir(dir string, names *[]string) error {
+	entries, err := rm.store.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() && e.Name() == StorageMetaFileName {
+			name := strings.Trim(strings.TrimPrefix(dir, rm.root), "/")
+			first, _, _ := strings.Cut(name, "/")
+			if name == "" || slices.Contains(reservedNames, first) {
+				rm.logger.Warn().Str("dir", dir).Msg("Recording not mountable, move it to a subdirectory")
+				return nil
+			}
+			*names = append(*names, name)
+			return nil
+		}
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			if err := rm.scanDir(path.Join(dir, e.Name()), names); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Maintain rescans and evicts idle recordings every interval, it does not return
+func (rm *RecordingMux) Maintain(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for now := range ticker.C {
+		if err := rm.Scan(); err != nil {
+			rm.logger.Warn().Err(err).Msg("Scan recordings")
+		}
+		rm.evict(now)
+	}
+}
+
+// evict drops recordings idle at now, and failed loads to retry them
+func (rm *RecordingMux) evict(now time.Time) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	for _, rec := range rm.recordings {
+		if !rec.mutex.TryLock() {
+			// Loading
+			continue
+		}
+		if (rec.looper != nil && now.Sub(rec.lastUsed) > rm.idle) || rec.err != nil {
+			rm.logger.Info().Str("recording", rec.name).Msg("Unload recording")
+			rec.looper, rec.handler, rec.err = nil, nil, nil
+		}
+		rec.mutex.Unlock()
+	}
+}
+
+// find returns the recording urlpath is in and the path within it
+func (rm *RecordingMux) find(urlpath string) (*muxRecording, string) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	var found *muxRecording
+	var rest string
+	for name, rec := range rm.recordings {
+		after, ok := strings.CutPrefix(urlpath, "/"+name+"/")
+		// Longest match, recordings may be nested in directories of others
+		if ok && (found == nil || len(name) > len(found.name)) {
+			found, rest = rec, "/"+after
+		}
+	}
+	return found, rest
+}
+
+// handler returns the handler of rec, loading it if needed
+func (rm *RecordingMux) handler(rec *muxRecording) (http.Handler, error) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	rec.lastUsed = time.Now()
+	if rec.handler != nil || rec.err != nil {
+		return rec.handler, rec.err
+	}
+	rm.logger.Info().Str("recording", rec.name).Msg("Load recording")
+	rec.looper, rec.handler, rec.err = rm.load(rec.name)
+	if rec.err != nil {
+		rm.logger.Error().Err(rec.err).Str("recording", rec.name).Msg("Load recording")
+	}
+	return rec.handler, rec.err
+}
+
+// load reads a recording and builds its handler
+func (rm *RecordingMux) load(name string) (*StreamLooper, http.Handler, error) {
+	sc, err := NewStreamLooperWithStorage(rm.store, path.Join(rm.root, name), rm.logger.With().Str("recording", name).Logger())
+	if err != nil {
+		return nil, nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/manifest.mpd", sc.DynamicHandler)
+	mux.HandleFunc("/static.mpd", sc.StaticHandler)
+	mux.HandleFunc(FaultPathPrefix, sc.FaultHandler)
+	mux.HandleFunc(TimePath, sc.TimeHandler)
+	mux.HandleFunc(TimePath+"/", sc.TimeHandler)
+	mux.HandleFunc("/", sc.FileHandler)
+	if rm.setup != nil {
+		if err := rm.setup(sc, mux); err != nil {
+			return nil, nil, err
+		}
+	}
+	return sc, mux, nil
+}
+
+// ServeHTTP serves the recordings, and their index as JSON on /
+func (rm *RecordingMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		rm.serveIndex(w)
+		return
+	}
+	rec, rest := rm.find(r.URL.Path)
+	if rec == nil {
+		http.NotFound(w, r)
+		return
+	}
+	handler, err := rm.handler(rec)
+	if err != nil {
+		http.Error(w, "Recording "+rec.name+" not available", http.StatusServiceUnavailable)
+		return
+	}
+	r2 := r.WithContext(context.WithValue(r.Context(), mountPrefixKey{}, mountPrefix(r)+"/"+rec.name))
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = rest
+	r2.URL.RawPath = ""
+	handler.ServeHTTP(w, r2)
+}
+
+// Recordings lists the recordings found, by name
+func (rm *RecordingMux) Recordings() []MuxRecordingInfo {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	ret := make([]MuxRecordingInfo, 0, len(rm.recordings))
+	for name, rec := range rm.recordings {
+		info := MuxRecordingInfo{Name: name, Manifest: "/" + name + "/manifest.mpd"}
+		// Do not wait for loads
+		if rec.mutex.TryLock() {
+			info.Loaded, info.LastUsed = rec.looper != nil, rec.lastUsed
+			if rec.err != nil {
+				info.Error = rec.err.Error()
+			}
+			rec.mutex.Unlock()
+		}
+		ret = append(ret, info)
+	}
+	slices.SortFunc(ret, func(a, b MuxRecordingInfo) int { return strings.Compare(a.Name, b.Name) })
+	return ret
+}
+
+// serveIndex sends the list of recordings
+func (rm *RecordingMux) serveIndex(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(rm.Recordings())
+}
+
+// findRecording splits a request path into the recording name and the path within it
+func (rm *RecordingMux) findRecording(urlpath string) (string, string, bool) {
+	rec, rest := rm.find(urlpath)
+	if rec == nil {
+		return "", "", false
+	}
+	return rec.name, rest, true
+}
+
+// locateSegment maps a request path to a segment of a loaded recording, not loading it
+func (rm *RecordingMux) locateSegment(urlpath string, at time.Time) (segmentRequest, bool) {
+	rec, rest := rm.find(urlpath)
+	if rec == nil || !rec.mutex.TryLock() {
+		return segmentRequest{}, false
+	}
+	sc := rec.looper
+	rec.mutex.Unlock()
+	if sc == nil {
+		return segmentRequest{}, false
+	}
+	return sc.locateSegment(rest, at)
+}
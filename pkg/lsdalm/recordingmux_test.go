@@ -0,0 +1,60 @@
+package lsdalm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordingMux(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"a", "b/c", "b/c/live", "time", "d/manifests"} {
+		os.MkdirAll(path.Join(root, dir), 0755)
+	}
+	for _, dir := range []string{"a", "b/c", "time"} {
+		os.WriteFile(path.Join(root, dir, StorageMetaFileName), []byte("{}"), 0644)
+	}
+	rm, err := NewRecordingMux(root, zerolog.Nop())
+	assert.NoError(t, err)
+	var names []string
+	for _, info := range rm.Recordings() {
+		names = append(names, info.Name)
+	}
+	assert.Equal(t, []string{"a", "b/c"}, names)
+
+	rec, rest := rm.find("/b/c/live/v/1.m4s")
+	assert.Equal(t, "b/c", rec.name)
+	assert.Equal(t, "/live/v/1.m4s", rest)
+	none, _ := rm.find("/b/manifest.mpd")
+	assert.Nil(t, none)
+
+	// Sessions are per recording, with the fault prefixes below it
+	r := httptest.NewRequest("GET", "/shape/rate=1M/b/c/faults/flaky/v/1.m4s", nil)
+	r.Header.Set("User-Agent", "player")
+	key, rest := NewMuxAccessLog(rm, zerolog.Nop()).session(r)
+	assert.Equal(t, "192.0.2.1 player /shape/rate=1M /b/c /faults/flaky", key)
+	assert.Equal(t, "/b/c/v/1.m4s", rest)
+
+	// Absolute URLs of handlers in a recording keep its prefix
+	var timing string
+	rec.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timing = *NewTimeServer().UTCTiming(r).Value
+	})
+	rm.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://looper/b/c/faults/flaky/manifest.mpd", nil))
+	assert.Equal(t, "http://looper/b/c/faults/flaky/time/xsdate", timing)
+
+	// No manifests: the load fails until evicted
+	w := httptest.NewRecorder()
+	rm.ServeHTTP(w, httptest.NewRequest("GET", "/a/manifest.mpd", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NotEmpty(t, rm.Recordings()[0].Error)
+
+	os.RemoveAll(path.Join(root, "a"))
+	assert.NoError(t, rm.Scan())
+	assert.Len(t, rm.Recordings(), 1)
+}
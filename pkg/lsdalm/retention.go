@@ -0,0 +1,329 @@
+package lsdalm
+
+import (
+	"errors"
+	"io/fs"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdeisenh/lsdalm/pkg/go-mpd"
+)
+
+const retentionInterval = time.Minute // How often retention is enforced
+
+// RetentionPolicy limits the storage used by the recordings of a channel
+type RetentionPolicy struct {
+	MaxAge  time.Duration // Delete manifests and segments older than this, 0: keep
+	MaxSize int64         // Delete the oldest data if all recordings of the channel exceed this (bytes), 0: unlimited
+	Rotate  time.Duration // Start a new recording directory at multiples of this (UTC), 0: never
+}
+
+// SetRetentionPolicy enables rolling retention and rotation of recordings
+func (sc *StreamChecker) SetRetentionPolicy(rp RetentionPolicy) {
+	sc.retention = &rp
+	if rp.Rotate > 0 {
+		sc.rotatedAt = time.Now().Truncate(rp.Rotate)
+	}
+}
+
+// ParseSize parses a byte size with optional K, M, G or T suffix (powers of 1024)
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(s, suffix) {
+			s = strings.TrimSuffix(s, suffix)
+			mult = 1 << (10 * (i + 1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("Negative size")
+	}
+	return n * mult, nil
+}
+
+// rotationName returns the directory name of the recording starting at 'at'
+func (sc *StreamChecker) rotationName(at time.Time) string {
+	format := "2006-01-02"
+	if sc.retention.Rotate%(24*time.Hour) != 0 {
+		format = "2006-01-02T15-04"
+	}
+	return sc.name + "-" + at.UTC().Format(format)
+}
+
+// rotateIfDue switches to a new recording directory when a rotation boundary was passed
+func (sc *StreamChecker) rotateIfDue(now time.Time) error {
+	if sc.retention == nil || sc.retention.Rotate <= 0 {
+		return nil
+	}
+	boundary := now.Truncate(sc.retention.Rotate)
+	if !boundary.After(sc.rotatedAt) {
+		return nil
+	}
+	sc.rotatedAt = boundary
+	newdir := path.Join(sc.dumpbase, sc.rotationName(boundary))
+	if _, err := sc.store.Stat(newdir); err == nil {
+		// Restarted within the interval
+		newdir += "." + strconv.FormatInt(now.Unix(), 10)
+	}
+	olddir := sc.storageDir()
+	if err := sc.createDumpDir(newdir, path.Base(olddir)); err != nil {
+		return err
+	}
+	// Link the old recording to the new one
+	if m, err := ReadStorageMeta(sc.store, olddir); err == nil {
+		m.Next = path.Base(newdir)
+		WriteStorageMeta(sc.store, olddir, m)
+	}
+	// The new recording needs its own init segments
+	sc.scheduler.ForgetInits()
+	sc.logger.Info().Str("from", olddir).Str("to", newdir).Msg("Rotated recording")
+	return nil
+}
+
+// channelDirs returns all recording directories of this channel, oldest first
+func (sc *StreamChecker) channelDirs() ([]string, error) {
+	entries, err := sc.store.ReadDir(sc.dumpbase)
+	if err != nil {
+		return nil, err
+	}
+	current := sc.storageDir()
+	type dirAge struct {
+		dir     string
+		created time.Time
+	}
+	var dirs []dirAge
+	for _, e := range entries {
+		if !e.IsDir() || (e.Name() != sc.name && !strings.HasPrefix(e.Name(), sc.name+"-")) {
+			continue
+		}
+		dir := path.Join(sc.dumpbase, e.Name())
+		if dir == current {
+			continue
+		}
+		m, err := ReadStorageMeta(sc.store, dir)
+		if err != nil || m.ManifestUrl != sc.storageMeta.ManifestUrl {
+			// Not a recording or from another source
+			continue
+		}
+		created := m.Created
+		if created.IsZero() {
+			if info, err := e.Info(); err == nil {
+				created = info.ModTime()
+			}
+		}
+		dirs = append(dirs, dirAge{dir, created})
+	}
+	slices.SortFunc(dirs, func(a, b dirAge) int { return a.created.Compare(b.created) })
+	ret := make([]string, 0, len(dirs)+1)
+	for _, d := range dirs {
+		ret = append(ret, d.dir)
+	}
+	return append(ret, current), nil
+}
+
+// storedFile is a file in a recording directory
+type storedFile struct {
+	path  string
+	mtime time.Time
+	size  int64
+}
+
+// enforceRetention deletes manifests and segments outside the retention limits
+// The newest manifest of the current recording is always kept
+func (sc *StreamChecker) enforceRetention(now time.Time) error {
+	rp := sc.retention
+	if rp.MaxAge <= 0 && rp.MaxSize <= 0 {
+		return nil
+	}
+	dirs, err := sc.channelDirs()
+	if err != nil {
+		return err
+	}
+	var files []storedFile
+	var total int64
+	for _, dir := range dirs {
+		walkStorage(sc.store, dir, func(p string, info fs.FileInfo) {
+			files = append(files, storedFile{p, info.ModTime(), info.Size()})
+			total += info.Size()
+		})
+	}
+
+	var cutoff time.Time
+	if rp.MaxAge > 0 {
+		cutoff = now.Add(-rp.MaxAge)
+	}
+	if rp.MaxSize > 0 && total > rp.MaxSize {
+		// Keep the newest files fitting into MaxSize
+		slices.SortFunc(files, func(a, b storedFile) int { return b.mtime.Compare(a.mtime) })
+		var sum int64
+		for _, f := range files {
+			sum += f.size
+			if sum > rp.MaxSize {
+				if sizeCut := f.mtime.Add(time.Nanosecond); sizeCut.After(cutoff) {
+					cutoff = sizeCut
+				}
+				break
+			}
+		}
+	}
+	if cutoff.IsZero() {
+		return nil
+	}
+
+	var removed, freed int64
+	for i, dir := range dirs {
+		isCurrent := i == len(dirs)-1
+		n, b, err := sc.pruneRecording(dir, cutoff, isCurrent)
+		if err != nil {
+			sc.logger.Warn().Err(err).Str("dir", dir).Msg("Prune recording")
+		}
+		removed += n
+		freed += b
+	}
+	if removed > 0 {
+		sc.logger.Info().Int64("files", removed).Int64("bytes", freed).Msgf("Retention: removed data before %s", cutoff.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// pruneRecording deletes manifests older than cutoff and the segments only they reference
+// Recordings without manifests left are deleted, unless current
+func (sc *StreamChecker) pruneRecording(dir string, cutoff time.Time, isCurrent bool) (removed, freed int64, err error) {
+	manifestDir := path.Join(dir, ManifestPath)
+	manifests, err := ListManifests(sc.store, manifestDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	// Stored files still referenced by retained deduplicated polls are kept
+	needed := make(map[string]bool)
+	for _, he := range manifests {
+		if !he.At.Before(cutoff) {
+			needed[he.Filename] = true
+		}
+	}
+	var kept []HistoryElement
+	var expired []string
+	for _, he := range manifests {
+		if at, _ := ParseManifestName(he.Filename); !at.Equal(he.At) {
+			// A deduplicated poll, not a file
+			continue
+		}
+		if he.At.Before(cutoff) && !needed[he.Filename] {
+			expired = append(expired, he.Filename)
+		} else {
+			kept = append(kept, he)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, 0, nil
+	}
+	if len(kept) == 0 {
+		if !isCurrent {
+			// Everything expired
+			size := sc.dirSize(dir)
+			if err := sc.store.RemoveAll(dir); err != nil {
+				return 0, 0, err
+			}
+			sc.logger.Info().Str("dir", dir).Msg("Removed recording")
+			return 1, size, nil
+		}
+		// Keep the newest manifest
+		last := expired[len(expired)-1]
+		expired = expired[:len(expired)-1]
+		at, _ := ParseManifestName(last)
+		kept = append(kept, HistoryElement{At: at, Filename: last})
+	}
+
+	// Deltas must not refer to deleted manifests
+	if err := NewManifestReader(sc.store).RewriteFull(path.Join(manifestDir, kept[0].Filename)); err != nil {
+		return 0, 0, err
+	}
+	for _, name := range expired {
+		p := path.Join(manifestDir, name)
+		if info, err := sc.store.Stat(p); err == nil {
+			freed += info.Size()
+		}
+		if sc.store.Remove(p) == nil {
+			removed++
+		}
+	}
+	if err := pruneManifestIndex(sc.store, manifestDir, kept[0].At); err != nil {
+		sc.logger.Warn().Err(err).Str("dir", manifestDir).Msg("Prune manifest index")
+	}
+
+	oldest := kept[0]
+	m, err := ReadStorageMeta(sc.store, dir)
+	if err == nil {
+		m.RetainedFrom = oldest.At
+		WriteStorageMeta(sc.store, dir, m)
+	}
+	if m.HaveMedia {
+		// Older recordings may be of another session, with the media stored below its URL
+		mediaBase := sc.sourceUrl
+		if u, err := url.Parse(m.MediaBase()); err == nil && u.IsAbs() {
+			mediaBase = u
+		}
+		// Segments fetched before the oldest manifest, and not in there, are not referenced anymore
+		n, b, err := sc.pruneSegments(dir, oldest, mediaBase)
+		removed += n
+		freed += b
+		if err != nil {
+			return removed, freed, err
+		}
+	}
+	return removed, freed, nil
+}
+
+// pruneSegments deletes media files written before the manifest 'oldest' and not referenced by it
+// The segment URLs are resolved against mediaBase
+func (sc *StreamChecker) pruneSegments(dir string, oldest HistoryElement, mediaBase *url.URL) (removed, freed int64, err error) {
+	contents, err := NewManifestReader(sc.store).Read(path.Join(dir, ManifestPath, oldest.Filename))
+	if err != nil {
+		return 0, 0, err
+	}
+	mpde := new(mpd.MPD)
+	if err := mpde.Decode(contents); err != nil {
+		return 0, 0, err
+	}
+	referenced := make(map[string]bool)
+	err = OnAllSegmentUrls(mpde, mediaBase, func(seg SegmentInfo) error {
+		referenced[path.Join(dir, seg.Url.Path)] = true
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	manifestDir := path.Join(dir, ManifestPath) + "/"
+	err = walkStorage(sc.store, dir, func(p string, info fs.FileInfo) {
+		if strings.HasPrefix(p, manifestDir) || p == path.Join(dir, StorageMetaFileName) || referenced[p] {
+			return
+		}
+		if !info.ModTime().Before(oldest.At) {
+			return
+		}
+		if sc.store.Remove(p) == nil {
+			removed++
+			freed += info.Size()
+		}
+	})
+	return removed, freed, err
+}
+
+// dirSize returns the size of all files below dir
+func (sc *StreamChecker) dirSize(dir string) int64 {
+	var size int64
+	walkStorage(sc.store, dir, func(p string, info fs.FileInfo) {
+		size += info.Size()
+	})
+	return size
+}
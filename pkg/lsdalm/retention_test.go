@@ -0,0 +1,131 @@
+package lsdalm
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// testRetentionChecker returns a checker of channel "ch" recording the session s2 into base/ch
+// with an older recording of session s1 in base/ch-old
+func testRetentionChecker(t *testing.T, rp RetentionPolicy) *StreamChecker {
+	base := t.TempDir()
+	manifestUrl := "http://origin/live/manifest.mpd"
+	writeTestRecording(t, path.Join(base, "ch-old"), StorageMeta{ManifestUrl: manifestUrl, MediaUrl: "http://origin/session/s1/manifest.mpd",
+		Created: testRecordingStart.Add(-time.Hour)}, 20)
+	meta := StorageMeta{ManifestUrl: manifestUrl, MediaUrl: "http://origin/session/s2/manifest.mpd", Created: testRecordingStart}
+	writeTestRecording(t, path.Join(base, "ch"), meta, 20)
+	sourceUrl, err := url.Parse(meta.MediaUrl)
+	assert.NoError(t, err)
+	return &StreamChecker{
+		name:        "ch",
+		sourceUrl:   sourceUrl,
+		store:       LocalStorage{},
+		dumpbase:    base,
+		dumpdir:     path.Join(base, "ch"),
+		storageMeta: meta,
+		retention:   &rp,
+		logger:      zerolog.Nop(),
+	}
+}
+
+// testSegments returns which segments of the session exist in dir
+func testSegments(dir, session string) []bool {
+	var exist []bool
+	for n := range 20 {
+		_, err := os.Stat(path.Join(dir, "session", session, fmt.Sprintf("v1/%d.m4s", n*2000)))
+		exist = append(exist, err == nil)
+	}
+	return exist
+}
+
+func TestRetentionAge(t *testing.T) {
+	// Manifests before poll 10 expire
+	sc := testRetentionChecker(t, RetentionPolicy{MaxAge: 18 * time.Second})
+	assert.NoError(t, sc.enforceRetention(testRecordingAt(19)))
+
+	for _, rec := range []struct{ dir, session string }{{"ch", "s2"}, {"ch-old", "s1"}} {
+		dir := path.Join(sc.dumpbase, rec.dir)
+		manifests, err := ListManifests(LocalStorage{}, path.Join(dir, ManifestPath))
+		assert.NoError(t, err)
+		assert.Len(t, manifests, 10, rec.dir)
+		assert.Equal(t, testRecordingAt(10), manifests[0].At, rec.dir)
+		m, err := ReadStorageMeta(LocalStorage{}, dir)
+		assert.NoError(t, err)
+		assert.Equal(t, testRecordingAt(10), m.RetainedFrom, rec.dir)
+
+		// Segments in the oldest manifest left are kept, in the older recording resolved against its own session
+		exist := testSegments(dir, rec.session)
+		assert.Equal(t, []bool{false, false, false, false, false, false, true, true, true, true}, exist[:10], rec.dir)
+		_, err = os.Stat(path.Join(dir, "session", rec.session, "v1/init.mp4"))
+		assert.NoError(t, err, rec.dir)
+	}
+}
+
+func TestRetentionAllExpired(t *testing.T) {
+	sc := testRetentionChecker(t, RetentionPolicy{MaxAge: time.Minute})
+	assert.NoError(t, sc.enforceRetention(testRecordingAt(19).Add(time.Hour)))
+
+	// The older recording is removed, the newest manifest of the current one kept
+	_, err := os.Stat(path.Join(sc.dumpbase, "ch-old"))
+	assert.True(t, os.IsNotExist(err))
+	manifests, err := ListManifests(LocalStorage{}, path.Join(sc.dumpdir, ManifestPath))
+	assert.NoError(t, err)
+	assert.Equal(t, []HistoryElement{{At: testRecordingAt(19), Filename: manifests[0].Filename}}, manifests)
+	got, err := NewManifestReader(LocalStorage{}).Read(path.Join(sc.dumpdir, ManifestPath, manifests[0].Filename))
+	assert.NoError(t, err)
+	assert.Equal(t, string(testManifest(19)), string(got))
+	assert.Equal(t, []bool{false, false, false, false, false, false, false, false, false, false,
+		false, false, false, false, false, true, true, true, true, true}, testSegments(sc.dumpdir, "s2"))
+}
+
+func TestRetentionSize(t *testing.T) {
+	sc := testRetentionChecker(t, RetentionPolicy{})
+	total := sc.dirSize(sc.dumpbase)
+	sc.retention.MaxSize = total / 2
+	assert.NoError(t, sc.enforceRetention(testRecordingAt(19)))
+
+	// Both recordings have the same times, the older half of each is removed
+	assert.Less(t, sc.dirSize(sc.dumpbase), total*3/4)
+	for _, dir := range []string{sc.dumpdir, path.Join(sc.dumpbase, "ch-old")} {
+		m, err := ReadStorageMeta(LocalStorage{}, dir)
+		assert.NoError(t, err)
+		assert.True(t, m.RetainedFrom.After(testRecordingAt(0)), dir)
+		manifests, err := ListManifests(LocalStorage{}, path.Join(dir, ManifestPath))
+		assert.NoError(t, err)
+		assert.Equal(t, testRecordingAt(19), manifests[len(manifests)-1].At, dir)
+	}
+}
+
+func TestRetentionDedup(t *testing.T) {
+	sc := testRetentionChecker(t, RetentionPolicy{MaxAge: 10 * time.Second})
+	// The stream stalls: one stored file at poll 20, deduplicated polls after it
+	mw := newManifestWriter(ManifestPlain)
+	mw.dedup = true
+	manifestDir := path.Join(sc.dumpdir, ManifestPath)
+	var names []string
+	for n := 20; n < 30; n++ {
+		name, err := mw.Write(LocalStorage{}, manifestDir, testRecordingAt(n), testManifest(19))
+		assert.NoError(t, err)
+		names = append(names, name)
+	}
+	assert.Equal(t, names[0], names[9])
+	assert.NoError(t, sc.enforceRetention(testRecordingAt(29)))
+
+	// The file of poll 20 is older than the cutoff, but still used
+	manifests, err := ListManifests(LocalStorage{}, manifestDir)
+	assert.NoError(t, err)
+	assert.Len(t, manifests, 10)
+	assert.Equal(t, testRecordingAt(20), manifests[0].At)
+	got, err := NewManifestReader(LocalStorage{}).Read(path.Join(manifestDir, manifests[9].Filename))
+	assert.NoError(t, err)
+	assert.Equal(t, string(testManifest(19)), string(got))
+	// Its segments are kept
+	assert.Equal(t, []bool{true, true, true, true, true}, testSegments(sc.dumpdir, "s2")[15:])
+}
@@ -0,0 +1,167 @@
+package lsdalm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"time"
+
+	"github.com/jdeisenh/lsdalm/pkg/prom"
+)
+
+// Outcomes of a request with retries
+const (
+	OutcomeOk        = "ok"         // Succeeded on first attempt
+	OutcomeRetriedOk = "retried_ok" // Succeeded after at least one retry
+	OutcomeFailed    = "failed"     // Failed after all attempts
+)
+
+// RetryPolicy controls how failed manifest and segment requests are repeated
+type RetryPolicy struct {
+	MaxAttempts    int           // Total number of attempts, including the first one
+	InitialBackoff time.Duration // Wait before the first retry
+	MaxBackoff     time.Duration // Upper limit for the wait between attempts
+	Multiplier     float64       // Growth of the wait per attempt
+	Jitter         float64       // Fraction (0-1) of the wait that is randomized
+	RetryStatus    []int         // Http status codes that are retried
+	RequestTimeout time.Duration // Timeout for a single attempt, 0 for none
+}
+
+// DefaultRetryPolicy returns a policy with three attempts and exponential backoff
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 200 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+		RetryStatus: []int{
+			http.StatusRequestTimeout,
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+		RequestTimeout: 10 * time.Second,
+	}
+}
+
+// FetchResult is the outcome of a single http request
+type FetchResult struct {
+	Resp      *http.Response // Response, the body is already read and closed
+	Body      []byte         // Data read
+	Requested time.Time      // Start of the request
+	Ttfb      time.Duration  // Time to first byte
+	Total     time.Duration  // Time until the body was read completely
+	Attempts  int            // Number of attempts made up to this one
+}
+
+// Backoff returns the wait before retry number 'retry' (starting at 1), jitter applied, at most MaxBackoff
+func (rp *RetryPolicy) Backoff(retry int) time.Duration {
+	if retry < 1 {
+		return 0
+	}
+	wait := float64(rp.InitialBackoff) * math.Pow(max(rp.Multiplier, 1), float64(retry-1))
+	if rp.Jitter > 0 {
+		wait += wait * rp.Jitter * (2*rand.Float64() - 1)
+	}
+	if rp.MaxBackoff > 0 {
+		wait = min(wait, float64(rp.MaxBackoff))
+	}
+	return time.Duration(wait)
+}
+
+// IsRetriable returns true if a request with this status should be repeated
+func (rp *RetryPolicy) IsRetriable(status int) bool {
+	return slices.Contains(rp.RetryStatus, status)
+}
+
+// Do executes the request built by 'newRequest', retrying it according to the policy.
+// 'newRequest' is called for every attempt, 'onAttempt' (if not nil) after every attempt.
+// A non-retriable status is returned as result without error, the caller has to check it
+func (rp *RetryPolicy) Do(ctx context.Context, client *http.Client, newRequest func(ctx context.Context) (*http.Request, error), onAttempt func(*FetchResult, error)) (*FetchResult, error) {
+	attempts := max(rp.MaxAttempts, 1)
+	var res *FetchResult
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return res, ctx.Err()
+			case <-time.After(rp.Backoff(attempt - 1)):
+			}
+		}
+		res, err = rp.attempt(ctx, client, newRequest)
+		res.Attempts = attempt
+		if onAttempt != nil {
+			onAttempt(res, err)
+		}
+		if ctx.Err() != nil || errors.Is(err, errInvalidRequest) {
+			// Cancelled from outside or never sent, no retries
+			return res, err
+		}
+		if err == nil && !rp.IsRetriable(res.Resp.StatusCode) {
+			return res, nil
+		}
+	}
+	return res, err
+}
+
+// attempt does a single request with timeout
+func (rp *RetryPolicy) attempt(ctx context.Context, client *http.Client, newRequest func(ctx context.Context) (*http.Request, error)) (*FetchResult, error) {
+	if rp.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rp.RequestTimeout)
+		defer cancel()
+	}
+	res := &FetchResult{Requested: time.Now()}
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotFirstResponseByte: func() { res.Ttfb = time.Since(res.Requested) },
+	})
+	req, err := newRequest(ctx)
+	if err != nil {
+		return res, fmt.Errorf("%w: %w", errInvalidRequest, err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		res.Total = time.Since(res.Requested)
+		return res, err
+	}
+	defer resp.Body.Close()
+	res.Resp = resp
+	res.Body, err = io.ReadAll(resp.Body)
+	res.Total = time.Since(res.Requested)
+	return res, err
+}
+
+// Outcome classifies the final result of Do
+func Outcome(res *FetchResult, err error) string {
+	if err != nil || res == nil || res.Resp == nil || res.Resp.StatusCode >= http.StatusBadRequest {
+		return OutcomeFailed
+	}
+	if res.Attempts > 1 {
+		return OutcomeRetriedOk
+	}
+	return OutcomeOk
+}
+
+// reportOutcome exports and logs the result of a request with retries
+func (sc *StreamChecker) reportOutcome(kind, url string, res *FetchResult, err error) string {
+	outcome := Outcome(res, err)
+	prom.FetchOutcome.WithLabelValues(sc.name, kind, outcome).Inc()
+	if outcome != OutcomeOk {
+		attempts := 0
+		if res != nil {
+			attempts = res.Attempts
+		}
+		sc.checkerLog.LogFetchOutcome(kind, url, outcome, attempts)
+	}
+	return outcome
+}
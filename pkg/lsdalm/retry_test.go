@@ -0,0 +1,103 @@
+package lsdalm
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	rp := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+	}
+	var testdata = []struct {
+		retry  int
+		expect time.Duration
+	}{
+		{0, 0},
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{10, time.Second},
+	}
+	for _, elem := range testdata {
+		assert.Equal(t, elem.expect, rp.Backoff(elem.retry))
+	}
+
+	rp.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		b := rp.Backoff(1)
+		assert.GreaterOrEqual(t, b, 50*time.Millisecond)
+		assert.LessOrEqual(t, b, 150*time.Millisecond)
+		// Jitter does not exceed MaxBackoff
+		assert.LessOrEqual(t, rp.Backoff(10), time.Second)
+	}
+}
+
+func TestRetryDo(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/flaky":
+			if calls < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("data"))
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	rp := DefaultRetryPolicy()
+	rp.InitialBackoff = time.Millisecond
+	get := func(p string) func(ctx context.Context) (*http.Request, error) {
+		return func(ctx context.Context) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, "GET", server.URL+p, nil)
+		}
+	}
+
+	res, err := rp.Do(context.Background(), server.Client(), get("/flaky"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, res.Attempts)
+	assert.Equal(t, "data", string(res.Body))
+	assert.Equal(t, OutcomeRetriedOk, Outcome(res, err))
+
+	// Not retriable
+	calls = 0
+	res, err = rp.Do(context.Background(), server.Client(), get("/missing"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, OutcomeFailed, Outcome(res, err))
+
+	// The request cannot be built, no retries
+	calls = 0
+	var builds int
+	res, err = rp.Do(context.Background(), server.Client(), func(ctx context.Context) (*http.Request, error) {
+		builds++
+		return http.NewRequestWithContext(ctx, "GET", "http://[invalid", nil)
+	}, nil)
+	assert.ErrorIs(t, err, errInvalidRequest)
+	assert.Equal(t, 1, builds)
+	assert.Equal(t, 0, calls)
+	assert.Equal(t, OutcomeFailed, Outcome(res, err))
+
+	// Retriable, but always failing
+	calls = 0
+	res, err = rp.Do(context.Background(), server.Client(), get("/broken"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, rp.MaxAttempts, calls)
+	assert.Equal(t, http.StatusBadGateway, res.Resp.StatusCode)
+	assert.Equal(t, OutcomeFailed, Outcome(res, err))
+}
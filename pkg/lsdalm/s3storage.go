@@ -0,0 +1,395 @@
+package lsdalm
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3DefaultRegion = "us-east-1"
+	s3Service       = "s3"
+	s3TimeFormat    = "20060102T150405Z"
+	s3MaxErrorBody  = 512 // Bytes of an error response included in errors
+)
+
+// S3Storage stores in a bucket of an S3 compatible object store
+// Directories are key prefixes, objects are addressed path style
+type S3Storage struct {
+	endpoint     *url.URL
+	bucket       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+	now          func() time.Time // For signing, replaced in tests
+}
+
+// NewS3Storage returns a storage for bucket at endpoint (e.g. http://localhost:9000)
+func NewS3Storage(endpoint *url.URL, bucket, region, accessKey, secretKey string) *S3Storage {
+	return &S3Storage{
+		endpoint:  endpoint,
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: time.Minute},
+		now:       time.Now,
+	}
+}
+
+// NewS3StorageFromUrl returns a storage for s3://bucket/prefix?endpoint=...&region=...
+// Credentials are taken from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN,
+// region and endpoint default to AWS_REGION and AWS_ENDPOINT_URL
+func NewS3StorageFromUrl(u *url.URL) (*S3Storage, error) {
+	q := u.Query()
+	region := cmp.Or(q.Get("region"), os.Getenv("AWS_REGION"), s3DefaultRegion)
+	endpoint := cmp.Or(q.Get("endpoint"), os.Getenv("AWS_ENDPOINT_URL"), "https://s3."+region+".amazonaws.com")
+	eu, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for S3 storage")
+	}
+	st := NewS3Storage(eu, u.Host, region, accessKey, secretKey)
+	st.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	return st, nil
+}
+
+// key returns the object key of a name
+func (st *S3Storage) key(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// do sends a signed request for key, with query and body
+func (st *S3Storage) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *st.endpoint
+	u.Path = "/" + st.bucket
+	u.RawPath = "/" + awsEscape(st.bucket, false)
+	if key != "" {
+		u.Path += "/" + key
+		u.RawPath += "/" + awsEscape(key, false)
+	}
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	st.sign(req, body)
+	return st.client.Do(req)
+}
+
+// sign adds an AWS signature version 4 to req
+func (st *S3Storage) sign(req *http.Request, body []byte) {
+	now := st.now().UTC()
+	amzDate := now.Format(s3TimeFormat)
+	day := amzDate[:8]
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if st.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", st.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + st.region + "/" + s3Service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSha256([]byte("AWS4"+st.secretKey), day)
+	key = hmacSha256(key, st.region)
+	key = hmacSha256(key, s3Service)
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		st.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscape percent-encodes all but the unreserved characters, and '/' unless encodeSlash
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes query sorted by key, as needed for signing
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Error converts an unexpected response into an error, consuming the body
+func s3Error(op, name string, resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		io.Copy(io.Discard, resp.Body)
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, s3MaxErrorBody))
+	return &fs.PathError{Op: op, Path: name, Err: fmt.Errorf("S3 status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))}
+}
+
+func (st *S3Storage) ReadFile(name string) ([]byte, error) {
+	resp, err := st.do("GET", st.key(name), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error("read", name, resp)
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (st *S3Storage) WriteFile(name string, data []byte) error {
+	resp, err := st.do("PUT", st.key(name), nil, data)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("write", name, resp)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// s3ListResult is the response of ListObjectsV2
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+// list returns the objects and sub prefixes below prefix, fn is called for every page
+func (st *S3Storage) list(prefix, delimiter string, fn func(*s3ListResult)) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	for {
+		resp, err := st.do("GET", "", query, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return s3Error("list", prefix, resp)
+		}
+		var res s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		fn(&res)
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", res.NextContinuationToken)
+	}
+}
+
+func (st *S3Storage) ReadDir(name string) ([]fs.DirEntry, error) {
+	prefix := st.key(name)
+	if prefix != "" {
+		prefix += "/"
+	}
+	var entries []fs.DirEntry
+	err := st.list(prefix, "/", func(res *s3ListResult) {
+		for _, c := range res.Contents {
+			if n := strings.TrimPrefix(c.Key, prefix); n != "" {
+				entries = append(entries, s3FileInfo{name: n, size: c.Size, modTime: c.LastModified})
+			}
+		}
+		for _, p := range res.CommonPrefixes {
+			if n := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"); n != "" {
+				entries = append(entries, s3FileInfo{name: n, dir: true})
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+// Stat returns the object, or a directory if objects with the prefix exist
+func (st *S3Storage) Stat(name string) (fs.FileInfo, error) {
+	key := st.key(name)
+	resp, err := st.do("HEAD", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return s3FileInfo{name: path.Base(key), size: resp.ContentLength, modTime: modTime}, nil
+	case http.StatusNotFound:
+		if _, err := st.ReadDir(name); err != nil {
+			return nil, err
+		}
+		return s3FileInfo{name: path.Base(key), dir: true}, nil
+	default:
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fmt.Errorf("S3 status %d", resp.StatusCode)}
+	}
+}
+
+func (st *S3Storage) Remove(name string) error {
+	resp, err := st.do("DELETE", st.key(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error("remove", name, resp)
+	}
+	return resp.Body.Close()
+}
+
+func (st *S3Storage) RemoveAll(name string) error {
+	prefix := st.key(name) + "/"
+	var keys []string
+	err := st.list(prefix, "", func(res *s3ListResult) {
+		for _, c := range res.Contents {
+			keys = append(keys, c.Key)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := st.Remove(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *S3Storage) ServeFile(w http.ResponseWriter, r *http.Request, name string) {
+	resp, err := st.do("GET", st.key(name), nil, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := s3Error("serve", name, resp)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	http.ServeContent(w, r, name, modTime, bytes.NewReader(data))
+}
+
+// s3FileInfo is an object or prefix, it implements fs.FileInfo and fs.DirEntry
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi s3FileInfo) Name() string               { return fi.name }
+func (fi s3FileInfo) Size() int64                { return fi.size }
+func (fi s3FileInfo) ModTime() time.Time         { return fi.modTime }
+func (fi s3FileInfo) IsDir() bool                { return fi.dir }
+func (fi s3FileInfo) Sys() any                   { return nil }
+func (fi s3FileInfo) Type() fs.FileMode          { return fi.Mode().Type() }
+func (fi s3FileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+func (fi s3FileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
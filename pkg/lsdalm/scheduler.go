@@ -0,0 +1,287 @@
+package lsdalm
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jdeisenh/lsdalm/pkg/prom"
+)
+
+const (
+	FetchQueuePerRep = 2000             // Max number of queued segments per representation
+	seenSweepEvery   = 30 * time.Second // How often expired entries are removed from the seen map
+)
+
+// Reasons for dropping queued segments
+const (
+	DropFull     = "full"     // Evicted by a newer segment of a full queue
+	DropExpired  = "expired"  // Fell out of the fetch window while queued
+	DropShutdown = "shutdown" // Still queued when draining was cancelled
+)
+
+var (
+	errQueueClosed = errors.New("Queue closed")
+	errQueued      = errors.New("Already queued")
+)
+
+// repQueue holds the queued segments of one representation, sorted by At
+type repQueue struct {
+	segments []SegmentInfo
+}
+
+// FetchScheduler queues segments for the fetch workers
+// Segments are kept per representation in bounded queues. Init segments
+// are served first, then the newest segment of each representation in turn.
+// Segments older than 'window' are dropped
+type FetchScheduler struct {
+	channel   string
+	perRep    int
+	window    time.Duration
+	mutex     sync.Mutex
+	inits     []SegmentInfo        // Init segments, served before everything else
+	queues    map[string]*repQueue // Media segments by representation
+	order     []string             // Representations in round robin order
+	next      int                  // Next representation to serve
+	seen      map[string]time.Time // Paths already queued, with the time the entry can be forgotten, zero: never
+	lastSweep time.Time
+	length    int
+	dropped   map[string]int // Drop counts by reason
+	closed    bool
+	wake      chan struct{} // Signals queued segments to a waiting worker, which passes it on
+	done      chan struct{} // Closed on Close
+}
+
+// NewFetchScheduler creates a scheduler keeping up to perRep segments per representation
+// and dropping segments older than window (0: never)
+func NewFetchScheduler(channel string, perRep int, window time.Duration) *FetchScheduler {
+	return &FetchScheduler{
+		channel: channel,
+		perRep:  perRep,
+		window:  window,
+		queues:  make(map[string]*repQueue),
+		seen:    make(map[string]time.Time),
+		dropped: make(map[string]int),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// Push adds a segment. Segments queued before are ignored and return errQueued
+// If the queue of the representation is full, its oldest segment is dropped
+// Queued paths are remembered until a while after they were last pushed, that is after they
+// left the manifest, so a long DVR window without fetch window is not queued again
+func (fs *FetchScheduler) Push(seg SegmentInfo) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.closed {
+		return errQueueClosed
+	}
+	now := time.Now()
+	fs.sweep(now)
+	forget := now.Add(2 * max(fs.window, time.Minute))
+	if last, ok := fs.seen[seg.Url.Path]; ok {
+		if !last.IsZero() {
+			fs.seen[seg.Url.Path] = forget
+		}
+		return errQueued
+	}
+	if seg.At.IsZero() {
+		// Init segments are few and needed forever
+		fs.seen[seg.Url.Path] = time.Time{}
+		fs.inits = append(fs.inits, seg)
+	} else {
+		fs.seen[seg.Url.Path] = forget
+		q, ok := fs.queues[seg.RepId]
+		if !ok {
+			q = &repQueue{}
+			fs.queues[seg.RepId] = q
+			fs.order = append(fs.order, seg.RepId)
+		}
+		pos, _ := slices.BinarySearchFunc(q.segments, seg, func(a, b SegmentInfo) int { return a.At.Compare(b.At) })
+		q.segments = slices.Insert(q.segments, pos, seg)
+		if len(q.segments) > fs.perRep {
+			// Keep the newest
+			q.segments = q.segments[1:]
+			fs.length--
+			fs.drop(seg.RepId, DropFull, 1)
+		}
+		prom.FetchQueueDepth.WithLabelValues(fs.channel, seg.RepId).Set(float64(len(q.segments)))
+	}
+	fs.length++
+	fs.signal()
+	return nil
+}
+
+// signal wakes one waiting worker, if none is woken already
+func (fs *FetchScheduler) signal() {
+	select {
+	case fs.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Pop returns the next segment to fetch. It blocks until one is available
+// and returns false when the scheduler is closed and empty or ctx is cancelled
+func (fs *FetchScheduler) Pop(ctx context.Context) (SegmentInfo, bool) {
+	for {
+		fs.mutex.Lock()
+		seg, ok := fs.take(time.Now())
+		if ok && fs.length > 0 {
+			// Pass the wakeup on, a burst of pushes signals only once
+			fs.signal()
+		}
+		closed := fs.closed
+		fs.mutex.Unlock()
+		if ok {
+			return seg, true
+		}
+		if closed {
+			return SegmentInfo{}, false
+		}
+		select {
+		case <-fs.wake:
+		case <-fs.done:
+		case <-ctx.Done():
+			return SegmentInfo{}, false
+		}
+	}
+}
+
+// take removes the next segment from the queues, mutex must be held
+func (fs *FetchScheduler) take(now time.Time) (SegmentInfo, bool) {
+	if len(fs.inits) > 0 {
+		seg := fs.inits[0]
+		fs.inits = fs.inits[1:]
+		fs.length--
+		return seg, true
+	}
+	for range fs.order {
+		repId := fs.order[fs.next%len(fs.order)]
+		fs.next = (fs.next + 1) % len(fs.order)
+		q := fs.queues[repId]
+		fs.expire(repId, q, now)
+		if len(q.segments) == 0 {
+			continue
+		}
+		// Newest first
+		seg := q.segments[len(q.segments)-1]
+		q.segments = q.segments[:len(q.segments)-1]
+		fs.length--
+		prom.FetchQueueDepth.WithLabelValues(fs.channel, repId).Set(float64(len(q.segments)))
+		return seg, true
+	}
+	return SegmentInfo{}, false
+}
+
+// expire drops segments that fell out of the window, mutex must be held
+func (fs *FetchScheduler) expire(repId string, q *repQueue, now time.Time) {
+	if fs.window <= 0 {
+		return
+	}
+	cut := now.Add(-fs.window)
+	n := 0
+	for n < len(q.segments) && q.segments[n].At.Before(cut) {
+		n++
+	}
+	if n > 0 {
+		q.segments = q.segments[n:]
+		fs.length -= n
+		fs.drop(repId, DropExpired, n)
+		prom.FetchQueueDepth.WithLabelValues(fs.channel, repId).Set(float64(len(q.segments)))
+	}
+}
+
+// sweep forgets old entries of the seen map, mutex must be held
+func (fs *FetchScheduler) sweep(now time.Time) {
+	if now.Sub(fs.lastSweep) < seenSweepEvery {
+		return
+	}
+	fs.lastSweep = now
+	for p, forget := range fs.seen {
+		if !forget.IsZero() && forget.Before(now) {
+			delete(fs.seen, p)
+		}
+	}
+}
+
+// drop counts dropped segments, mutex must be held
+func (fs *FetchScheduler) drop(repId, reason string, n int) {
+	fs.dropped[reason] += n
+	prom.FetchQueueDropped.WithLabelValues(fs.channel, repId, reason).Add(float64(n))
+}
+
+// SetWindow changes the age above which queued segments are dropped (0: never)
+func (fs *FetchScheduler) SetWindow(window time.Duration) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.window = window
+}
+
+// Forget removes a path from the seen map, so it can be queued again
+func (fs *FetchScheduler) Forget(path string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	delete(fs.seen, path)
+}
+
+// ForgetInits removes all init segments from the seen map, so they are fetched again
+func (fs *FetchScheduler) ForgetInits() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	for p, forget := range fs.seen {
+		if forget.IsZero() {
+			delete(fs.seen, p)
+		}
+	}
+}
+
+// Len returns the number of queued segments
+func (fs *FetchScheduler) Len() int {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.length
+}
+
+// Dropped returns the drop counts by reason
+func (fs *FetchScheduler) Dropped() map[string]int {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	ret := make(map[string]int, len(fs.dropped))
+	for k, v := range fs.dropped {
+		ret[k] = v
+	}
+	return ret
+}
+
+// Close stops accepting segments. Queued segments can still be taken with Pop
+func (fs *FetchScheduler) Close() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if !fs.closed {
+		fs.closed = true
+		close(fs.done)
+	}
+}
+
+// DropAll empties all queues and returns the number of dropped segments
+func (fs *FetchScheduler) DropAll() int {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	n := fs.length
+	if len(fs.inits) > 0 {
+		fs.drop("", DropShutdown, len(fs.inits))
+		fs.inits = nil
+	}
+	for repId, q := range fs.queues {
+		if len(q.segments) > 0 {
+			fs.drop(repId, DropShutdown, len(q.segments))
+			q.segments = nil
+			prom.FetchQueueDepth.WithLabelValues(fs.channel, repId).Set(0)
+		}
+	}
+	fs.length = 0
+	return n
+}
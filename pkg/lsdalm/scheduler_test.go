@@ -0,0 +1,100 @@
+package lsdalm
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchScheduler(t *testing.T) {
+	now := time.Now()
+	seg := func(repId, p string, age time.Duration) SegmentInfo {
+		s := SegmentInfo{Url: &url.URL{Path: p}, RepId: repId}
+		if age >= 0 {
+			s.At = now.Add(-age)
+		}
+		return s
+	}
+	fs := NewFetchScheduler("test", 2, time.Minute)
+
+	assert.NoError(t, fs.Push(seg("v", "/v/1", 3*time.Second)))
+	assert.NoError(t, fs.Push(seg("v", "/v/2", 2*time.Second)))
+	assert.Equal(t, errQueued, fs.Push(seg("v", "/v/2", 2*time.Second)))
+	// Queue full, the oldest is evicted
+	assert.NoError(t, fs.Push(seg("v", "/v/3", time.Second)))
+	assert.NoError(t, fs.Push(seg("a", "/a/old", 2*time.Minute)))
+	assert.NoError(t, fs.Push(seg("a", "/a/1", time.Second)))
+	assert.NoError(t, fs.Push(seg("v", "/v/init", -1)))
+	assert.Equal(t, 5, fs.Len())
+
+	fs.Close()
+	assert.Equal(t, errQueueClosed, fs.Push(seg("v", "/v/4", 0)))
+
+	var order []string
+	for {
+		s, ok := fs.Pop(context.Background())
+		if !ok {
+			break
+		}
+		order = append(order, s.Url.Path)
+	}
+	// Init first, then newest per representation in turn
+	assert.Equal(t, []string{"/v/init", "/v/3", "/a/1", "/v/2"}, order)
+	assert.Equal(t, map[string]int{DropFull: 1, DropExpired: 1}, fs.Dropped())
+	assert.Equal(t, 0, fs.Len())
+
+	// Without window, old segments of the DVR window are remembered while pushed
+	fs = NewFetchScheduler("test", 2, 0)
+	assert.NoError(t, fs.Push(seg("v", "/v/old", time.Hour)))
+	assert.True(t, fs.seen["/v/old"].After(now))
+	fs.seen["/v/old"] = now.Add(time.Second)
+	assert.Equal(t, errQueued, fs.Push(seg("v", "/v/old", time.Hour)))
+	assert.True(t, fs.seen["/v/old"].After(now.Add(time.Minute)))
+}
+
+func TestFetchSchedulerWakesAll(t *testing.T) {
+	const workers = 8
+	fs := NewFetchScheduler("test", FetchQueuePerRep, 0)
+	got := make(chan string)
+	release := make(chan struct{})
+	for range workers {
+		go func() {
+			for {
+				s, ok := fs.Pop(context.Background())
+				if !ok {
+					return
+				}
+				// Busy until released, the others must fetch meanwhile
+				got <- s.Url.Path
+				<-release
+			}
+		}()
+	}
+	// Let the workers wait
+	time.Sleep(20 * time.Millisecond)
+	push := func(from, to int) {
+		for n := from; n < to; n++ {
+			assert.NoError(t, fs.Push(SegmentInfo{Url: &url.URL{Path: fmt.Sprintf("/v/%d", n)}, RepId: "v", At: time.Now()}))
+		}
+	}
+	timeout := time.After(2 * time.Second)
+	busy := func(n int) {
+		for i := range n {
+			select {
+			case <-got:
+			case <-timeout:
+				t.Fatalf("Only %d of %d workers busy", i, n)
+			}
+		}
+	}
+	push(0, 2*workers)
+	busy(workers)
+	// Busy workers return to a non-empty queue
+	close(release)
+	busy(workers)
+	fs.Close()
+}
@@ -0,0 +1,317 @@
+package lsdalm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ShapePathPrefix starts the path of a shaped session: /shape/<spec>/manifest.mpd
+// Segment URLs are relative to the manifest, so they are shaped too
+const ShapePathPrefix = "/shape/"
+
+// shapeSessionTimeout ends idle sessions, their schedule starts again on the next request
+const shapeSessionTimeout = 2 * time.Minute
+
+// ShapeStep is a section of a bandwidth schedule
+type ShapeStep struct {
+	Duration time.Duration // 0: until the end
+	Rate     int64         // Bit per second shared by all requests of the session, 0: unlimited
+	Latency  time.Duration // Added before every response
+}
+
+// shapeStepJson is the trace file representation of ShapeStep
+type shapeStepJson struct {
+	Duration string `json:"duration"`
+	Rate     string `json:"rate"`
+	Latency  string `json:"latency"`
+}
+
+// ShapeProfile is a bandwidth schedule, starting with the first request of a session
+// After the last step, it stays in effect
+type ShapeProfile []ShapeStep
+
+// ParseBitrate parses a rate in bit/s with optional k, M or G suffix (powers of 1000)
+func ParseBitrate(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "bit")
+	mult := int64(1)
+	for i, suffix := range []string{"k", "M", "G"} {
+		if strings.HasSuffix(s, suffix) || strings.HasSuffix(s, strings.ToUpper(suffix)) {
+			s = s[:len(s)-1]
+			mult = []int64{1e3, 1e6, 1e9}[i]
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("Negative rate %s", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// ParseShapeSpec parses a comma separated list of trace names and rate=, latency= settings, e.g.
+// "rate=4M,latency=50ms" or "stepdown". Settings apply to all steps; id= distinguishes sessions of one client
+func ParseShapeSpec(spec string, traces map[string]ShapeProfile) (ShapeProfile, error) {
+	profile := ShapeProfile{{}}
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(item, "=")
+		if !ok {
+			trace, found := traces[item]
+			if !found {
+				return nil, fmt.Errorf("Unknown shaping trace %q", item)
+			}
+			profile = append(ShapeProfile{}, trace...)
+			continue
+		}
+		var err error
+		switch key {
+		case "rate":
+			var rate int64
+			rate, err = ParseBitrate(value)
+			for i := range profile {
+				profile[i].Rate = rate
+			}
+		case "latency":
+			var latency time.Duration
+			latency, err = time.ParseDuration(value)
+			for i := range profile {
+				profile[i].Latency = latency
+			}
+		case "id":
+		default:
+			err = fmt.Errorf("Unknown key, use one of rate, latency, id")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Shaping %s: %w", key, err)
+		}
+	}
+	return profile, nil
+}
+
+// LoadShapeTraces reads bandwidth schedules from a JSON object mapping names to lists of steps,
+// e.g. {"stepdown": [{"duration": "30s", "rate": "8M"}, {"rate": "1M", "latency": "100ms"}]}
+func LoadShapeTraces(filename string) (map[string]ShapeProfile, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var traces map[string][]shapeStepJson
+	if err := json.Unmarshal(buf, &traces); err != nil {
+		return nil, err
+	}
+	profiles := make(map[string]ShapeProfile, len(traces))
+	for name, steps := range traces {
+		if strings.ContainsAny(name, ",=/") || len(steps) == 0 {
+			return nil, fmt.Errorf("Invalid shaping trace %q", name)
+		}
+		profile := make(ShapeProfile, len(steps))
+		for i, step := range steps {
+			if step.Duration != "" {
+				profile[i].Duration, err = time.ParseDuration(step.Duration)
+			}
+			if err == nil && step.Rate != "" {
+				profile[i].Rate, err = ParseBitrate(step.Rate)
+			}
+			if err == nil && step.Latency != "" {
+				profile[i].Latency, err = time.ParseDuration(step.Latency)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Shaping trace %s step %d: %w", name, i, err)
+			}
+		}
+		profiles[name] = profile
+	}
+	return profiles, nil
+}
+
+// shapeSession shares the bandwidth of a profile between the requests of one client
+type shapeSession struct {
+	profile ShapeProfile
+	logger  zerolog.Logger
+
+	mutex    sync.Mutex
+	start    time.Time
+	lastSeen time.Time
+	next     time.Time // End of the transmissions reserved so far
+	stepIdx  int
+}
+
+// newShapeSession starts the schedule of profile now
+func newShapeSession(profile ShapeProfile, logger zerolog.Logger) *shapeSession {
+	now := time.Now()
+	return &shapeSession{profile: profile, logger: logger, start: now, lastSeen: now, next: now, stepIdx: -1}
+}
+
+// step returns the step in effect at now. Must be called with mutex held
+func (ss *shapeSession) step(now time.Time) ShapeStep {
+	elapsed := now.Sub(ss.start)
+	idx := len(ss.profile) - 1
+	for i, step := range ss.profile {
+		if step.Duration <= 0 || elapsed < step.Duration {
+			idx = i
+			break
+		}
+		elapsed -= step.Duration
+	}
+	if idx != ss.stepIdx {
+		ss.stepIdx = idx
+		ss.logger.Info().Int("step", idx).Int64("rate", ss.profile[idx].Rate).
+			Dur("latency", ss.profile[idx].Latency).Msg("Shaping")
+	}
+	return ss.profile[idx]
+}
+
+// latency returns the current latency and marks the session as used
+func (ss *shapeSession) latency() time.Duration {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.lastSeen = time.Now()
+	return ss.step(ss.lastSeen).Latency
+}
+
+// reserve books the transmission of n bytes and returns when it is done
+func (ss *shapeSession) reserve(n int) time.Time {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	now := time.Now()
+	ss.lastSeen = now
+	rate := ss.step(now).Rate
+	if rate <= 0 {
+		return now
+	}
+	if ss.next.Before(now) {
+		ss.next = now
+	}
+	ss.next = ss.next.Add(time.Duration(float64(n) * 8 / float64(rate) * float64(time.Second)))
+	return ss.next
+}
+
+// shapedWriter paces the body by the bandwidth of its session
+type shapedWriter struct {
+	http.ResponseWriter
+	sess *shapeSession
+	ctx  context.Context
+}
+
+// shapeChunk is the amount written between pauses
+const shapeChunk = 16 * 1024
+
+func (sw *shapedWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), shapeChunk)]
+		due := sw.sess.reserve(len(chunk))
+		n, err := sw.ResponseWriter.Write(chunk)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+		if wait := time.Until(due); wait > 0 {
+			if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+				f.Flush()
+			}
+			if err := sleepContext(sw.ctx, wait); err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+// sleepContext waits d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shaper emulates network conditions for sessions below ShapePathPrefix
+type Shaper struct {
+	traces map[string]ShapeProfile
+	logger zerolog.Logger
+
+	mutex    sync.Mutex
+	sessions map[string]*shapeSession // By spec and client address
+}
+
+// NewShaper creates a Shaper with named traces, which may be nil
+func NewShaper(traces map[string]ShapeProfile, logger zerolog.Logger) *Shaper {
+	return &Shaper{traces: traces, logger: logger, sessions: make(map[string]*shapeSession)}
+}
+
+// session returns the running session for spec and client, or starts one
+func (sh *Shaper) session(spec string, r *http.Request) (*shapeSession, error) {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	key := spec + " " + client
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	if ss, ok := sh.sessions[key]; ok {
+		ss.mutex.Lock()
+		idle := time.Since(ss.lastSeen)
+		ss.mutex.Unlock()
+		if idle < shapeSessionTimeout {
+			return ss, nil
+		}
+	}
+	profile, err := ParseShapeSpec(spec, sh.traces)
+	if err != nil {
+		return nil, err
+	}
+	// Forget idle sessions
+	for k, ss := range sh.sessions {
+		ss.mutex.Lock()
+		idle := time.Since(ss.lastSeen)
+		ss.mutex.Unlock()
+		if idle >= shapeSessionTimeout {
+			delete(sh.sessions, k)
+		}
+	}
+	ss := newShapeSession(profile, sh.logger.With().Str("shape", spec).Str("client", client).Logger())
+	sh.sessions[key] = ss
+	return ss, nil
+}
+
+// Wrap returns a handler serving the paths below ShapePathPrefix from next, shaped
+func (sh *Shaper) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spec, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, ShapePathPrefix), "/")
+		ss, err := sh.session(spec, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := sleepContext(r.Context(), ss.latency()); err != nil {
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = "/" + rest
+		r2.URL.RawPath = ""
+		next.ServeHTTP(&shapedWriter{ResponseWriter: w, sess: ss, ctx: r.Context()}, r2)
+	})
+}
@@ -0,0 +1,81 @@
+package lsdalm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBitrate(t *testing.T) {
+	var testdata = []struct {
+		in     string
+		expect int64
+	}{
+		{"800", 800},
+		{"500k", 500000},
+		{"2.5M", 2500000},
+		{"1Gbit", 1000000000},
+	}
+	for _, elem := range testdata {
+		rate, err := ParseBitrate(elem.in)
+		assert.NoError(t, err)
+		assert.Equal(t, elem.expect, rate, elem.in)
+	}
+	_, err := ParseBitrate("fast")
+	assert.Error(t, err)
+}
+
+func TestShapeTraces(t *testing.T) {
+	filename := path.Join(t.TempDir(), "traces.json")
+	os.WriteFile(filename, []byte(`{"stepdown": [{"duration": "10s", "rate": "8M"}, {"rate": "1M", "latency": "100ms"}]}`), 0644)
+	traces, err := LoadShapeTraces(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, ShapeProfile{{Duration: 10 * time.Second, Rate: 8e6}, {Rate: 1e6, Latency: 100 * time.Millisecond}}, traces["stepdown"])
+
+	profile, err := ParseShapeSpec("stepdown,latency=20ms,id=p1", traces)
+	assert.NoError(t, err)
+	ss := newShapeSession(profile, zerolog.Nop())
+	assert.Equal(t, int64(8e6), ss.step(ss.start.Add(9*time.Second)).Rate)
+	assert.Equal(t, int64(1e6), ss.step(ss.start.Add(11*time.Second)).Rate)
+	assert.Equal(t, 20*time.Millisecond, ss.step(ss.start.Add(time.Hour)).Latency)
+
+	_, err = ParseShapeSpec("rate=1M,jitter=5ms", traces)
+	assert.Error(t, err)
+}
+
+func TestShaper(t *testing.T) {
+	body := strings.Repeat("x", 25000)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/seg.m4s", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+	sh := NewShaper(nil, zerolog.Nop())
+	shaped := sh.Wrap(mux)
+
+	w := httptest.NewRecorder()
+	shaped.ServeHTTP(w, httptest.NewRequest("GET", "/shape/rate=80M,latency=5ms/seg.m4s", nil))
+	assert.Equal(t, body, w.Body.String())
+
+	// Requests of a client share the session: at 800 kbit/s, each body is due 250ms after the one before
+	ss, err := sh.session("rate=800k,latency=50ms", httptest.NewRequest("GET", "/", nil))
+	assert.NoError(t, err)
+	other, err := sh.session("rate=800k,latency=50ms", httptest.NewRequest("GET", "/", nil))
+	assert.NoError(t, err)
+	assert.Same(t, ss, other)
+	assert.Equal(t, 50*time.Millisecond, ss.latency())
+	before := time.Now()
+	first := ss.reserve(len(body))
+	assert.WithinRange(t, first, before.Add(250*time.Millisecond), time.Now().Add(250*time.Millisecond))
+	assert.Equal(t, 250*time.Millisecond, other.reserve(len(body)).Sub(first))
+
+	w = httptest.NewRecorder()
+	shaped.ServeHTTP(w, httptest.NewRequest("GET", "/shape/unknown/seg.m4s", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,98 @@
+package lsdalm
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// Storage holds recordings: metadata, manifests and media segments
+// Names are slash separated paths; for local storage they are file system paths
+type Storage interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte) error   // Creates missing parent directories
+	ReadDir(name string) ([]fs.DirEntry, error) // Sorted by name
+	Stat(name string) (fs.FileInfo, error)
+	Remove(name string) error
+	RemoveAll(name string) error
+	ServeFile(w http.ResponseWriter, r *http.Request, name string)
+}
+
+// OpenStorage returns the storage for spec and the path of spec within it
+// spec is a local directory or s3://bucket/prefix, see NewS3StorageFromUrl for options
+func OpenStorage(spec string) (Storage, string, error) {
+	if !strings.HasPrefix(spec, "s3://") {
+		return LocalStorage{}, spec, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Host == "" {
+		return nil, "", errors.New("No bucket in storage URL")
+	}
+	st, err := NewS3StorageFromUrl(u)
+	if err != nil {
+		return nil, "", err
+	}
+	return st, strings.Trim(u.Path, "/"), nil
+}
+
+// walkStorage calls fn for all files below dir, in name order
+func walkStorage(store Storage, dir string, fn func(name string, info fs.FileInfo)) error {
+	entries, err := store.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := path.Join(dir, e.Name())
+		if e.IsDir() {
+			if err := walkStorage(store, name, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			fn(name, info)
+		}
+	}
+	return nil
+}
+
+// LocalStorage stores in the local file system
+type LocalStorage struct{}
+
+func (LocalStorage) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (LocalStorage) WriteFile(name string, data []byte) error {
+	if err := os.MkdirAll(path.Dir(name), 0777); err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0644)
+}
+
+func (LocalStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (LocalStorage) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (LocalStorage) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (LocalStorage) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (LocalStorage) ServeFile(w http.ResponseWriter, r *http.Request, name string) {
+	http.ServeFile(w, r, name)
+}
@@ -1,9 +1,49 @@
 package lsdalm
 
+import (
+	"cmp"
+	"encoding/json"
+	"path"
+	"time"
+)
+
 // The format of the meta.json we store with the data
 const StorageMetaFileName = "meta.json"
 
 type StorageMeta struct {
-	ManifestUrl string // Original manifest URL
-	HaveMedia   bool   // Flag if we mirrored the media or not
+	ManifestUrl  string       // Original manifest URL
+	HaveMedia    bool         // Flag if we mirrored the media or not
+	Created      time.Time    // Start of the recording (zero in old recordings)
+	RetainedFrom time.Time    // Oldest manifest kept by retention, zero if nothing was deleted
+	Previous     string       // Directory of the recording before rotation, if any
+	Next         string       // Directory of the recording after rotation, if any
+	Filter       *TrackFilter `json:",omitempty"` // Tracks recorded, nil for all
+	MediaUrl     string       `json:",omitempty"` // Manifest URL of the session opened by ManifestUrl, if any
+	FetchWindow  *Duration    `json:",omitempty"` // Segments fetched behind the live edge, 0 for all, nil if unknown
+	Backfill     bool         `json:",omitempty"` // The DVR window of the first manifest was fetched
+}
+
+// MediaBase returns the URL the media of the stored manifests resolves against
+func (m StorageMeta) MediaBase() string {
+	return cmp.Or(m.MediaUrl, m.ManifestUrl)
+}
+
+// ReadStorageMeta reads the metadata of the recording in dumpdir
+func ReadStorageMeta(store Storage, dumpdir string) (StorageMeta, error) {
+	var m StorageMeta
+	mf, err := store.ReadFile(path.Join(dumpdir, StorageMetaFileName))
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(mf, &m)
+	return m, err
+}
+
+// WriteStorageMeta stores the metadata of the recording in dumpdir
+func WriteStorageMeta(store Storage, dumpdir string, m StorageMeta) error {
+	metaJson, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return store.WriteFile(path.Join(dumpdir, StorageMetaFileName), metaJson)
 }
@@ -2,17 +2,17 @@ package lsdalm
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"math"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Eyevinn/mp4ff/mp4"
@@ -23,13 +23,12 @@ import (
 const (
 	ManifestPath     = "manifests"                         // subdirectory name for manifests
 	ManifestFormat   = "manifest-2006-01-02T15:04:05Z.mpd" // time format for filenames
-	FetchQueueSize   = 50000                               // Max number of outstanding requests in queue
 	maxGapLog        = 100 * time.Millisecond              // Warn above this gap length
 	dateShortFmt     = "15:04:05.00"                       // Used in logging dates
 	SchemeScteXml    = "urn:scte:scte35:2014:xml+bin"      // The one scte scheme we support right now
 	DefaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/130.0.0.0 Safari/537.36"
 	maxTimeDiff      = 100 * time.Millisecond // What segment duration/offset we tolerate before warning (due to rounding errors)
-	cutSegmentsAt    = 5 * time.Minute        // Fetch only segments within this range of Now
+	fetchWindow      = 5 * time.Minute        // Default range of Now in which segments are fetched
 )
 
 // Modes support for checking media segments
@@ -45,25 +44,42 @@ type FetchMode int
 
 // URL and data to verify for a single segment
 type SegmentInfo struct {
-	Url  *url.URL      // URL to fetch
-	T, D time.Duration // Time, Duration in Segment (PTS, from Period Start
+	Url       *url.URL      // URL to fetch
+	T, D      time.Duration // Time, Duration in Segment (PTS, from Period Start
+	RepId     string        // Representation the segment belongs to
+	Track     string        // Track (AdaptationSet) the segment belongs to
+	At        time.Time     // Wall clock start of the segment, zero for init segments
+	Available time.Time     // Wall clock time the segment is complete
 }
 
 type StreamChecker struct {
 	name            string                    // Name, display only
 	sourceUrl       *url.URL                  // Manifest source URL
+	store           Storage                   // Storage of the recordings
+	dumpbase        string                    // Directory holding all recordings
 	dumpdir         string                    // Directory we write manifests and segments
 	manifestDir     string                    // Subdirectory of above for manifests
+	dirMutex        sync.RWMutex              // Protects dumpdir and manifestDir, changed on rotation
+	storageMeta     StorageMeta               // Metadata of the current recording
+	manifestWriter  *manifestWriter           // Stores manifests in the configured format
+	retention       *RetentionPolicy          // Retention and rotation of recordings, if enabled
+	rotatedAt       time.Time                 // Start of the current rotation interval
+	filter          *TrackFilter              // Tracks and representations to record, nil for all
+	cutSegmentsAt   time.Duration             // Fetch only segments within this range of Now, 0: all
+	backfill        *backfill                 // Fetches the DVR window of the first manifest, if enabled
 	userAgent       string                    // Agent used in outgoing http
 	updateFreq      time.Duration             // Update freq for manifests
-	fetchqueue      chan SegmentInfo          // Buffered chan for async media segment requests
-	done            chan struct{}             // Chan to stop background goroutines
+	scheduler       *FetchScheduler           // Queue for async media segment requests
+	fetchCtx        context.Context           // Context of segment requests, cancelled when draining times out
+	cancelFetch     context.CancelFunc        // Cancels fetchCtx
+	workers         sync.WaitGroup            // Running fetch workers
+	queued          atomic.Int64              // Segments added to the fetch queue
+	completed       atomic.Int64              // Segments fetched successfully
+	failed          atomic.Int64              // Segments fetched without success
 	ticker          *time.Ticker              // Ticker for timing manifest requests
 	fetchMode       FetchMode                 // Media segment fetch mode: one of MODE_
 	logger          zerolog.Logger            // Logger instance
 	client          *http.Client              // Client to do http with
-	haveMap         map[string]bool           // Map of requests in queue (to avoid adding them several times)
-	haveMutex       sync.Mutex                // Mutex protecting the haveMap
 	onFetch         []func(string, time.Time) // Callbacks to be execute on manifest storage
 	initialPeriod   *mpd.Period               // The first period ever fetched, stream format of initial period
 	upcomingSplices SpliceList                // SCTE-Markers announced
@@ -71,6 +87,9 @@ type StreamChecker struct {
 	mpdDiffer       *MpdDiffer                // compare new to last mpd and trigger events
 	lastNewMpd      time.Time                 // time of last update of mpd
 	checkerLog      CheckerLogger             // logging strategy (text or json)
+	fetchStats      *FetchStats               // per representation segment fetch statistics
+	retryPolicy     RetryPolicy               // retries for manifest and segment requests
+	availability    *AvailabilityChecker      // probes new segments around availability time, if enabled
 }
 
 // CheckerLogger abstracts text vs JSON logging
@@ -82,24 +101,33 @@ type CheckerLogger interface {
 	LogNoUpdate(since time.Duration)
 	LogManifest(m *ManifestLog)
 	LogPollFailure(err error, consecutive int)
+	LogSegmentFetch(rec *SegmentFetchRecord)
+	LogFetchStats(stats []RepFetchStats)
+	LogFetchOutcome(kind, url, outcome string, attempts int)
+	LogAvailability(track, url, result string, delay time.Duration)
+	LogAvailabilityStats(stats []TrackAvailability)
 }
 
 func NewStreamChecker(name, source, dumpbase string, updateFreq time.Duration, fetchMode FetchMode, logger zerolog.Logger, workers int, nodate bool, checkerLog CheckerLogger) (*StreamChecker, error) {
 
 	st := &StreamChecker{
-		name:       name,
-		updateFreq: updateFreq,
-		fetchqueue: make(chan SegmentInfo, FetchQueueSize),
-		logger:     logger.With().Str("channel", name).Logger(),
-		done:       make(chan struct{}),
-		fetchMode:  fetchMode,
+		name:           name,
+		store:          LocalStorage{},
+		dumpbase:       dumpbase,
+		updateFreq:     updateFreq,
+		scheduler:      NewFetchScheduler(name, FetchQueuePerRep, fetchWindow),
+		manifestWriter: newManifestWriter(ManifestPlain),
+		cutSegmentsAt:  fetchWindow,
+		logger:         logger.With().Str("channel", name).Logger(),
+		fetchMode:      fetchMode,
 		client: &http.Client{
 			Transport: &http.Transport{},
 		},
-		haveMap:    make(map[string]bool),
-		userAgent:  DefaultUserAgent,
-		mpdDiffer:  NewMpdDiffer(logger),
-		checkerLog: checkerLog,
+		userAgent:   DefaultUserAgent,
+		mpdDiffer:   NewMpdDiffer(logger),
+		checkerLog:  checkerLog,
+		fetchStats:  NewFetchStats(name),
+		retryPolicy: DefaultRetryPolicy(),
 	}
 	var err error
 	st.sourceUrl, err = url.Parse(source)
@@ -109,13 +137,18 @@ func NewStreamChecker(name, source, dumpbase string, updateFreq time.Duration, f
 	// Create a storage directory from dumpdir, name, and optionally date and version
 	var dumpdir string
 	if dumpbase != "" {
+		st.store, st.dumpbase, err = OpenStorage(dumpbase)
+		if err != nil {
+			return nil, err
+		}
+		dumpbase = st.dumpbase
 		if nodate {
 			dumpdir = path.Join(dumpbase, name)
 		} else {
 			version := ""
 			for versioncount := 0; versioncount < 20; versioncount++ {
 				dumpdir = path.Join(dumpbase, name+"-"+time.Now().Format("2006-01-02")+version)
-				if _, e := os.Stat(dumpdir); e != nil {
+				if _, e := st.store.Stat(dumpdir); e != nil {
 					break
 				}
 				logger.Debug().Msgf("Directory %s exists", dumpdir)
@@ -124,34 +157,18 @@ func NewStreamChecker(name, source, dumpbase string, updateFreq time.Duration, f
 			}
 		}
 	}
-	st.dumpdir = dumpdir
-	st.manifestDir = path.Join(dumpdir, ManifestPath)
-
 	// Create dump directory if requested
 	if dumpdir != "" {
-		logger.Info().Msgf("Storing manifests in %s", dumpdir)
-		// Create directory
-		if err := os.MkdirAll(st.manifestDir, 0777); err != nil {
-			return nil, errors.New("Cannot create directory")
-		}
-		// Store Metadata
-		m := StorageMeta{
-			ManifestUrl: st.sourceUrl.String(),
-			HaveMedia:   fetchMode >= MODE_STORE,
-		}
-		metaJson, err := json.Marshal(m)
-		if err != nil {
-			return st, err
-		}
-		err = os.WriteFile(path.Join(st.dumpdir, StorageMetaFileName), metaJson, 0666)
-		if err != nil {
+		if err := st.createDumpDir(dumpdir, ""); err != nil {
 			return st, err
 		}
 	}
 
 	// Start workers
+	st.fetchCtx, st.cancelFetch = context.WithCancel(context.Background())
 	if fetchMode >= MODE_ACCESS {
 		for w := 0; w < workers; w++ {
+			st.workers.Add(1)
 			go st.fetcher()
 		}
 	}
@@ -211,9 +228,51 @@ func (sc *StreamChecker) checkTrackAlignment(period *mpd.Period) {
 
 }
 
-// GetDumpDir() returns the filesystem path where manifests and segments are stored
+// GetStorage returns the storage of the recordings
+func (sc *StreamChecker) GetStorage() Storage {
+	return sc.store
+}
+
+// GetDumpDir() returns the path in storage where manifests and segments are stored
 func (sc *StreamChecker) GetDumpDir() string {
-	return sc.dumpdir
+	return sc.storageDir()
+}
+
+// SetHttpConfig replaces the http client by one with headers, TLS, proxy and token settings applied
+func (sc *StreamChecker) SetHttpConfig(hc *HttpConfig) error {
+	client, err := hc.NewClient(0)
+	if err != nil {
+		return err
+	}
+	sc.client = client
+	if hc.UserAgent != "" {
+		sc.userAgent = hc.UserAgent
+	}
+	return nil
+}
+
+// SetManifestFormat selects how manifests are stored: plain, gzip, zstd or delta
+func (sc *StreamChecker) SetManifestFormat(format string) error {
+	if err := ValidManifestFormat(format); err != nil {
+		return err
+	}
+	sc.manifestWriter.format = format
+	return nil
+}
+
+// EnableManifestDedup stores manifests identical to the previous one only as entry in the manifest index
+func (sc *StreamChecker) EnableManifestDedup() {
+	sc.manifestWriter.dedup = true
+}
+
+// SetRetryPolicy replaces the retry policy for manifest and segment requests
+func (sc *StreamChecker) SetRetryPolicy(rp RetryPolicy) {
+	sc.retryPolicy = rp
+}
+
+// EnableAvailabilityCheck starts probing every newly announced segment around its availability time
+func (sc *StreamChecker) EnableAvailabilityCheck() {
+	sc.availability = NewAvailabilityChecker(sc)
 }
 
 // AddFetchCallback adds a callback executed on manifest storage
@@ -221,59 +280,103 @@ func (sc *StreamChecker) AddFetchCallback(f func(string, time.Time)) {
 	sc.onFetch = append(sc.onFetch, f)
 }
 
-func (sc *StreamChecker) fetchAndStoreSegment(url *url.URL, t, d time.Duration) error {
-	return sc.fetchAndStoreSegmentS(SegmentInfo{
-		Url: url,
-		T:   t,
-		D:   d,
-	})
+// createDumpDir creates a recording directory and stores its metadata
+// previous is the directory of the recording it continues, if rotated
+func (sc *StreamChecker) createDumpDir(dumpdir, previous string) error {
+	sc.logger.Info().Msgf("Storing manifests in %s", dumpdir)
+	manifestDir := path.Join(dumpdir, ManifestPath)
+	manifestUrl := sc.sourceUrl.String()
+	if sc.storageMeta.ManifestUrl != "" {
+		// Keep the original URL, not a session URL
+		manifestUrl = sc.storageMeta.ManifestUrl
+	}
+	window := Duration(sc.cutSegmentsAt)
+	m := StorageMeta{
+		ManifestUrl: manifestUrl,
+		HaveMedia:   sc.fetchMode >= MODE_STORE,
+		Created:     time.Now(),
+		Previous:    previous,
+		Filter:      sc.filter,
+		FetchWindow: &window,
+		// Only the first recording is backfilled
+		Backfill: sc.backfill != nil && previous == "",
+	}
+	if mediaUrl := sc.sourceUrl.String(); mediaUrl != manifestUrl {
+		m.MediaUrl = mediaUrl
+	}
+	if err := WriteStorageMeta(sc.store, dumpdir, m); err != nil {
+		return fmt.Errorf("Cannot create recording: %w", err)
+	}
+	sc.dirMutex.Lock()
+	sc.dumpdir = dumpdir
+	sc.manifestDir = manifestDir
+	sc.storageMeta = m
+	sc.dirMutex.Unlock()
+	return nil
 }
 
-// fetchAndStoreSegment queues an URL for fetching
-func (sc *StreamChecker) fetchAndStoreSegmentS(fetchthis SegmentInfo) error {
+// SetTrackFilter restricts fetching and stored manifests to the matching tracks
+func (sc *StreamChecker) SetTrackFilter(tf *TrackFilter) error {
+	if tf.IsEmpty() {
+		tf = nil
+	}
+	sc.filter = tf
+	return sc.updateStorageMeta(func(m *StorageMeta) { m.Filter = tf })
+}
 
-	// Check what we already have.
-	// This does not handle errors, retries, everything else
-	sc.haveMutex.Lock()
-	if _, ok := sc.haveMap[fetchthis.Url.Path]; ok {
-		sc.haveMutex.Unlock()
-		// Don't fetch again
-		sc.logger.Trace().Msgf("Already in queue%s", fetchthis.Url.Path)
+// updateStorageMeta changes and writes the metadata of the current recording, if any
+func (sc *StreamChecker) updateStorageMeta(update func(m *StorageMeta)) error {
+	dumpdir := sc.storageDir()
+	if dumpdir == "" {
 		return nil
 	}
-	sc.haveMutex.Unlock()
+	sc.dirMutex.Lock()
+	update(&sc.storageMeta)
+	m := sc.storageMeta
+	sc.dirMutex.Unlock()
+	return WriteStorageMeta(sc.store, dumpdir, m)
+}
 
-	localpath := path.Join(sc.dumpdir, fetchthis.Url.Path)
-	_, err := os.Stat(localpath)
+// storageDir returns the current recording directory
+func (sc *StreamChecker) storageDir() string {
+	sc.dirMutex.RLock()
+	defer sc.dirMutex.RUnlock()
+	return sc.dumpdir
+}
+
+// fetchAndStoreSegment queues an URL for fetching
+func (sc *StreamChecker) fetchAndStoreSegment(fetchthis SegmentInfo) error {
+
+	localpath := path.Join(sc.storageDir(), fetchthis.Url.Path)
+	_, err := sc.store.Stat(localpath)
 	if err == nil {
 		// Assume file exists
 		sc.logger.Debug().Msgf("Have file %s", fetchthis.Url.Path)
 		return nil
 	}
-	sc.logger.Debug().Int("QL", len(sc.fetchqueue)).Msg("Queue size")
 	// Queue request
-	select {
-	case sc.fetchqueue <- fetchthis:
-		sc.haveMutex.Lock()
-		sc.haveMap[fetchthis.Url.Path] = true
-		sc.haveMutex.Unlock()
+	switch err := sc.scheduler.Push(fetchthis); err {
+	case nil:
+		sc.queued.Add(1)
+		return nil
+	case errQueued:
+		// Don't fetch again
+		sc.logger.Trace().Msgf("Already in queue %s", fetchthis.Url.Path)
 		return nil
 	default:
-		// That happens in batches, should probably be rate limited
-		//sc.logger.Error().Msg("Queue full")
-		return errors.New("Queue full")
+		return err
 	}
 }
 
 // executeFetchAndStore gets a segment and stores it
-func (sc *StreamChecker) executeFetchAndStore(fetchme SegmentInfo) error {
+func (sc *StreamChecker) executeFetchAndStore(ctx context.Context, fetchme SegmentInfo) error {
 
 	// Create path
 	localpath := ""
+	dumpdir := sc.storageDir()
 	if sc.fetchMode >= MODE_STORE {
-		localpath = path.Join(sc.dumpdir, fetchme.Url.Path)
-		os.MkdirAll(path.Dir(localpath), 0777)
-		_, err := os.Stat(localpath)
+		localpath = path.Join(dumpdir, fetchme.Url.Path)
+		_, err := sc.store.Stat(localpath)
 		if err == nil {
 			// Assume file exists
 			return nil
@@ -284,35 +387,28 @@ func (sc *StreamChecker) executeFetchAndStore(fetchme SegmentInfo) error {
 	if sc.fetchMode > MODE_ACCESS {
 		mode = "GET"
 	}
-	req, err := http.NewRequest(mode, fetchme.Url.String(), nil)
-	if err != nil {
-		sc.logger.Warn().Err(err).Str("url", fetchme.Url.String()).Msg("Create Request")
-		// Handle error
-		return err
-	}
-
-	// Set a (fixed) User Agent, there are sources disciminiating Agents
-	req.Header.Set("User-Agent", sc.userAgent)
-
-	resp, err := sc.client.Do(req)
+	res, err := sc.retryPolicy.Do(ctx, sc.client, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, mode, fetchme.Url.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		// Set a (fixed) User Agent, there are sources disciminiating Agents
+		req.Header.Set("User-Agent", sc.userAgent)
+		return req, nil
+	}, func(res *FetchResult, err error) {
+		sc.recordFetch(NewSegmentFetchRecord(fetchme, res.Resp, res.Requested, res.Ttfb, res.Total, int64(len(res.Body))))
+	})
+	outcome := sc.reportOutcome("segment", fetchme.Url.String(), res, err)
+	sc.fetchStats.AddOutcome(fetchme.RepId, outcome)
 	if err != nil {
 		sc.logger.Warn().Err(err).Str("url", fetchme.Url.String()).Msg("Fetch Segment")
 		// Handle error
 		return err
 	}
-
-	if resp.Body != nil {
-		defer resp.Body.Close()
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		sc.logger.Error().Err(err).Str("url", fetchme.Url.String()).Msg("Read Segment data")
-		return err
-	}
-	if resp.StatusCode != http.StatusOK {
-		sc.logger.Warn().Str("Segment", fetchme.Url.String()).Int("status", resp.StatusCode).Msg("Status")
-		return errors.New("Not successful")
+	body := res.Body
+	if res.Resp.StatusCode != http.StatusOK {
+		sc.logger.Warn().Str("Segment", fetchme.Url.String()).Int("status", res.Resp.StatusCode).Msg("Status")
+		return errNotSuccessful
 	}
 	// Check the segment
 	if sc.fetchMode >= MODE_VERIFY {
@@ -345,8 +441,8 @@ func (sc *StreamChecker) executeFetchAndStore(fetchme SegmentInfo) error {
 		}
 	}
 	sc.logger.Debug().Str("Segment", fetchme.Url.String()).Msg("Got")
-	if sc.dumpdir != "" && sc.fetchMode >= MODE_STORE {
-		err = os.WriteFile(localpath, body, 0644)
+	if dumpdir != "" && sc.fetchMode >= MODE_STORE {
+		err = sc.store.WriteFile(localpath, body)
 		if err != nil {
 			sc.logger.Error().Err(err).Str("Path", localpath).Msg("Write Segment Data")
 			return err
@@ -355,6 +451,17 @@ func (sc *StreamChecker) executeFetchAndStore(fetchme SegmentInfo) error {
 	return nil
 }
 
+// recordFetch adds a fetch record to the statistics and logs it
+func (sc *StreamChecker) recordFetch(rec *SegmentFetchRecord) {
+	sc.fetchStats.Add(rec)
+	sc.checkerLog.LogSegmentFetch(rec)
+}
+
+// GetFetchStats returns the aggregated segment fetch statistics per representation
+func (sc *StreamChecker) GetFetchStats() []RepFetchStats {
+	return sc.fetchStats.Snapshot()
+}
+
 // decodeSegment will decode the buffer as a mp4, extract the pts and duration metadata and return them
 func (sc *StreamChecker) decodeSegment(buf []byte) (offset, duration time.Duration, err error) {
 	buffer := bytes.NewReader(buf)
@@ -410,33 +517,25 @@ func (sc *StreamChecker) decodeSegment(buf []byte) (offset, duration time.Durati
 
 // fetchAndStore gets a manifest from URL, decode the manifest, dump stats, and calls back the action
 // callback on all Segments
-func (sc *StreamChecker) fetchAndStoreManifest() error {
+func (sc *StreamChecker) fetchAndStoreManifest(ctx context.Context) error {
 
-	req, err := http.NewRequest("GET", sc.sourceUrl.String(), nil)
-	if err != nil {
-		sc.logger.Warn().Err(err).Str("url", sc.sourceUrl.String()).Msg("Create Request")
-		// Handle error
-		return err
-	}
-
-	req.Header.Set("User-Agent", sc.userAgent)
-	if sc.lastDate != "" {
-		req.Header.Set("If-Modified-Since", sc.lastDate)
-	}
-
-	resp, err := sc.client.Do(req)
+	res, err := sc.retryPolicy.Do(ctx, sc.client, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", sc.sourceUrl.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", sc.userAgent)
+		if sc.lastDate != "" {
+			req.Header.Set("If-Modified-Since", sc.lastDate)
+		}
+		return req, nil
+	}, nil)
+	sc.reportOutcome("manifest", sc.sourceUrl.String(), res, err)
 	if err != nil {
 		sc.logger.Error().Err(err).Str("source", sc.sourceUrl.String()).Msg("Do Manifest Request")
 		return err
 	}
-	if resp.Body != nil {
-		defer resp.Body.Close()
-	}
-	contents, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		sc.logger.Error().Err(err).Str("source", sc.sourceUrl.String()).Msg("Get Manifest data")
-		return err
-	}
+	resp, contents := res.Resp, res.Body
 	if resp.StatusCode == http.StatusNotModified {
 		sc.logger.Debug().Str("url", sc.sourceUrl.String()).Msg("No update")
 		return nil
@@ -444,7 +543,7 @@ func (sc *StreamChecker) fetchAndStoreManifest() error {
 	}
 	if resp.StatusCode != http.StatusOK {
 		sc.logger.Warn().Int("status", resp.StatusCode).Msg("Manifest fetch")
-		return errors.New("Not successful")
+		return errNotSuccessful
 	}
 	if ct := resp.Header.Get("Content-Type"); strings.HasPrefix(ct, "application/json") || strings.HasPrefix(ct, "text/plain") {
 		var sessioninfo struct{ MediaUrl string }
@@ -464,8 +563,12 @@ func (sc *StreamChecker) fetchAndStoreManifest() error {
 		}
 		sc.logger.Info().Str("url", sessioninfo.MediaUrl).Msg("Open session")
 		sc.sourceUrl = sessionUrl
+		// Media resolves against the session
+		if err := sc.updateStorageMeta(func(m *StorageMeta) { m.MediaUrl = sessioninfo.MediaUrl }); err != nil {
+			sc.logger.Error().Err(err).Msg("Write metadata")
+		}
 		// Call myself
-		return sc.fetchAndStoreManifest()
+		return sc.fetchAndStoreManifest(ctx)
 
 	}
 	if resp.Header.Get("Date") == sc.lastDate {
@@ -478,9 +581,10 @@ func (sc *StreamChecker) fetchAndStoreManifest() error {
 	if sc.dumpdir != "" {
 		// Store the manifest
 		now := time.Now()
-		filename := now.UTC().Format(ManifestFormat)
-		filepath := path.Join(sc.manifestDir, filename)
-		err = os.WriteFile(filepath, contents, 0644)
+		if err := sc.rotateIfDue(now); err != nil {
+			sc.logger.Error().Err(err).Msg("Rotate recording")
+		}
+		filepath, err := sc.manifestWriter.Write(sc.store, sc.manifestDir, now, sc.filterManifest(contents))
 		if err != nil {
 			sc.logger.Error().Err(err).Str("path", filepath).Msg("Write manifest")
 			return err
@@ -504,6 +608,23 @@ func (sc *StreamChecker) fetchAndStoreManifest() error {
 
 }
 
+// filterManifest removes the tracks not recorded from a manifest to store
+// Unparseable manifests are stored as they are
+func (sc *StreamChecker) filterManifest(contents []byte) []byte {
+	if sc.filter == nil {
+		return contents
+	}
+	mpde := new(mpd.MPD)
+	if err := mpde.Decode(contents); err != nil {
+		return contents
+	}
+	filtered, err := sc.filter.Apply(mpde).Encode()
+	if err != nil {
+		return contents
+	}
+	return filtered
+}
+
 // OnNewMpd is called when a new MPD is published
 // (that is different)
 func (sc *StreamChecker) OnNewMpd(mpde *mpd.MPD) error {
@@ -522,16 +643,27 @@ func (sc *StreamChecker) OnNewMpd(mpde *mpd.MPD) error {
 	if err := sc.walkMpd(mpde); err != nil {
 		return err
 	}
-	ast := GetAst(mpde)
+	// Only the recorded tracks
+	recorded := sc.filter.Apply(mpde)
+	if sc.availability != nil {
+		OnAllSegmentUrls(recorded, sc.sourceUrl, func(seg SegmentInfo) error {
+			sc.availability.Announce(seg)
+			return nil
+		})
+		sc.availability.EndOfManifest()
+	}
 	var err error
 	if sc.fetchMode > MODE_NOFETCH {
-		err = OnAllSegmentUrls(mpde, sc.sourceUrl, func(url *url.URL, t, d, pStart time.Duration) error {
-			if t != 0 && d != 0 && cutSegmentsAt > 0 && time.Since(ast.Add(pStart+t)) > cutSegmentsAt {
-				sc.logger.Trace().Msgf("Skip: %s Age %s ", url, time.Since(ast.Add(pStart+t)))
+		err = OnAllSegmentUrls(recorded, sc.sourceUrl, func(seg SegmentInfo) error {
+			if !seg.At.IsZero() && sc.cutSegmentsAt > 0 && time.Since(seg.At) > sc.cutSegmentsAt {
+				if sc.collectBackfill(seg) {
+					return nil
+				}
+				sc.logger.Trace().Msgf("Skip: %s Age %s ", seg.Url, time.Since(seg.At))
 				// Skip too old segments, but not init segments
 				return nil
 			}
-			return sc.fetchAndStoreSegment(url, t, d)
+			return sc.fetchAndStoreSegment(seg)
 		})
 	}
 	return err
@@ -704,26 +836,51 @@ ASloop:
 	return nil
 }
 
-// Do fetches and analyzes until 'done' is signaled.
+// Do fetches and analyzes until ctx is cancelled.
 // If maxRetries > 0, it returns an error after that many consecutive poll failures.
-func (sc *StreamChecker) Do(maxRetries int) error {
+// Queued segment fetches continue after return, call Drain to finish them
+func (sc *StreamChecker) Do(ctx context.Context, maxRetries int) error {
 
 	// Do once immediately, return on error
-	err := sc.fetchAndStoreManifest()
+	err := sc.fetchAndStoreManifest(ctx)
 	if err != nil {
 		sc.logger.Error().Err(err).Msg("Initial fetch")
 		return err
 	}
+	sc.startBackfill(ctx)
 	consecutiveErrors := 0
 	sc.ticker = time.NewTicker(sc.updateFreq)
 	defer sc.ticker.Stop()
+	statsTicker := time.NewTicker(fetchStatsInterval)
+	defer statsTicker.Stop()
+	var retentionC <-chan time.Time
+	if sc.retention != nil && sc.dumpdir != "" {
+		retentionTicker := time.NewTicker(retentionInterval)
+		defer retentionTicker.Stop()
+		retentionC = retentionTicker.C
+	}
 forloop:
 	for {
 		select {
-		case <-sc.done:
+		case <-ctx.Done():
 			break forloop
+		case <-statsTicker.C:
+			if sc.fetchMode >= MODE_ACCESS {
+				sc.checkerLog.LogFetchStats(sc.fetchStats.Snapshot())
+			}
+			if sc.availability != nil {
+				sc.checkerLog.LogAvailabilityStats(sc.availability.Snapshot())
+			}
+		case <-retentionC:
+			if err := sc.enforceRetention(time.Now()); err != nil {
+				sc.logger.Error().Err(err).Msg("Retention")
+			}
 		case <-sc.ticker.C:
-			if err := sc.fetchAndStoreManifest(); err != nil {
+			if err := sc.fetchAndStoreManifest(ctx); err != nil {
+				if ctx.Err() != nil {
+					// Cancelled while polling
+					break forloop
+				}
 				consecutiveErrors++
 				sc.checkerLog.LogPollFailure(err, consecutiveErrors)
 				if maxRetries > 0 && consecutiveErrors >= maxRetries {
@@ -739,29 +896,83 @@ forloop:
 	return nil
 }
 
-// Done terminates the Streamchecker gracefully
-func (sc *StreamChecker) Done() {
-	close(sc.done)
-	sc.fetchqueue <- SegmentInfo{}
-	// Sync exit (lame)
-	time.Sleep(time.Second)
+// FetchSummary are the final segment statistics after draining
+type FetchSummary struct {
+	Queued    int64 `json:"queued"`
+	Completed int64 `json:"completed"`
+	Failed    int64 `json:"failed"`
+	Dropped   int64 `json:"dropped"` // Evicted, expired, or still queued when the deadline expired
+}
+
+// Drain stops accepting new segments and waits up to 'deadline' for queued fetches to finish.
+// Fetches still running after the deadline are cancelled. Must be called after Do returned
+func (sc *StreamChecker) Drain(deadline time.Duration) FetchSummary {
+	sc.scheduler.Close()
+
+	sc.logger.Info().Int("queued", sc.scheduler.Len()).Msgf("Draining fetch queue for up to %s", deadline)
+	finished := make(chan struct{})
+	go func() {
+		sc.workers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(deadline):
+		sc.logger.Warn().Int("queued", sc.scheduler.Len()).Msg("Drain deadline expired, cancelling fetches")
+		sc.cancelFetch()
+		<-finished
+	}
+	sc.cancelFetch()
+	sc.scheduler.DropAll()
+
+	summary := FetchSummary{
+		Queued:    sc.queued.Load(),
+		Completed: sc.completed.Load(),
+		Failed:    sc.failed.Load(),
+	}
+	summary.Dropped = summary.Queued - summary.Completed - summary.Failed
+	sc.logger.Info().
+		Int64("queued", summary.Queued).
+		Int64("completed", summary.Completed).
+		Int64("failed", summary.Failed).
+		Int64("dropped", summary.Dropped).
+		Interface("drops", sc.scheduler.Dropped()).
+		Msg("Fetch summary")
+	if sc.fetchMode >= MODE_ACCESS {
+		sc.checkerLog.LogFetchStats(sc.fetchStats.Snapshot())
+	}
+	if sc.availability != nil {
+		sc.availability.Wait()
+		sc.checkerLog.LogAvailabilityStats(sc.availability.Snapshot())
+	}
+	return summary
 }
 
 // Goroutine executing media fetches
 func (sc *StreamChecker) fetcher() {
+	defer sc.workers.Done()
 
-	for i := range sc.fetchqueue {
-		if i.Url == nil {
-			// Exit signal
+	for {
+		i, ok := sc.scheduler.Pop(sc.fetchCtx)
+		if !ok {
+			// Closed and empty, or cancelled
 			break
 		}
-		if sc.fetchMode > MODE_VERIFY {
-			sc.haveMutex.Lock()
-			delete(sc.haveMap, i.Url.Path)
-			sc.haveMutex.Unlock()
-		}
 
-		sc.executeFetchAndStore(i)
+		if err := sc.executeFetchAndStore(sc.fetchCtx, i); err != nil {
+			if sc.fetchCtx.Err() != nil {
+				// Aborted by cancellation
+				sc.scheduler.DropAll()
+				break
+			}
+			sc.failed.Add(1)
+			if sc.fetchMode > MODE_VERIFY {
+				// Try again if still in the next manifest
+				sc.scheduler.Forget(i.Url.Path)
+			}
+		} else {
+			sc.completed.Add(1)
+		}
 	}
 	sc.logger.Debug().Msg("Close Fetcher")
 
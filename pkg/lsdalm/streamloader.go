@@ -42,6 +42,8 @@ type StreamLoader struct {
 	sessions        []*Session     // All active Sessions
 	singleconn      bool
 	sourceUrl       *url.URL
+	requestTimeout  time.Duration // Timeout for a single request
+	httpConfig      *HttpConfig   // Settings for outgoing requests, nil for defaults
 }
 
 type Session struct {
@@ -77,27 +79,59 @@ func NewStreamLoader(name, source string, updateFreq time.Duration, logger zerol
 				},
 			},
 		},
-		userAgent:   DefaultUserAgent,
-		sessions:    make([]*Session, 0, numSessions),
-		singleconn:  singleconn,
-		numSessions: numSessions,
+		userAgent:      DefaultUserAgent,
+		sessions:       make([]*Session, 0, numSessions),
+		singleconn:     singleconn,
+		numSessions:    numSessions,
+		requestTimeout: requestTimeout,
 	}
 	var err error
 	st.sourceUrl, err = url.Parse(source)
 	if err != nil {
 		return nil, err
 	}
-	for w := 0; w < max(numSessions/10, 1); w++ {
-		go st.fetcher()
-	}
-	go st.AddLoad()
 	return st, nil
 }
 
+// SetHttpConfig applies headers, TLS, proxy and token settings to all requests
+// Must be called before Do
+func (sl *StreamLoader) SetHttpConfig(hc *HttpConfig) error {
+	client, err := sl.newClient(hc)
+	if err != nil {
+		return err
+	}
+	sl.client = client
+	sl.httpConfig = hc
+	if hc.UserAgent != "" {
+		sl.userAgent = hc.UserAgent
+	}
+	return nil
+}
+
+// newClient creates a http client with the load test connection settings
+func (sl *StreamLoader) newClient(hc *HttpConfig) (*http.Client, error) {
+	tr, err := hc.NewTransport()
+	if err != nil {
+		return nil, err
+	}
+	tr.MaxIdleConnsPerHost = 10000
+	tr.DialContext = (&net.Dialer{Timeout: dialTimeout}).DialContext
+	return &http.Client{Timeout: sl.requestTimeout, Transport: hc.Wrap(tr)}, nil
+}
+
 func (sl *StreamLoader) AddLoad() {
 	for i := 0; i < sl.numSessions; i++ {
+		ses := NewSession(sl.sourceUrl, sl.singleconn)
+		if sl.singleconn && sl.httpConfig != nil {
+			client, err := sl.newClient(sl.httpConfig)
+			if err != nil {
+				sl.logger.Error().Err(err).Msg("Create client")
+			} else {
+				ses.client = client
+			}
+		}
 		sl.sessionMutex.Lock()
-		sl.sessions = append(sl.sessions, NewSession(sl.sourceUrl, sl.singleconn))
+		sl.sessions = append(sl.sessions, ses)
 		sl.sessionMutex.Unlock()
 		time.Sleep(10 * time.Millisecond) // 100 Hz
 	}
@@ -267,6 +301,11 @@ func (sc *StreamLoader) fetchAllManifest() error {
 // Do fetches and analyzes until 'done' is signaled
 func (sc *StreamLoader) Do() error {
 
+	for w := 0; w < max(sc.numSessions/10, 1); w++ {
+		go sc.fetcher()
+	}
+	go sc.AddLoad()
+
 	// Do once immediately, return on error
 	err := sc.fetchAllManifest()
 	if err != nil {
@@ -5,9 +5,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jdeisenh/lsdalm/pkg/go-mpd"
@@ -23,31 +24,59 @@ const (
 )
 
 type StreamLooper struct {
+	// Protects the recording below, which Reload and Switch replace
+	mutex   sync.RWMutex
+	source  string // dumpdir as given, with storage scheme
+	store   Storage
 	dumpdir string
 
 	logger zerolog.Logger
 
-	recording *Recording
+	recording *Recording              // The longest continuous range
+	ranges    []*Recording            // All continuous ranges, in time order
+	loopAll   bool                    // Loop across all ranges instead of the longest
+	matchers  func() []segmentMatcher // Segment paths of the recording, built on first use
 	// statistics
 
 	originalBaseUrl *url.URL
 	storageMeta     StorageMeta
+	rewriter        *UrlRewriter
+	proxy           *MediaProxy // nil: serve only recorded files
+	proxyConfig     *HttpConfig // To recreate the proxy on Switch
+	timeServer      *TimeServer // nil: keep the original UTCTiming
+	faultProfiles   map[string]FaultProfile
 }
 
+// NewStreamLooper loads the recording in dumpdir, a local directory or s3://bucket/prefix
 func NewStreamLooper(dumpdir string, logger zerolog.Logger) (*StreamLooper, error) {
 
-	st := &StreamLooper{
-		dumpdir:   dumpdir,
-		logger:    logger,
-		recording: NewRecording(path.Join(dumpdir, ManifestPath)),
+	source := dumpdir
+	store, dumpdir, err := OpenStorage(dumpdir)
+	if err != nil {
+		return nil, err
 	}
-	st.recording.fillData(st.logger)
-	if len(st.recording.history) < 10 {
-		return nil, fmt.Errorf("Not enough manifests")
+	st, err := NewStreamLooperWithStorage(store, dumpdir, logger)
+	if err != nil {
+		return nil, err
+	}
+	st.source = source
+	return st, nil
+}
+
+// NewStreamLooperWithStorage loads the recording in dumpdir of store
+func NewStreamLooperWithStorage(store Storage, dumpdir string, logger zerolog.Logger) (*StreamLooper, error) {
+
+	st := &StreamLooper{
+		source:     dumpdir,
+		store:      store,
+		dumpdir:    dumpdir,
+		logger:     logger,
+		rewriter:   &UrlRewriter{},
+		timeServer: NewTimeServer(),
 	}
 
 	metapath := path.Join(dumpdir, StorageMetaFileName)
-	mf, err := os.ReadFile(metapath)
+	mf, err := store.ReadFile(metapath)
 	if err != nil {
 		logger.Warn().Err(err).Str("filename", metapath).Msg("Read Metadata")
 	} else {
@@ -63,19 +92,138 @@ func NewStreamLooper(dumpdir string, logger zerolog.Logger) (*StreamLooper, erro
 		st.originalBaseUrl.Path = path.Dir(st.originalBaseUrl.Path)
 	}
 
+	// Manifests before are being deleted by retention, their segments may be gone
+	st.ranges, err = LoadRanges(store, path.Join(dumpdir, ManifestPath), st.storageMeta.RetainedFrom, st.logger)
+	if err != nil {
+		return nil, err
+	}
+	for _, re := range st.ranges {
+		if st.recording == nil || re.loopLength() > st.recording.loopLength() {
+			st.recording = re
+		}
+	}
+	if st.recording == nil || len(st.recording.history) < 10 {
+		return nil, fmt.Errorf("Not enough manifests")
+	}
+	if len(st.ranges) > 1 {
+		st.logger.Warn().Int("ranges", len(st.ranges)).Str("longest", shortT(st.recording.historyStart)).
+			Msg("Recording has gaps")
+	}
+
 	st.recording.ShowStats(st.logger)
+	st.matchers = sync.OnceValue(st.segmentMatchers)
 	return st, nil
 }
 
+// Reload reads the recording again from the same storage, e.g. after it was extended
+func (sc *StreamLooper) Reload() error {
+	sc.mutex.RLock()
+	source, store, dumpdir := sc.source, sc.store, sc.dumpdir
+	sc.mutex.RUnlock()
+	next, err := NewStreamLooperWithStorage(store, dumpdir, sc.logger)
+	if err != nil {
+		return err
+	}
+	next.source = source
+	return sc.switchTo(next)
+}
+
+// Switch replaces the recording by the one in dumpdir, keeping the settings
+// The current recording stays in use if loading fails
+func (sc *StreamLooper) Switch(dumpdir string) error {
+	next, err := NewStreamLooper(dumpdir, sc.logger)
+	if err != nil {
+		return err
+	}
+	return sc.switchTo(next)
+}
+
+// switchTo takes over the recording loaded into next
+func (sc *StreamLooper) switchTo(next *StreamLooper) error {
+	sc.mutex.RLock()
+	hc := sc.proxyConfig
+	next.rewriter = sc.rewriter
+	sc.mutex.RUnlock()
+	if hc != nil {
+		if err := next.EnableProxy(hc); err != nil {
+			return err
+		}
+	}
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	sc.source, sc.store, sc.dumpdir = next.source, next.store, next.dumpdir
+	sc.recording, sc.ranges, sc.matchers = next.recording, next.ranges, next.matchers
+	sc.originalBaseUrl, sc.storageMeta, sc.proxy = next.originalBaseUrl, next.storageMeta, next.proxy
+	sc.logger.Info().Str("dumpdir", next.source).Msg("Switched recording")
+	return nil
+}
+
+// SetUrlRewriter replaces the rules for the BaseURLs of generated manifests
+func (sc *StreamLooper) SetUrlRewriter(ur *UrlRewriter) error {
+	if err := ur.Validate(); err != nil {
+		return err
+	}
+	sc.rewriter = ur
+	return nil
+}
+
+// SetTimeServer selects the time server UTCTiming points to, nil keeps the original
+func (sc *StreamLooper) SetTimeServer(ts *TimeServer) error {
+	if ts != nil {
+		if err := ts.Validate(); err != nil {
+			return err
+		}
+	}
+	sc.timeServer = ts
+	return nil
+}
+
+// SetLoopAllRanges loops across all continuous ranges of a recording with gaps,
+// with a Period boundary at each gap, instead of only the longest range
+func (sc *StreamLooper) SetLoopAllRanges(all bool) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	sc.loopAll = all
+}
+
+// SetFaultProfiles sets the named profiles usable in fault specs
+func (sc *StreamLooper) SetFaultProfiles(profiles map[string]FaultProfile) {
+	sc.faultProfiles = profiles
+}
+
+// EnableProxy serves files missing in the recording from their origin, storing them
+// Recordings without media are then served completely through the proxy
+func (sc *StreamLooper) EnableProxy(hc *HttpConfig) error {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	proxy, err := NewMediaProxy(sc.store, sc.dumpdir, sc.originalBaseUrl, hc, sc.logger)
+	if err != nil {
+		return err
+	}
+	proxy.AllowRules(sc.rewriter)
+	// Generated manifests only have the BaseURLs of the first manifest of each range
+	for _, re := range sc.ranges {
+		proxy.AllowManifest(re.firstMpd, sc.originalBaseUrl)
+	}
+	sc.proxy, sc.proxyConfig = proxy, hc
+	return nil
+}
+
 // BuildMpd takes the recordings original mpd and adds Segments for the indicated timestamps range
 // it also shifts the Timeline by 'shift' and assigns a new id
 // ptsShift: shift presentationTime
 // periodStart: Beginning of Period
 // from, to: Segments to include (in shifted absolute time)
+// The caller holds the read lock
 func (sc *StreamLooper) BuildMpd(ptsShift time.Duration, id string, periodStart, from, to time.Time) *mpd.MPD {
+	return sc.buildPeriod(sc.recording, ptsShift, id, periodStart, from, to)
+}
+
+// buildPeriod is BuildMpd for the range re
+func (sc *StreamLooper) buildPeriod(re *Recording, ptsShift time.Duration, id string, periodStart, from, to time.Time) *mpd.MPD {
 
 	// Copy the Root Node
-	outMpd := Copy(sc.recording.firstMpd)
+	outMpd := Copy(re.firstMpd)
 
 	period := outMpd.Period[0] // There is only one
 
@@ -120,7 +268,7 @@ func (sc *StreamLooper) BuildMpd(ptsShift time.Duration, id string, periodStart,
 		nst := nas.SegmentTemplate
 		nstl := nas.SegmentTemplate.SegmentTimeline
 
-		elements := sc.recording.Segments[asi]
+		elements := re.Segments[asi]
 		ShiftPto(nst, effectivePtsShift)
 		start := elements.start
 		timescale := ZeroIfNil(nst.Timescale)
@@ -165,8 +313,9 @@ func (sc *StreamLooper) BuildMpd(ptsShift time.Duration, id string, periodStart,
 	}
 
 	// Add Events
-	np.EventStream = np.EventStream[:0]
-	for _, ev := range sc.recording.EventStreamMap {
+	// New slice, the copied one shares its array with the recording
+	np.EventStream = make([]*mpd.EventStream, 0, len(re.EventStreamMap))
+	for _, ev := range re.EventStreamMap {
 		// Append all for all ranges: Todo: map offset, duration
 		evs := Copy(ev)
 		evs.Event = make([]mpd.Event, len(ev.Event))
@@ -205,52 +354,142 @@ func (sc *StreamLooper) BuildMpd(ptsShift time.Duration, id string, periodStart,
 	return outMpd
 }
 
-// GetLooped generates a Manifest by combining one or two timeshifted parts of the recording into a new mpd
-// and rendering it out
-func (sc *StreamLooper) GetLooped(at, now time.Time, requestDuration time.Duration) ([]byte, error) {
-
-	offset, timeShift, loopLength, startOfRecording := sc.recording.getLoopMeta(at, now)
+// loopSection is a continuous range of the recording played in the loop
+type loopSection struct {
+	re       *Recording
+	from, to time.Time // Loopable range
+}
 
-	if false {
-		// Example on how to replay a part of the DVR window
-		loopLength = 60 * time.Minute
-		startOfRecording, _ = time.Parse(time.RFC3339, "2026-02-05T11:00:00+01:00")
-		offset = time.Duration(time.Now().Unix()%3600) * time.Second
-		timeShift = time.Now().Sub(startOfRecording) / time.Hour * time.Hour
+// loopSections returns the ranges played in the loop, in order. The caller holds the read lock
+func (sc *StreamLooper) loopSections() []loopSection {
+	ranges := []*Recording{sc.recording}
+	if sc.loopAll {
+		ranges = sc.ranges
+	}
+	sections := make([]loopSection, 0, len(ranges))
+	for _, re := range ranges {
+		from, to := re.getLoopableRange()
+		sections = append(sections, loopSection{re: re, from: from, to: to})
 	}
-	sc.logger.Info().Msgf("Offset: %6s TimeShift: %s LoopDuration: %s OrgStart:%s OrgPosition %s",
-		RoundToS(offset), RoundToS(timeShift), RoundToS(loopLength), shortT(startOfRecording), shortT(startOfRecording.Add(offset)))
+	return sections
+}
 
-	/*
-		// Fill timeShiftWindow with loops...
-		kio := timeShiftWindowSize/loopLength*loopLength + timeShiftWindowSize
-		for first := startOfRecording.Add(timeShift - kio); first.Before(now); first = first.Add(loopLength) {
-			sc.logger.Info().Msgf("Period ad %s %s", first, kio)
+// loopPlace is a section placed on the output timeline
+type loopPlace struct {
+	section int
+	loop    int64         // Number of the loop
+	start   time.Time     // Output time of the section start
+	offset  time.Duration // Position in the section
+	shift   time.Duration // Added to the recording times of the section
+	length  time.Duration // Of the whole loop
+}
+
+// placeLoop finds the section played at 'at', shifted to play at now
+// Invariants, as for a single range:
+// start+offset+shift=now => shift=now-offset-start
+// We play at at%duration => (start+offset)%duration == at%duration => offset=(at-start)%duration
+func placeLoop(sections []loopSection, at, now time.Time) loopPlace {
+	var p loopPlace
+	for _, s := range sections {
+		p.length += s.to.Sub(s.from)
+	}
+	loopOffset := at.Sub(sections[0].from) % p.length
+	p.offset = loopOffset
+	for i, s := range sections {
+		p.section = i
+		d := s.to.Sub(s.from)
+		if p.offset < d || i == len(sections)-1 {
+			break
 		}
-	*/
-	// Check if we are around the loop point
+		p.offset -= d
+	}
+	p.start = now.Add(-p.offset)
+	p.shift = p.start.Sub(sections[p.section].from)
+	// The loop starts before the sections played before
+	p.loop = int64(p.start.Add(p.offset-loopOffset).Sub(sections[0].from) / p.length)
+	return p
+}
+
+// previous places the section played before p
+func (p loopPlace) previous(sections []loopSection) loopPlace {
+	prev := loopPlace{section: p.section - 1, loop: p.loop, length: p.length}
+	if prev.section < 0 {
+		prev.section = len(sections) - 1
+		prev.loop--
+	}
+	s := sections[prev.section]
+	prev.start = p.start.Add(-s.to.Sub(s.from))
+	prev.shift = prev.start.Sub(s.from)
+	return prev
+}
+
+// shiftOf returns the shift of section i in the loop of p
+func (p loopPlace) shiftOf(sections []loopSection, i int) time.Duration {
+	start := p.start
+	for j := p.section; j > i; j-- {
+		start = start.Add(-sections[j-1].to.Sub(sections[j-1].from))
+	}
+	for j := p.section; j < i; j++ {
+		start = start.Add(sections[j].to.Sub(sections[j].from))
+	}
+	return start.Sub(sections[i].from)
+}
+
+// periodId numbers the Periods by loop and section
+func (p loopPlace) periodId(sections []loopSection) string {
+	return fmt.Sprintf("Id-%d", p.loop*int64(len(sections))+int64(p.section))
+}
+
+// GetLooped generates a Manifest by combining one or two timeshifted parts of the recording into a new mpd
+// and rendering it out. utcTiming replaces UTCTiming, if not nil
+func (sc *StreamLooper) GetLooped(at, now time.Time, requestDuration time.Duration, utcTiming *mpd.Descriptor) ([]byte, error) {
+	mpdCurrent := sc.buildLooped(at, now, requestDuration, utcTiming)
+	// re-encode
+	afterEncode, err := mpdCurrent.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return afterEncode, nil
+}
+
+// buildLooped generates the manifest for GetLooped
+func (sc *StreamLooper) buildLooped(at, now time.Time, requestDuration time.Duration, utcTiming *mpd.Descriptor) *mpd.MPD {
+	sc.mutex.RLock()
+	defer sc.mutex.RUnlock()
+
+	sections := sc.loopSections()
+	cur := placeLoop(sections, at, now)
+	section := sections[cur.section]
+	sc.logger.Info().Msgf("Offset: %6s TimeShift: %s LoopDuration: %s OrgStart:%s OrgPosition %s Range %d/%d",
+		RoundToS(cur.offset), RoundToS(cur.shift), RoundToS(cur.length), shortT(section.from), shortT(section.from.Add(cur.offset)),
+		cur.section+1, len(sections))
+
+	// Check if we are around the loop point, or a gap between ranges
 	var mpdCurrent *mpd.MPD
-	if offset < timeShiftWindowSize {
+	if cur.offset < timeShiftWindowSize {
 		// We are just after the loop point and have to add date from the previous period
 		// Todo: Generalize for several periods. Allow serveral repeats within the DVR window
-		sc.logger.Debug().Msgf("Loop point: %s", shortT(startOfRecording.Add(timeShift)))
-		mpdPrevious := sc.BuildMpd(
-			timeShift-loopLength,
-			fmt.Sprintf("Id-%d", timeShift/loopLength-1),
-			startOfRecording.Add(timeShift).Add(-loopLength),
-			startOfRecording.Add(timeShift).Add(-loopLength),
-			startOfRecording.Add(timeShift),
+		sc.logger.Debug().Msgf("Loop point: %s", shortT(cur.start))
+		prev := cur.previous(sections)
+		mpdPrevious := sc.buildPeriod(
+			sections[prev.section].re,
+			prev.shift,
+			prev.periodId(sections),
+			prev.start,
+			prev.start,
+			cur.start,
 		)
 		pf, pt := PeriodSegmentLimits(mpdPrevious.Period[0], GetAst(mpdPrevious))
-		sc.logger.Debug().Msgf("A %s to %s asked %s Duration %s", shortT(pf.Add(-timeShift+loopLength)), shortT(pt.Add(-timeShift+loopLength)),
-			shortT(startOfRecording.Add(loopLength)), pt.Sub(pf))
-		if offset > segmentSize {
+		sc.logger.Debug().Msgf("A %s to %s asked %s Duration %s", shortT(pf.Add(-prev.shift)), shortT(pt.Add(-prev.shift)),
+			shortT(sections[prev.section].to), pt.Sub(pf))
+		if cur.offset > segmentSize {
 			// Ensure period not empty
-			mpdCurrent = sc.BuildMpd(
-				timeShift,
-				fmt.Sprintf("Id-%d", timeShift/loopLength),
-				startOfRecording.Add(timeShift),
-				startOfRecording.Add(timeShift),
+			mpdCurrent = sc.buildPeriod(
+				section.re,
+				cur.shift,
+				cur.periodId(sections),
+				cur.start,
+				cur.start,
 				now,
 			)
 			pf, pt := PeriodSegmentLimits(mpdCurrent.Period[0], GetAst(mpdCurrent))
@@ -259,28 +498,31 @@ func (sc *StreamLooper) GetLooped(at, now time.Time, requestDuration time.Durati
 		mpdCurrent = mergeMpd(mpdPrevious, mpdCurrent)
 	} else {
 		// No loop point
-		mpdCurrent = sc.BuildMpd(
-			timeShift,
-			fmt.Sprintf("Id-%d", timeShift/loopLength),
-			startOfRecording.Add(timeShift),
-			startOfRecording.Add(timeShift),
+		mpdCurrent = sc.buildPeriod(
+			section.re,
+			cur.shift,
+			cur.periodId(sections),
+			cur.start,
+			cur.start,
 			//now.Add(-timeShiftWindowSize),
 			now,
 		)
 	}
-	mpdCurrent = ReBaseMpd(mpdCurrent, sc.originalBaseUrl, sc.storageMeta.HaveMedia)
-	publishTime := xsd.DateTime(time.Now().UTC())
+	// Advertise only what was recorded
+	mpdCurrent = sc.storageMeta.Filter.Apply(mpdCurrent)
+	mpdCurrent = proxyRewriter(sc.rewriter, sc.proxy, sc.storageMeta.HaveMedia).Apply(mpdCurrent, sc.originalBaseUrl, sc.storageMeta.HaveMedia)
+	publishTime := xsd.DateTime(now.UTC())
 	mpdCurrent.PublishTime = &publishTime
-	// re-encode
-	afterEncode, err := mpdCurrent.Encode()
-	if err != nil {
-		return nil, err
+	if utcTiming != nil {
+		mpdCurrent.UTCTiming = utcTiming
 	}
-	return afterEncode, nil
+	return mpdCurrent
 }
 
 // GetStatic generates a Manifest by finding the manifest before now%duration
 func (sc *StreamLooper) GetStatic() ([]byte, error) {
+	sc.mutex.RLock()
+	defer sc.mutex.RUnlock()
 
 	start, end := sc.recording.getTimelineRange()
 	//start, end = sc.recording.getRecordingRange()
@@ -307,7 +549,8 @@ func (sc *StreamLooper) GetStatic() ([]byte, error) {
 	dur := DurationToXsdDuration(duration)
 	mpdCurrent.MediaPresentationDuration = &dur
 	mpdCurrent.Period[0].Duration = &dur
-	mpdCurrent = ReBaseMpd(mpdCurrent, sc.originalBaseUrl, sc.storageMeta.HaveMedia)
+	mpdCurrent = sc.storageMeta.Filter.Apply(mpdCurrent)
+	mpdCurrent = proxyRewriter(sc.rewriter, sc.proxy, sc.storageMeta.HaveMedia).Apply(mpdCurrent, sc.originalBaseUrl, sc.storageMeta.HaveMedia)
 	// re-encode
 	afterEncode, err := mpdCurrent.Encode()
 	if err != nil {
@@ -316,8 +559,64 @@ func (sc *StreamLooper) GetStatic() ([]byte, error) {
 	return afterEncode, nil
 }
 
-// Handler serves manifests
+// DynamicHandler serves manifests
+// The query parameter faults=<spec> redirects to the faulty session with this spec
 func (sc *StreamLooper) DynamicHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if spec := q.Get("faults"); spec != "" {
+		q.Del("faults")
+		// Relative, the manifest may be mounted below a prefix the handler does not see
+		target := strings.TrimPrefix(FaultPathPrefix, "/") + url.PathEscape(spec) + "/" + path.Base(r.URL.Path)
+		if len(q) > 0 {
+			target += "?" + q.Encode()
+		}
+		w.Header().Set("Location", target)
+		w.WriteHeader(http.StatusSeeOther)
+		return
+	}
+	sc.serveDynamic(w, r, nil)
+}
+
+// FaultHandler serves manifests and files below FaultPathPrefix, injecting the faults of the spec in the path
+func (sc *StreamLooper) FaultHandler(w http.ResponseWriter, r *http.Request) {
+	spec, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, FaultPathPrefix), "/")
+	profile, err := ParseFaultSpec(spec, sc.faultProfiles)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sess := newFaultSession(profile, spec, r, sc.logger)
+	switch {
+	case path.Base(rest) == "manifest.mpd":
+		sc.serveDynamic(w, r, sess)
+		return
+	case rest == strings.TrimPrefix(TimePath, "/") || strings.HasPrefix(rest, strings.TrimPrefix(TimePath, "/")+"/"):
+		sc.TimeHandler(w, r)
+		return
+	}
+	if w = sess.segmentWriter(w, r); w == nil {
+		return
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = "/" + rest
+	r2.URL.RawPath = ""
+	sc.FileHandler(w, r2)
+}
+
+// TimeHandler serves the time UTCTiming points to, for servers mounting the looper below a prefix
+func (sc *StreamLooper) TimeHandler(w http.ResponseWriter, r *http.Request) {
+	if sc.timeServer == nil {
+		http.NotFound(w, r)
+		return
+	}
+	sc.timeServer.ServeHTTP(w, r)
+}
+
+// serveDynamic serves the looped manifest, with the faults of sess if not nil
+func (sc *StreamLooper) serveDynamic(w http.ResponseWriter, r *http.Request, sess *faultSession) {
 	/*
 		loopstart, _ := time.Parse(time.RFC3339, "2025-02-27T09:48:00Z")
 		startat= loopstart.Add(time.Now().Sub(sc.start))
@@ -355,7 +654,16 @@ func (sc *StreamLooper) DynamicHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	buf, err := sc.GetLooped(startat, now, duration)
+	if sess != nil {
+		stale := sess.manifestTime(now, r.URL.Path)
+		startat, now = startat.Add(stale.Sub(now)), stale
+	}
+	mpdCurrent := sc.buildLooped(startat, now, duration, sc.timeServer.UTCTiming(r))
+	if sess != nil {
+		sess.applyManifest(mpdCurrent, r.URL.Path)
+		sess.delayManifest(r)
+	}
+	buf, err := mpdCurrent.Encode()
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -367,9 +675,17 @@ func (sc *StreamLooper) DynamicHandler(w http.ResponseWriter, r *http.Request) {
 // FileHanlder serves data
 func (sc *StreamLooper) FileHandler(w http.ResponseWriter, r *http.Request) {
 	//urlpath := strings.TrimPrefix(r.URL.Path, "/dash/")
-	filepath := path.Join(sc.dumpdir, r.URL.Path)
+	// Not locked while serving, slow clients would block Switch
+	sc.mutex.RLock()
+	store, dumpdir, proxy := sc.store, sc.dumpdir, sc.proxy
+	sc.mutex.RUnlock()
+	filepath := path.Join(dumpdir, r.URL.Path)
 	sc.logger.Trace().Str("path", filepath).Msg("Access")
-	http.ServeFile(w, r, filepath)
+	if proxy != nil {
+		proxy.ServeHTTP(w, r)
+		return
+	}
+	store.ServeFile(w, r, filepath)
 }
 
 // Static Handler serves the whole buffer as a static mpd
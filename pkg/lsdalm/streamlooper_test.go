@@ -0,0 +1,42 @@
+package lsdalm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlaceLoop(t *testing.T) {
+	base := time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+	// Two ranges, 58s and 22s, separated by a gap
+	sections := []loopSection{
+		{from: base, to: base.Add(58 * time.Second)},
+		{from: base.Add(2 * time.Minute), to: base.Add(2*time.Minute + 22*time.Second)},
+	}
+	at := base.Add(63 * time.Second)
+	now := at.Add(time.Hour)
+	p := placeLoop(sections, at, now)
+	assert.Equal(t, 1, p.section)
+	assert.Equal(t, 5*time.Second, p.offset)
+	assert.Equal(t, 80*time.Second, p.length)
+	assert.Equal(t, int64(45), p.loop)
+	assert.Equal(t, now.Add(-5*time.Second), p.start)
+	assert.Equal(t, now, sections[1].from.Add(p.offset+p.shift))
+	assert.Equal(t, "Id-91", p.periodId(sections))
+
+	prev := p.previous(sections)
+	assert.Equal(t, 0, prev.section)
+	assert.Equal(t, p.start.Add(-58*time.Second), prev.start)
+	assert.Equal(t, prev.shift, p.shiftOf(sections, 0))
+	assert.Equal(t, "Id-90", prev.periodId(sections))
+
+	// The first section follows the last one of the previous loop
+	p = placeLoop(sections, base.Add(90*time.Second), now)
+	assert.Equal(t, 0, p.section)
+	assert.Equal(t, 10*time.Second, p.offset)
+	prev = p.previous(sections)
+	assert.Equal(t, 1, prev.section)
+	assert.Equal(t, p.loop-1, prev.loop)
+	assert.Equal(t, p.start.Add(-22*time.Second), prev.start)
+}
@@ -1,15 +1,15 @@
 package lsdalm
 
 import (
+	"cmp"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/jdeisenh/lsdalm/pkg/go-mpd"
@@ -20,28 +20,57 @@ import (
 // StreamReplay can replay a recording as is, time-shifted, but otherwise not manipulated
 // It will manipulate presentationTimeOffsets and BaseURLs
 type StreamReplay struct {
+	// Protects the recording below, which Reload and Switch replace
+	mutex           sync.RWMutex
+	source          string // dumpdir as given, with storage scheme
+	store           Storage
 	dumpdir         string
 	manifestDir     string
+	reader          *ManifestReader
 	originalBaseUrl *url.URL
 	storageMeta     StorageMeta
-	isPast          bool // Flag: recording end is past, loop mode
+	rewriter        *UrlRewriter
+	proxy           *MediaProxy // nil: serve only recorded files
+	proxyConfig     *HttpConfig // To recreate the proxy on Switch
+	timeServer      *TimeServer // nil: keep the original UTCTiming
+	isPast          bool        // Flag: recording end is past, loop mode
 
 	logger                   zerolog.Logger
 	history                  []HistoryElement
 	historyStart, historyEnd time.Time
 }
 
+// NewStreamReplay opens the recording in dumpdir, a local directory or s3://bucket/prefix
 func NewStreamReplay(dumpdir string, logger zerolog.Logger) (*StreamReplay, error) {
+	source := dumpdir
+	store, dumpdir, err := OpenStorage(dumpdir)
+	if err != nil {
+		return nil, err
+	}
+	st, err := NewStreamReplayWithStorage(store, dumpdir, logger)
+	if err != nil {
+		return nil, err
+	}
+	st.source = source
+	return st, nil
+}
+
+// NewStreamReplayWithStorage opens the recording in dumpdir of store
+func NewStreamReplayWithStorage(store Storage, dumpdir string, logger zerolog.Logger) (*StreamReplay, error) {
 
 	st := &StreamReplay{
+		store:       store,
 		dumpdir:     dumpdir,
 		manifestDir: path.Join(dumpdir, ManifestPath),
+		reader:      NewManifestReader(store),
+		rewriter:    &UrlRewriter{},
+		timeServer:  NewTimeServer(),
 		logger:      logger,
 		history:     make([]HistoryElement, 0, 1000),
 	}
 
 	metapath := path.Join(dumpdir, StorageMetaFileName)
-	mf, err := os.ReadFile(metapath)
+	mf, err := store.ReadFile(metapath)
 	if err != nil {
 		logger.Warn().Err(err).Str("filename", metapath).Msg("Read Metadata")
 	} else {
@@ -59,9 +88,45 @@ func NewStreamReplay(dumpdir string, logger zerolog.Logger) (*StreamReplay, erro
 	return st, nil
 }
 
+// SetUrlRewriter replaces the rules for the BaseURLs of replayed manifests
+func (sc *StreamReplay) SetUrlRewriter(ur *UrlRewriter) error {
+	if err := ur.Validate(); err != nil {
+		return err
+	}
+	sc.rewriter = ur
+	return nil
+}
+
+// EnableProxy serves files missing in the recording from their origin, storing them
+// Recordings without media are then served completely through the proxy
+func (sc *StreamReplay) EnableProxy(hc *HttpConfig) error {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	proxy, err := NewMediaProxy(sc.store, sc.dumpdir, sc.originalBaseUrl, hc, sc.logger)
+	if err != nil {
+		return err
+	}
+	proxy.AllowRules(sc.rewriter)
+	sc.proxy, sc.proxyConfig = proxy, hc
+	return nil
+}
+
+// SetTimeServer selects the time server UTCTiming points to, nil keeps the original
+func (sc *StreamReplay) SetTimeServer(ts *TimeServer) error {
+	if ts != nil {
+		if err := ts.Validate(); err != nil {
+			return err
+		}
+	}
+	sc.timeServer = ts
+	return nil
+}
+
 // LoadArchive Load the full recording
 // This is used for already stored, finished Recordings
 func (sc *StreamReplay) LoadArchive() error {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
 	sc.fillData()
 	if len(sc.history) < 10 {
 		return fmt.Errorf("Not enough manifests")
@@ -71,9 +136,58 @@ func (sc *StreamReplay) LoadArchive() error {
 	return nil
 }
 
+// Reload reads the finished recording again from the same storage
+func (sc *StreamReplay) Reload() error {
+	sc.mutex.RLock()
+	source, store, dumpdir := sc.source, sc.store, sc.dumpdir
+	sc.mutex.RUnlock()
+	next, err := NewStreamReplayWithStorage(store, dumpdir, sc.logger)
+	if err != nil {
+		return err
+	}
+	next.source = source
+	return sc.switchTo(next)
+}
+
+// Switch replaces the recording by the finished one in dumpdir, keeping the settings
+// The current recording stays in use if loading fails
+func (sc *StreamReplay) Switch(dumpdir string) error {
+	next, err := NewStreamReplay(dumpdir, sc.logger)
+	if err != nil {
+		return err
+	}
+	return sc.switchTo(next)
+}
+
+// switchTo loads the recording opened in next and takes it over
+func (sc *StreamReplay) switchTo(next *StreamReplay) error {
+	sc.mutex.RLock()
+	hc := sc.proxyConfig
+	next.rewriter = sc.rewriter
+	sc.mutex.RUnlock()
+	if hc != nil {
+		if err := next.EnableProxy(hc); err != nil {
+			return err
+		}
+	}
+	if err := next.LoadArchive(); err != nil {
+		return err
+	}
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	sc.source, sc.store, sc.dumpdir, sc.manifestDir = next.source, next.store, next.dumpdir, next.manifestDir
+	sc.reader, sc.originalBaseUrl, sc.storageMeta = next.reader, next.originalBaseUrl, next.storageMeta
+	sc.proxy, sc.isPast = next.proxy, next.isPast
+	sc.history, sc.historyStart, sc.historyEnd = next.history, next.historyStart, next.historyEnd
+	sc.logger.Info().Str("dumpdir", cmp.Or(next.source, next.dumpdir)).Msg("Switched recording")
+	return nil
+}
+
 // AddManifest adds a manifest to the archive
 // This is called for on-the-fly timeshift
 func (sc *StreamReplay) AddManifest(filepath string, ctime time.Time) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
 	sc.history = append(sc.history, HistoryElement{At: ctime, Filename: path.Base(filepath)})
 
 }
@@ -81,20 +195,17 @@ func (sc *StreamReplay) AddManifest(filepath string, ctime time.Time) {
 // fillData scans manifestDir and fills history with timestamp->filename
 // it will also find first and last TimeLine date in history
 func (sc *StreamReplay) fillData() error {
-	files, err := os.ReadDir(sc.manifestDir)
+	manifests, err := ListManifests(sc.store, sc.manifestDir)
 	if err != nil {
 		sc.logger.Error().Err(err).Msg("Scan directories")
 		return err
 	}
 	var lasttime time.Time
-	for _, f := range files {
-		if f.IsDir() {
-			continue
-		}
-		sc.logger.Trace().Msg(f.Name())
-		ctime, err := time.Parse(ManifestFormat, f.Name())
-		if err != nil {
-			sc.logger.Warn().Err(err).Msg("Parse String")
+	for _, he := range manifests {
+		sc.logger.Trace().Msg(he.Filename)
+		ctime := he.At
+		if ctime.Before(sc.storageMeta.RetainedFrom) {
+			// Outside the retained range
 			continue
 		}
 		if !lasttime.IsZero() && (ctime.Sub(lasttime) > time.Second*30) {
@@ -103,7 +214,7 @@ func (sc *StreamReplay) fillData() error {
 			sc.history = sc.history[:0]
 		}
 
-		sc.history = append(sc.history, HistoryElement{At: ctime, Filename: f.Name()})
+		sc.history = append(sc.history, he)
 	}
 	// Find last pts in both first and last manifest
 	fs := sc.history[0].At
@@ -169,33 +280,35 @@ func (sc *StreamReplay) getLoopMeta(at, now time.Time, requestDuration time.Dura
 	return
 }
 
-// AdjustMpd adds a time offset to each Period in the Manifest, shifting the PresentationTime
+// AdjustMpd moves all times of the Manifest by shift: Period starts, publishTime and availabilityEndTime
+// Events are relative to their Period and move with it. UTCTiming is replaced by utcTiming, if given
 // Note that this will change the mpd, which only is not problem if its freshly reloaded
-func (sc *StreamReplay) AdjustMpd(mpde *mpd.MPD, shift time.Duration, localMedia bool) {
-	if len(mpde.Period) == 0 {
-		return
-	}
-	for _, period := range mpde.Period {
-
-		// Shift periods
-		if period.Start != nil {
-			startmed, _ := (*period.Start).ToNanoseconds()
-			start := time.Duration(startmed)
-			*period.Start = DurationToXsdDuration(start + shift)
-		}
-		// Expand to full URL first
-		if sc.originalBaseUrl != nil && len(period.BaseURL) > 0 && period.BaseURL[0].Value != "" {
-			baseurl := period.BaseURL[0].Value
-			baseurlUrl := ConcatURL(sc.originalBaseUrl, baseurl)
-			if localMedia && !strings.HasPrefix(baseurlUrl.String(), "https://svc49.cdn-t0.tv.telekom.net/") {
-
-				period.BaseURL[0].Value = baseurlUrl.Path[1:]
-			} else {
-				period.BaseURL[0].Value = baseurlUrl.String()
+func (sc *StreamReplay) AdjustMpd(mpde *mpd.MPD, shift time.Duration, utcTiming *mpd.Descriptor) {
+	for i, period := range mpde.Period {
+		if period.Start == nil {
+			if i > 0 {
+				// Follows the previous period
+				continue
 			}
+			zero := DurationToXsdDuration(0)
+			period.Start = &zero
 		}
+		// Shift periods
+		startmed, _ := (*period.Start).ToNanoseconds()
+		start := time.Duration(startmed)
+		*period.Start = DurationToXsdDuration(start + shift)
+	}
+	if mpde.PublishTime != nil {
+		publishTime := xsd.DateTime(time.Time(*mpde.PublishTime).Add(shift))
+		mpde.PublishTime = &publishTime
+	}
+	if mpde.AvailabilityEndTime != nil {
+		endTime := xsd.DateTime(time.Time(*mpde.AvailabilityEndTime).Add(shift))
+		mpde.AvailabilityEndTime = &endTime
+	}
+	if utcTiming != nil {
+		mpde.UTCTiming = utcTiming
 	}
-	return
 }
 
 // Find a manifest at time 'at'
@@ -206,7 +319,7 @@ func (sc *StreamReplay) loadHistoricMpd(at time.Time) (*mpd.MPD, error) {
 	if sourceElement == nil {
 		return nil, errors.New("No source found")
 	}
-	buf, err := os.ReadFile(sourceElement.Filename)
+	buf, err := sc.reader.Read(sourceElement.Filename)
 	if err != nil {
 		return nil, fmt.Errorf("Reading %s: %s", sourceElement.Filename, err)
 	}
@@ -218,7 +331,10 @@ func (sc *StreamReplay) loadHistoricMpd(at time.Time) (*mpd.MPD, error) {
 }
 
 // GetLooped generates a Manifest by finding the manifest before now%duration
-func (sc *StreamReplay) GetLooped(at, now time.Time, requestDuration time.Duration) ([]byte, error) {
+// utcTiming replaces UTCTiming, if not nil
+func (sc *StreamReplay) GetLooped(at, now time.Time, requestDuration time.Duration, utcTiming *mpd.Descriptor) ([]byte, error) {
+	sc.mutex.RLock()
+	defer sc.mutex.RUnlock()
 
 	offset, shift, duration, startOfRecording := sc.getLoopMeta(at, at, requestDuration)
 	sc.logger.Info().Msgf("Offset: %s TimeShift: %s LoopDuration: %s LoopStart:%s Original At %s",
@@ -228,12 +344,13 @@ func (sc *StreamReplay) GetLooped(at, now time.Time, requestDuration time.Durati
 		return []byte{}, err
 	}
 
-	sc.AdjustMpd(mpdCurrent, shift, sc.storageMeta.HaveMedia) // Manipulate
-
-	//sc.logger.Info().Msgf("Move period: %s", startOfRecording.Add(shift))
-	// Upate Publish time
-	publishTime := xsd.DateTime(time.Now().UTC())
-	mpdCurrent.PublishTime = &publishTime
+	mpdCurrent = sc.storageMeta.Filter.Apply(mpdCurrent)
+	sc.AdjustMpd(mpdCurrent, shift, utcTiming) // Manipulate
+	if sc.proxy != nil {
+		// Recorded manifests are loaded on demand, their hosts are allowed when served
+		sc.proxy.AllowManifest(mpdCurrent, sc.originalBaseUrl)
+	}
+	mpdCurrent = proxyRewriter(sc.rewriter, sc.proxy, sc.storageMeta.HaveMedia).Apply(mpdCurrent, sc.originalBaseUrl, sc.storageMeta.HaveMedia)
 
 	// re-encode
 	afterEncode, err := mpdCurrent.Encode()
@@ -244,14 +361,23 @@ func (sc *StreamReplay) GetLooped(at, now time.Time, requestDuration time.Durati
 }
 
 // GetArchived generates a Manifest by finding the manifest closest
-func (sc *StreamReplay) GetArchived(timeShift time.Duration, at time.Time) ([]byte, error) {
+// utcTiming replaces UTCTiming, if not nil
+func (sc *StreamReplay) GetArchived(timeShift time.Duration, at time.Time, utcTiming *mpd.Descriptor) ([]byte, error) {
+	sc.mutex.RLock()
+	defer sc.mutex.RUnlock()
 
 	mpdCurrent, err := sc.loadHistoricMpd(at.Add(-timeShift))
 	if err != nil {
 		return []byte{}, err
 	}
+	mpdCurrent = sc.storageMeta.Filter.Apply(mpdCurrent)
 	// This must be constant for all updates of this session
-	sc.AdjustMpd(mpdCurrent, timeShift, sc.storageMeta.HaveMedia) // Manipulate
+	sc.AdjustMpd(mpdCurrent, timeShift, utcTiming) // Manipulate
+	if sc.proxy != nil {
+		// Recorded manifests are loaded on demand, their hosts are allowed when served
+		sc.proxy.AllowManifest(mpdCurrent, sc.originalBaseUrl)
+	}
+	mpdCurrent = proxyRewriter(sc.rewriter, sc.proxy, sc.storageMeta.HaveMedia).Apply(mpdCurrent, sc.originalBaseUrl, sc.storageMeta.HaveMedia)
 
 	sc.logger.Debug().Msgf("Move period: %s", timeShift)
 
@@ -392,12 +518,17 @@ func (sc *StreamReplay) Handler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	*/
+	// Clients sync to our clock, the content is moved to it
+	utcTiming := sc.timeServer.UTCTiming(r)
 	var buf []byte
 	var err error
-	if sc.isPast {
-		buf, err = sc.GetLooped(startat, now, duration)
+	sc.mutex.RLock()
+	isPast := sc.isPast
+	sc.mutex.RUnlock()
+	if isPast {
+		buf, err = sc.GetLooped(startat, now, duration, utcTiming)
 	} else {
-		buf, err = sc.GetArchived(timeShift, now)
+		buf, err = sc.GetArchived(timeShift, now, utcTiming)
 	}
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
@@ -409,9 +540,17 @@ func (sc *StreamReplay) Handler(w http.ResponseWriter, r *http.Request) {
 
 // FileHandler serves data
 func (sc *StreamReplay) FileHandler(w http.ResponseWriter, r *http.Request) {
-	filepath := path.Join(sc.dumpdir, r.URL.Path)
+	// Not locked while serving, slow clients would block Switch
+	sc.mutex.RLock()
+	store, dumpdir, proxy := sc.store, sc.dumpdir, sc.proxy
+	sc.mutex.RUnlock()
+	filepath := path.Join(dumpdir, r.URL.Path)
 	sc.logger.Trace().Str("path", filepath).Msg("Access")
-	http.ServeFile(w, r, filepath)
+	if proxy != nil {
+		proxy.ServeHTTP(w, r)
+		return
+	}
+	store.ServeFile(w, r, filepath)
 }
 
 func (sc *StreamReplay) ShowStats() {
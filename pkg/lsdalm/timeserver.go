@@ -0,0 +1,99 @@
+package lsdalm
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jdeisenh/lsdalm/pkg/go-mpd"
+)
+
+// UTCTiming schemes served by TimeServer
+const (
+	TimingIso    = "iso"    // urn:mpeg:dash:utc:http-iso:2014
+	TimingXsDate = "xsdate" // urn:mpeg:dash:utc:http-xsdate:2014
+	TimingHead   = "head"   // urn:mpeg:dash:utc:http-head:2014, time in the Date header
+)
+
+// timingSchemes maps the TimeServer formats to the UTCTiming schemeIdUri
+var timingSchemes = map[string]string{
+	TimingIso:    "urn:mpeg:dash:utc:http-iso:2014",
+	TimingXsDate: "urn:mpeg:dash:utc:http-xsdate:2014",
+	TimingHead:   "urn:mpeg:dash:utc:http-head:2014",
+}
+
+// TimePath is where the TimeServer is mounted; formats are served below, TimePath itself serves xsdate
+const TimePath = "/time"
+
+// TimeServer serves the server clock for UTCTiming, optionally off by Offset to simulate clock drift
+type TimeServer struct {
+	Offset time.Duration // Added to the served time
+	Format string        // Advertised in manifests, one of the Timing constants
+}
+
+// NewTimeServer creates a TimeServer advertising xsdate without offset
+func NewTimeServer() *TimeServer {
+	return &TimeServer{Format: TimingXsDate}
+}
+
+// RegisterFlags adds command line flags for all settings to fs
+func (ts *TimeServer) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&ts.Offset, "clockoffset", ts.Offset, "Add this to the time served for UTCTiming, to simulate clock drift")
+	fs.StringVar(&ts.Format, "utctiming", ts.Format, "UTCTiming format to advertise: iso, xsdate or head")
+}
+
+// Validate checks the settings
+func (ts *TimeServer) Validate() error {
+	if _, ok := timingSchemes[ts.Format]; !ok {
+		return errors.New("utctiming must be iso, xsdate or head")
+	}
+	return nil
+}
+
+// Now returns the served time
+func (ts *TimeServer) Now() time.Time {
+	return time.Now().Add(ts.Offset).UTC()
+}
+
+// ServeHTTP serves TimePath and the formats below it
+func (ts *TimeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	format := TimingXsDate
+	if i := strings.LastIndex(r.URL.Path, TimePath+"/"); i >= 0 {
+		format = r.URL.Path[i+len(TimePath)+1:]
+	}
+	now := ts.Now()
+	w.Header().Set("Cache-Control", "no-store")
+	// Overrides the automatic header
+	w.Header().Set("Date", now.Format(http.TimeFormat))
+	switch format {
+	case TimingIso, TimingXsDate:
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(now.Format("2006-01-02T15:04:05.000Z")))
+	case TimingHead:
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// UTCTiming returns the descriptor pointing to the TimeServer next to the manifest requested by r
+// The path includes the prefix a RecordingMux stripped, the server is mounted below it too
+func (ts *TimeServer) UTCTiming(r *http.Request) *mpd.Descriptor {
+	if ts == nil {
+		return nil
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	format := ts.Format
+	schemeIdUri, ok := timingSchemes[format]
+	if !ok {
+		format, schemeIdUri = TimingXsDate, timingSchemes[TimingXsDate]
+	}
+	value := (&url.URL{Scheme: scheme, Host: r.Host, Path: path.Join(mountPrefix(r), path.Dir(r.URL.Path), TimePath, format)}).String()
+	return &mpd.Descriptor{SchemeIDURI: &schemeIdUri, Value: &value}
+}
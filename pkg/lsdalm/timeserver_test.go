@@ -0,0 +1,45 @@
+package lsdalm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeServer(t *testing.T) {
+	ts := NewTimeServer()
+	ts.Offset = -time.Hour
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	for _, p := range []string{"/time", "/time/iso", "/time/xsdate"} {
+		resp, err := http.Get(server.URL + p)
+		assert.NoError(t, err)
+		var body [64]byte
+		n, _ := resp.Body.Read(body[:])
+		resp.Body.Close()
+		served, err := time.Parse(time.RFC3339, string(body[:n]))
+		assert.NoError(t, err, p)
+		assert.InDelta(t, -time.Hour, served.Sub(time.Now()), float64(5*time.Second), p)
+	}
+
+	resp, err := http.Head(server.URL + "/time/head")
+	assert.NoError(t, err)
+	served, err := http.ParseTime(resp.Header.Get("Date"))
+	assert.NoError(t, err)
+	assert.InDelta(t, -time.Hour, served.Sub(time.Now()), float64(5*time.Second))
+
+	resp, err = http.Get(server.URL + "/time/ntp")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	ts.Format = TimingHead
+	timing := ts.UTCTiming(httptest.NewRequest("GET", "http://replay:9080/ch1/manifest.mpd", nil))
+	assert.Equal(t, "urn:mpeg:dash:utc:http-head:2014", *timing.SchemeIDURI)
+	assert.Equal(t, "http://replay:9080/ch1/time/head", *timing.Value)
+	ts.Format = "ntp"
+	assert.Error(t, ts.Validate())
+}
@@ -0,0 +1,243 @@
+package lsdalm
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/jdeisenh/lsdalm/pkg/go-mpd"
+)
+
+// Actions of a RewriteRule
+const (
+	RewriteLocal = "local" // Serve from the recording, as path relative to the manifest
+	RewritePass  = "pass"  // Keep the absolute origin URL
+	RewriteProxy = "proxy" // Serve through the proxy prefix, as <target>/<scheme>/<host>/<path>
+)
+
+// DefaultProxyPrefix is the target of proxy rules without one
+const DefaultProxyPrefix = "proxy/"
+
+// RewriteRule maps the URLs starting with Prefix
+type RewriteRule struct {
+	Prefix string // Absolute URL prefix, e.g. https://cdn.example.com/live/; empty matches all
+	Action string // One of the Rewrite constants
+	Target string // local: replaces Prefix, empty keeps the URL path; proxy: the proxy prefix
+}
+
+// ParseRewriteRule parses prefix=action or prefix=action:target
+func ParseRewriteRule(s string) (RewriteRule, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return RewriteRule{}, fmt.Errorf("Rewrite rule %q: missing =", s)
+	}
+	rule := RewriteRule{Prefix: s[:i]}
+	rule.Action, rule.Target, _ = strings.Cut(s[i+1:], ":")
+	return rule, rule.Validate()
+}
+
+// Validate checks the rule
+func (rr RewriteRule) Validate() error {
+	switch rr.Action {
+	case RewriteLocal, RewriteProxy:
+	case RewritePass:
+		if rr.Target != "" {
+			return fmt.Errorf("Rewrite rule %q: pass takes no target", rr.Prefix)
+		}
+	default:
+		return fmt.Errorf("Rewrite rule %q: unknown action %q", rr.Prefix, rr.Action)
+	}
+	if rr.Prefix != "" {
+		u, err := url.Parse(rr.Prefix)
+		if err != nil {
+			return err
+		}
+		if !u.IsAbs() {
+			return fmt.Errorf("Rewrite rule %q: prefix must be an absolute URL", rr.Prefix)
+		}
+	}
+	return nil
+}
+
+// UrlRewriter decides where the BaseURLs of replayed manifests point to
+// The longest matching rule wins; without a match, Default applies
+type UrlRewriter struct {
+	Rules   []RewriteRule
+	Default string // Action without matching rule, empty: local if media was recorded, else pass
+}
+
+// RegisterFlags adds command line flags for all settings to fs
+func (ur *UrlRewriter) RegisterFlags(fs *flag.FlagSet) {
+	fs.Func("rewrite", "Rewrite media URLs: prefix=local[:path], prefix=pass or prefix=proxy[:prefix], repeatable", func(v string) error {
+		rule, err := ParseRewriteRule(v)
+		if err != nil {
+			return err
+		}
+		ur.Rules = append(ur.Rules, rule)
+		return nil
+	})
+	fs.StringVar(&ur.Default, "rewritedefault", "", "Rewrite action for URLs without matching rule (default local if media was recorded, else pass)")
+}
+
+// Validate checks the settings
+func (ur *UrlRewriter) Validate() error {
+	if ur.Default != "" {
+		if err := (RewriteRule{Action: ur.Default}).Validate(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range ur.Rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rewrite returns the URL to advertise for the absolute URL u
+// Local and proxy URLs are relative to the manifest
+func (ur *UrlRewriter) Rewrite(u *url.URL, localMedia bool) string {
+	s := u.String()
+	rule := RewriteRule{Action: RewritePass}
+	if localMedia {
+		rule.Action = RewriteLocal
+	}
+	if ur != nil {
+		rule.Action = cmp.Or(ur.Default, rule.Action)
+		matched := -1
+		for _, r := range ur.Rules {
+			if strings.HasPrefix(s, r.Prefix) && len(r.Prefix) > matched {
+				rule, matched = r, len(r.Prefix)
+			}
+		}
+	}
+	switch rule.Action {
+	case RewriteLocal:
+		if rule.Target != "" {
+			return rule.Target + strings.TrimPrefix(s, rule.Prefix)
+		}
+		return strings.TrimPrefix(u.Path, "/")
+	case RewriteProxy:
+		return ProxyPath(cmp.Or(rule.Target, DefaultProxyPrefix), u)
+	default:
+		return s
+	}
+}
+
+// ProxyPath returns the path below prefix that the proxy maps back to u
+func ProxyPath(prefix string, u *url.URL) string {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix + u.Scheme + "/" + u.Host + u.EscapedPath()
+}
+
+// ProxyUrl maps a path below the proxy prefix, as returned by ProxyPath, back to the URL
+func ProxyUrl(proxyPath string) (*url.URL, error) {
+	scheme, rest, _ := strings.Cut(strings.TrimPrefix(proxyPath, "/"), "/")
+	host, p, _ := strings.Cut(rest, "/")
+	if (scheme != "http" && scheme != "https") || host == "" {
+		return nil, errors.New("Invalid proxy path")
+	}
+	return url.Parse(scheme + "://" + host + "/" + p)
+}
+
+// Apply returns a copy of mpde with rewritten BaseURLs. The input is not modified
+// originalBase is the directory of the original manifest. MPD level BaseURLs are folded into the Periods,
+// which always get one; AdaptationSet and Representation BaseURLs are kept relative to their parent
+func (ur *UrlRewriter) Apply(mpde *mpd.MPD, originalBase *url.URL, localMedia bool) *mpd.MPD {
+	if mpde == nil || len(mpde.Period) == 0 || originalBase == nil {
+		return mpde
+	}
+	base := originalBase.JoinPath("/")
+	if len(mpde.BaseURL) > 0 {
+		base = ConcatURL(base, mpde.BaseURL[0].Value)
+	}
+	out := Copy(mpde)
+	out.BaseURL = nil
+	out.Period = make([]*mpd.Period, 0, len(mpde.Period))
+	for _, period := range mpde.Period {
+		np := Copy(period)
+		periodBase := base
+		nburl := new(mpd.BaseURL)
+		if len(period.BaseURL) > 0 {
+			*nburl = *period.BaseURL[0]
+			periodBase = ConcatURL(base, nburl.Value)
+		}
+		if periodBase == nil {
+			out.Period = append(out.Period, np)
+			continue
+		}
+		periodValue := ur.Rewrite(periodBase, localMedia)
+		nburl.Value = periodValue
+		np.BaseURL = []*mpd.BaseURL{nburl}
+		np.AdaptationSets = make([]*mpd.AdaptationSet, 0, len(period.AdaptationSets))
+		for _, as := range period.AdaptationSets {
+			nas := Copy(as)
+			asBase, asValue := periodBase, periodValue
+			nas.BaseURL, asBase, asValue = ur.rewriteChild(as.BaseURL, asBase, asValue, localMedia)
+			nas.Representations = make([]mpd.Representation, 0, len(as.Representations))
+			for _, rep := range as.Representations {
+				rep.BaseURL, _, _ = ur.rewriteChild(rep.BaseURL, asBase, asValue, localMedia)
+				nas.Representations = append(nas.Representations, rep)
+			}
+			np.AdaptationSets = append(np.AdaptationSets, nas)
+		}
+		out.Period = append(out.Period, np)
+	}
+	return out
+}
+
+// rewriteChild rewrites the first of the BaseURLs below a parent with the resolved URL parentBase,
+// advertised as parentValue. It returns the new BaseURLs and the resolved and advertised URL of the child
+func (ur *UrlRewriter) rewriteChild(baseUrls []*mpd.BaseURL, parentBase *url.URL, parentValue string, localMedia bool) ([]*mpd.BaseURL, *url.URL, string) {
+	if len(baseUrls) == 0 {
+		return nil, parentBase, parentValue
+	}
+	childBase := ConcatURL(parentBase, baseUrls[0].Value)
+	if childBase == nil {
+		return baseUrls[:1], parentBase, parentValue
+	}
+	value := ur.Rewrite(childBase, localMedia)
+	nburl := new(mpd.BaseURL)
+	*nburl = *baseUrls[0]
+	nburl.Value = value
+	dir := parentValue[:strings.LastIndex(parentValue, "/")+1]
+	switch {
+	case dir != "" && strings.HasPrefix(value, dir):
+		nburl.Value = value[len(dir):]
+	case isAbsUrl(value):
+		// Absolute overrides the parent
+	case isAbsUrl(parentValue):
+		// A relative child would resolve against the parents origin, keep the original
+		value = childBase.String()
+		nburl.Value = value
+	default:
+		nburl.Value = relativeRef(parentValue, value)
+	}
+	return []*mpd.BaseURL{nburl}, childBase, value
+}
+
+// isAbsUrl returns true if s has a scheme
+func isAbsUrl(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.IsAbs()
+}
+
+// relativeRef returns a reference that resolves to target against base, both relative paths
+func relativeRef(base, target string) string {
+	dir := base[:strings.LastIndex(base, "/")+1]
+	if dir == "" {
+		return target
+	}
+	baseParts := strings.Split(strings.TrimSuffix(dir, "/"), "/")
+	targetParts := strings.Split(target, "/")
+	common := 0
+	for common < len(baseParts) && common < len(targetParts)-1 && baseParts[common] == targetParts[common] {
+		common++
+	}
+	return strings.Repeat("../", len(baseParts)-common) + strings.Join(targetParts[common:], "/")
+}
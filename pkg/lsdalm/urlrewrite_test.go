@@ -0,0 +1,80 @@
+package lsdalm
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/jdeisenh/lsdalm/pkg/go-mpd"
+	"github.com/stretchr/testify/assert"
+)
+
+// rewriteTestMpd has BaseURLs on all levels
+func rewriteTestMpd() *mpd.MPD {
+	return &mpd.MPD{
+		BaseURL: []*mpd.BaseURL{{Value: "dash/"}},
+		Period: []*mpd.Period{{
+			BaseURL: []*mpd.BaseURL{{Value: "p1/"}},
+			AdaptationSets: []*mpd.AdaptationSet{
+				{
+					BaseURL: []*mpd.BaseURL{{Value: "video/"}},
+					Representations: []mpd.Representation{
+						{BaseURL: []*mpd.BaseURL{{Value: "v1/"}}},
+						{},
+					},
+				},
+				{
+					BaseURL: []*mpd.BaseURL{{Value: "https://audio.example.com/a/"}},
+				},
+			},
+		}},
+	}
+}
+
+func TestUrlRewriter(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/live")
+	baseUrls := func(m *mpd.MPD) []string {
+		p := m.Period[0]
+		return []string{
+			p.BaseURL[0].Value,
+			p.AdaptationSets[0].BaseURL[0].Value,
+			p.AdaptationSets[0].Representations[0].BaseURL[0].Value,
+			p.AdaptationSets[1].BaseURL[0].Value,
+		}
+	}
+	var testdata = []struct {
+		rules      []string
+		localMedia bool
+		expect     []string
+	}{
+		{nil, true, []string{"live/dash/p1/", "video/", "v1/", "../../../a/"}},
+		{nil, false, []string{"https://cdn.example.com/live/dash/p1/", "video/", "v1/", "https://audio.example.com/a/"}},
+		{[]string{"https://audio.example.com/=pass"}, true, []string{"live/dash/p1/", "video/", "v1/", "https://audio.example.com/a/"}},
+		{[]string{"https://audio.example.com/=proxy"}, true, []string{"live/dash/p1/", "video/", "v1/", "../../../proxy/https/audio.example.com/a/"}},
+		{[]string{"https://cdn.example.com/live/dash/=local:rec/"}, true, []string{"rec/p1/", "video/", "v1/", "../../a/"}},
+		{[]string{"https://cdn.example.com/live/dash/p1/video/=pass"}, true, []string{"live/dash/p1/", "https://cdn.example.com/live/dash/p1/video/", "v1/", "../../../a/"}},
+	}
+	for _, elem := range testdata {
+		var ur UrlRewriter
+		for _, r := range elem.rules {
+			rule, err := ParseRewriteRule(r)
+			assert.NoError(t, err)
+			ur.Rules = append(ur.Rules, rule)
+		}
+		in := rewriteTestMpd()
+		out := ur.Apply(in, base, elem.localMedia)
+		assert.Nil(t, out.BaseURL)
+		assert.Equal(t, elem.expect, baseUrls(out), elem.rules)
+		// Input untouched
+		assert.Equal(t, rewriteTestMpd(), in)
+	}
+
+	_, err := ParseRewriteRule("cdn.example.com=local")
+	assert.Error(t, err)
+	_, err = ParseRewriteRule("https://cdn.example.com/=drop")
+	assert.Error(t, err)
+
+	u, _ := url.Parse("https://audio.example.com/a/x.m4s")
+	back, err := ProxyUrl(ProxyPath("", u))
+	assert.NoError(t, err)
+	assert.Equal(t, u, back)
+}
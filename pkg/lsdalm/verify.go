@@ -0,0 +1,342 @@
+package lsdalm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/jdeisenh/lsdalm/pkg/go-mpd"
+	"github.com/rs/zerolog"
+)
+
+const maxProblemsListed = 20 // Max number of problem segments listed per representation
+
+// Problems found with a stored segment
+const (
+	ProblemMissing     = "missing"
+	ProblemEmpty       = "empty"
+	ProblemUndecodable = "undecodable"
+)
+
+// SegmentProblem is a segment announced in a manifest, but not stored correctly
+type SegmentProblem struct {
+	Url     string    `json:"url"`
+	At      time.Time `json:"at,omitempty"`
+	Problem string    `json:"problem"` // One of the Problem constants
+}
+
+// RepVerify is the result for one representation
+type RepVerify struct {
+	RepId       string           `json:"representation"`
+	Track       string           `json:"track"`
+	Segments    int              `json:"segments"`
+	Present     int              `json:"present"`
+	Missing     int              `json:"missing"`
+	Empty       int              `json:"empty"`
+	Undecodable int              `json:"undecodable"`
+	Problems    []SegmentProblem `json:"problems,omitempty"` // The first ones only
+}
+
+// TimeGap is a gap in manifest polling or a discontinuity in a timeline
+type TimeGap struct {
+	RepId  string    `json:"representation,omitempty"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Length Duration  `json:"length"` // Negative for overlaps
+}
+
+// VerifyReport is the result of a recording verification
+type VerifyReport struct {
+	Dir             string      `json:"dir"`
+	ManifestUrl     string      `json:"manifestUrl"`
+	HaveMedia       bool        `json:"haveMedia"`
+	Manifests       int         `json:"manifests"`
+	Undecodable     int         `json:"undecodableManifests"`
+	First           time.Time   `json:"first"`
+	Last            time.Time   `json:"last"`
+	PollGaps        []TimeGap   `json:"pollGaps"`
+	Discontinuities []TimeGap   `json:"discontinuities"`
+	Reps            []RepVerify `json:"representations"`
+	NotFetched      int         `json:"notFetched,omitempty"` // Announced only outside the fetch window of the recorder
+	Refetched       int         `json:"refetched,omitempty"`
+	RefetchFailed   int         `json:"refetchFailed,omitempty"`
+
+	problems []SegmentInfo // All segments with problems
+	baseUrl  *url.URL
+	store    Storage
+	dumpdir  string // Path in store
+}
+
+// HasProblems returns true if segments are broken or the recording has gaps
+func (vr *VerifyReport) HasProblems() bool {
+	if len(vr.PollGaps) > 0 || len(vr.Discontinuities) > 0 || vr.Undecodable > 0 {
+		return true
+	}
+	return len(vr.problems) > vr.Refetched
+}
+
+// VerifyRecording checks the manifests and media of the recording in dumpdir,
+// a local directory or s3://bucket/prefix
+func VerifyRecording(spec string, logger zerolog.Logger) (*VerifyReport, error) {
+	store, dumpdir, err := OpenStorage(spec)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := ReadStorageMeta(store, dumpdir)
+	if err != nil {
+		return nil, fmt.Errorf("Read metadata: %w", err)
+	}
+	vr := &VerifyReport{
+		Dir:         spec,
+		ManifestUrl: meta.ManifestUrl,
+		HaveMedia:   meta.HaveMedia,
+		store:       store,
+		dumpdir:     dumpdir,
+	}
+	vr.baseUrl, err = url.Parse(meta.MediaBase())
+	if err != nil {
+		return nil, err
+	}
+	// Old recordings do not have the fetch window, assume the default
+	window := fetchWindow
+	if meta.FetchWindow != nil {
+		window = time.Duration(*meta.FetchWindow)
+	}
+
+	manifestDir := path.Join(dumpdir, ManifestPath)
+	manifests, err := ListManifests(store, manifestDir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make(map[string]SegmentInfo)
+	outside := make(map[string]bool) // Announced outside the fetch window
+	reader := NewManifestReader(store)
+	var lastFile string
+	for i, he := range manifests {
+		at := he.At
+		if at.Before(meta.RetainedFrom) {
+			continue
+		}
+		if !vr.Last.IsZero() && at.Sub(vr.Last) > maxMpdGap {
+			vr.PollGaps = append(vr.PollGaps, TimeGap{From: vr.Last, To: at, Length: Duration(at.Sub(vr.Last))})
+		}
+		if vr.First.IsZero() {
+			vr.First = at
+		}
+		vr.Last = at
+		vr.Manifests++
+		if he.Filename == lastFile {
+			// Deduplicated poll
+			continue
+		}
+		lastFile = he.Filename
+
+		buf, err := reader.Read(path.Join(manifestDir, he.Filename))
+		if err != nil {
+			return nil, err
+		}
+		mpde := new(mpd.MPD)
+		if err := mpde.Decode(buf); err != nil {
+			logger.Warn().Err(err).Str("manifest", he.Filename).Msg("Decode")
+			vr.Undecodable++
+			continue
+		}
+		// The recorder skips segments older than the fetch window at poll time, except for the backfill
+		// of the DVR window of its first manifest
+		backfilled := meta.Backfill && i == 0 && meta.RetainedFrom.IsZero()
+		OnAllSegmentUrls(mpde, vr.baseUrl, func(seg SegmentInfo) error {
+			if _, ok := segments[seg.Url.Path]; ok {
+				return nil
+			}
+			if !seg.At.IsZero() && window > 0 && at.Sub(seg.At) > window && !backfilled {
+				outside[seg.Url.Path] = true
+				return nil
+			}
+			segments[seg.Url.Path] = seg
+			return nil
+		})
+	}
+	if vr.Manifests == 0 {
+		return nil, errors.New("No manifests")
+	}
+	for p := range outside {
+		if _, ok := segments[p]; !ok {
+			vr.NotFetched++
+		}
+	}
+
+	// Sort by representation and time
+	all := make([]SegmentInfo, 0, len(segments))
+	for _, seg := range segments {
+		all = append(all, seg)
+	}
+	slices.SortFunc(all, func(a, b SegmentInfo) int {
+		if c := strings.Compare(a.RepId, b.RepId); c != 0 {
+			return c
+		}
+		return a.At.Compare(b.At)
+	})
+
+	var rv *RepVerify
+	var last SegmentInfo
+	for _, seg := range all {
+		if rv == nil || rv.RepId != seg.RepId {
+			vr.Reps = append(vr.Reps, RepVerify{RepId: seg.RepId, Track: seg.Track})
+			rv = &vr.Reps[len(vr.Reps)-1]
+			last = SegmentInfo{}
+		}
+		rv.Segments++
+		if !seg.At.IsZero() {
+			if !last.At.IsZero() {
+				expected := last.At.Add(last.D)
+				if diff := seg.At.Sub(expected); diff > maxTimeDiff || diff < -maxTimeDiff {
+					vr.Discontinuities = append(vr.Discontinuities, TimeGap{RepId: seg.RepId, From: expected, To: seg.At, Length: Duration(diff)})
+				}
+			}
+			last = seg
+		}
+		if !vr.HaveMedia {
+			continue
+		}
+		problem := checkStoredSegment(store, path.Join(dumpdir, seg.Url.Path), seg.At.IsZero())
+		switch problem {
+		case "":
+			rv.Present++
+			continue
+		case ProblemMissing:
+			rv.Missing++
+		case ProblemEmpty:
+			rv.Empty++
+		case ProblemUndecodable:
+			rv.Undecodable++
+		}
+		vr.problems = append(vr.problems, seg)
+		if len(rv.Problems) < maxProblemsListed {
+			rv.Problems = append(rv.Problems, SegmentProblem{Url: seg.Url.String(), At: seg.At, Problem: problem})
+		}
+	}
+	return vr, nil
+}
+
+// checkStoredSegment returns the problem of a stored segment, "" if ok
+func checkStoredSegment(store Storage, localpath string, isInit bool) string {
+	buf, err := store.ReadFile(localpath)
+	if err != nil {
+		return ProblemMissing
+	}
+	return checkSegmentData(buf, isInit)
+}
+
+// checkSegmentData returns the problem of segment data, "" if ok
+func checkSegmentData(buf []byte, isInit bool) string {
+	if len(buf) == 0 {
+		return ProblemEmpty
+	}
+	parsed, err := mp4.DecodeFile(bytes.NewReader(buf), mp4.WithDecodeMode(mp4.DecModeLazyMdat))
+	if err != nil {
+		return ProblemUndecodable
+	}
+	if isInit {
+		if parsed.Init == nil || parsed.Init.Moov == nil {
+			return ProblemUndecodable
+		}
+	} else if len(parsed.Segments) == 0 || len(parsed.Segments[0].Fragments) == 0 {
+		return ProblemUndecodable
+	}
+	return ""
+}
+
+// Refetch downloads the problem segments still announced by the live manifest, of the session if any
+func (vr *VerifyReport) Refetch(ctx context.Context, client *http.Client, rp RetryPolicy, logger zerolog.Logger) error {
+	if len(vr.problems) == 0 {
+		return nil
+	}
+	res, err := rp.Do(ctx, client, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", vr.baseUrl.String(), nil)
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if res.Resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Manifest status %d", res.Resp.StatusCode)
+	}
+	mpde := new(mpd.MPD)
+	if err := mpde.Decode(res.Body); err != nil {
+		return err
+	}
+	// Segments still in the DVR window
+	available := make(map[string]bool)
+	OnAllSegmentUrls(mpde, vr.baseUrl, func(seg SegmentInfo) error {
+		available[seg.Url.Path] = true
+		return nil
+	})
+
+	for _, seg := range vr.problems {
+		if !available[seg.Url.Path] {
+			continue
+		}
+		if err := vr.refetchSegment(ctx, client, rp, seg); err != nil {
+			logger.Warn().Err(err).Str("url", seg.Url.String()).Msg("Refetch")
+			vr.RefetchFailed++
+			continue
+		}
+		logger.Debug().Str("url", seg.Url.String()).Msg("Refetched")
+		vr.Refetched++
+	}
+	return nil
+}
+
+// refetchSegment downloads and stores a single segment
+func (vr *VerifyReport) refetchSegment(ctx context.Context, client *http.Client, rp RetryPolicy, seg SegmentInfo) error {
+	res, err := rp.Do(ctx, client, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", seg.Url.String(), nil)
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if res.Resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Status %d", res.Resp.StatusCode)
+	}
+	if problem := checkSegmentData(res.Body, seg.At.IsZero()); problem != "" {
+		return errors.New("Refetched segment is " + problem)
+	}
+	return vr.store.WriteFile(path.Join(vr.dumpdir, seg.Url.Path), res.Body)
+}
+
+// WriteText writes a human readable summary
+func (vr *VerifyReport) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Recording %s\nSource    %s\n", vr.Dir, vr.ManifestUrl)
+	fmt.Fprintf(w, "Manifests %d from %s to %s (%s), %d undecodable\n",
+		vr.Manifests, vr.First.Format(time.DateTime), vr.Last.Format(time.DateTime), vr.Last.Sub(vr.First), vr.Undecodable)
+	for _, g := range vr.PollGaps {
+		fmt.Fprintf(w, "Poll gap       %s - %s (%s)\n", g.From.Format(time.TimeOnly), g.To.Format(time.TimeOnly), time.Duration(g.Length))
+	}
+	for _, g := range vr.Discontinuities {
+		fmt.Fprintf(w, "Discontinuity  %-12s at %s (%s)\n", g.RepId, g.From.Format(dateShortFmt), time.Duration(g.Length))
+	}
+	if vr.NotFetched > 0 {
+		fmt.Fprintf(w, "Not fetched    %d segments outside the fetch window\n", vr.NotFetched)
+	}
+	for _, rv := range vr.Reps {
+		fmt.Fprintf(w, "%-12s %-16s %6d segments", rv.RepId, rv.Track, rv.Segments)
+		if vr.HaveMedia {
+			fmt.Fprintf(w, " %6d present %4d missing %4d empty %4d undecodable", rv.Present, rv.Missing, rv.Empty, rv.Undecodable)
+		}
+		fmt.Fprintln(w)
+		for _, p := range rv.Problems {
+			fmt.Fprintf(w, "  %-11s %s\n", p.Problem, p.Url)
+		}
+	}
+	if vr.Refetched > 0 || vr.RefetchFailed > 0 {
+		fmt.Fprintf(w, "Refetched %d segments, %d failed\n", vr.Refetched, vr.RefetchFailed)
+	}
+}
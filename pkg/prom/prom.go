@@ -8,6 +8,24 @@ const (
 
 var (
 	Processed prometheus.Counter
+
+	// Segment fetch metrics, labeled by channel and representation
+	SegmentFetchSeconds *prometheus.HistogramVec
+	SegmentTtfbSeconds  *prometheus.HistogramVec
+	SegmentBytes        *prometheus.CounterVec
+	SegmentRequests     *prometheus.CounterVec
+	SegmentEarly        *prometheus.CounterVec
+
+	// Final outcome of requests with retries, labeled by channel, kind (manifest, segment) and outcome
+	FetchOutcome *prometheus.CounterVec
+
+	// Segment fetch queue, labeled by channel and representation (and drop reason)
+	FetchQueueDepth   *prometheus.GaugeVec
+	FetchQueueDropped *prometheus.CounterVec
+
+	// Segment availability probes, labeled by channel, track and result
+	SegmentAvailability      *prometheus.CounterVec
+	SegmentAvailabilityDelay *prometheus.HistogramVec
 )
 
 func init() {
@@ -16,5 +34,59 @@ func init() {
 		Name:      "processed",
 		Help:      "Processed Manifests",
 	})
-	prometheus.MustRegister(Processed)
+	SegmentFetchSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "segment_fetch_seconds",
+		Help:      "Total download time of media segments",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"channel", "representation"})
+	SegmentTtfbSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "segment_ttfb_seconds",
+		Help:      "Time to first byte of media segments",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"channel", "representation"})
+	SegmentBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "segment_bytes_total",
+		Help:      "Bytes received for media segments",
+	}, []string{"channel", "representation"})
+	SegmentRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "segment_requests_total",
+		Help:      "Media segment requests by status and cache result",
+	}, []string{"channel", "representation", "status", "cache"})
+	SegmentEarly = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "segment_early_total",
+		Help:      "Media segments served before they were complete",
+	}, []string{"channel", "representation"})
+	FetchOutcome = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "fetch_outcome_total",
+		Help:      "Requests succeeding at once, after retries, or failing permanently",
+	}, []string{"channel", "kind", "outcome"})
+	SegmentAvailability = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "segment_availability_total",
+		Help:      "Availability probe results of announced segments",
+	}, []string{"channel", "track", "result"})
+	SegmentAvailabilityDelay = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "segment_availability_delay_seconds",
+		Help:      "Delay from announced to real availability of segments, negative if early",
+		Buckets:   []float64{-2, -1, -0.5, -0.1, 0, 0.1, 0.25, 0.5, 1, 2, 5, 10},
+	}, []string{"channel", "track"})
+	FetchQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "fetch_queue_depth",
+		Help:      "Media segments queued for fetching",
+	}, []string{"channel", "representation"})
+	FetchQueueDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "fetch_queue_dropped_total",
+		Help:      "Queued media segments dropped before fetching",
+	}, []string{"channel", "representation", "reason"})
+	prometheus.MustRegister(Processed, SegmentFetchSeconds, SegmentTtfbSeconds, SegmentBytes, SegmentRequests, SegmentEarly, FetchOutcome,
+		FetchQueueDepth, FetchQueueDropped, SegmentAvailability, SegmentAvailabilityDelay)
 }